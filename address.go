@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcutil/bech32"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/crypto/ripemd160"
+)
+
+// DerivedKey is the output of the derive command
+type DerivedKey struct {
+	DerivePath            string `json:"derive_path"`
+	PublicKey             string `json:"public_key"`
+	PublicKeyUncompressed string `json:"public_key_uncompressed,omitempty"`
+	BitcoinAddress        string `json:"bitcoin_address,omitempty"`
+	EthereumAddress       string `json:"ethereum_address,omitempty"`
+	CosmosAddress         string `json:"cosmos_address,omitempty"`
+	// WatchOnly is set when the parties can't sign with the key, e.g. a child EdDSA key
+	WatchOnly bool `json:"watch_only,omitempty"`
+}
+
+// NewDerivedKey builds the addresses of a derived public key, addresses are only computed for ECDSA keys
+func NewDerivedKey(derivePath string, publicKey []byte, isEdDSA bool) (*DerivedKey, error) {
+	if isEdDSA {
+		return &DerivedKey{
+			DerivePath: derivePath,
+			PublicKey:  hex.EncodeToString(publicKey),
+		}, nil
+	}
+	pubKey, err := secp256k1.ParsePubKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	compressed := pubKey.SerializeCompressed()
+	bitcoinAddress, err := getBitcoinAddress(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bitcoin address: %w", err)
+	}
+	cosmosAddress, err := getCosmosAddress(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cosmos address: %w", err)
+	}
+	return &DerivedKey{
+		DerivePath:            derivePath,
+		PublicKey:             hex.EncodeToString(compressed),
+		PublicKeyUncompressed: hex.EncodeToString(pubKey.SerializeUncompressed()),
+		BitcoinAddress:        bitcoinAddress,
+		EthereumAddress:       crypto.PubkeyToAddress(*pubKey.ToECDSA()).Hex(),
+		CosmosAddress:         cosmosAddress,
+	}, nil
+}
+
+func hash160(input []byte) []byte {
+	h := ripemd160.New()
+	h.Write(SHA256HashBytes(input))
+	return h.Sum(nil)
+}
+
+// getBitcoinAddress returns the native segwit (P2WPKH) mainnet address of a compressed public key
+func getBitcoinAddress(compressedPubKey []byte) (string, error) {
+	program, err := bech32.ConvertBits(hash160(compressedPubKey), 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	// witness version 0
+	return bech32.Encode("bc", append([]byte{0}, program...))
+}
+
+func getCosmosAddress(compressedPubKey []byte) (string, error) {
+	data, err := bech32.ConvertBits(hash160(compressedPubKey), 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	return bech32.Encode("cosmos", data)
+}
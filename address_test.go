@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcutil/bech32"
+)
+
+func TestNewDerivedKey(t *testing.T) {
+	// public key of private key 1, which is the generator point
+	publicKey, err := hex.DecodeString("0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+	if err != nil {
+		t.Fatal(err)
+	}
+	derivedKey, err := NewDerivedKey("m/84'/0'/0'/0/0", publicKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if derivedKey.BitcoinAddress != "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4" {
+		t.Errorf("unexpected bitcoin address: %s", derivedKey.BitcoinAddress)
+	}
+	if derivedKey.EthereumAddress != "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf" {
+		t.Errorf("unexpected ethereum address: %s", derivedKey.EthereumAddress)
+	}
+	hrp, data, err := bech32.Decode(derivedKey.CosmosAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := bech32.ConvertBits(data, 5, 8, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hrp != "cosmos" || hex.EncodeToString(decoded) != "751e76e8199196d454941c45d1b3a323f1433bd6" {
+		t.Errorf("unexpected cosmos address: %s", derivedKey.CosmosAddress)
+	}
+	if derivedKey.PublicKeyUncompressed[:2] != "04" {
+		t.Errorf("unexpected uncompressed public key: %s", derivedKey.PublicKeyUncompressed)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltKeysharesBucket = []byte("keyshares")
+	boltMetadataBucket  = []byte("metadata")
+)
+
+// BoltStateAccessor keeps the keyshares in a bbolt database, one top level bucket per party, so the parties
+// running on a host can share one database file. The database is only opened for the duration of a call,
+// since bbolt locks the file while it's open.
+type BoltStateAccessor struct {
+	dbFile       string
+	localPartyID string
+	shareCipher  *ShareCipher
+}
+
+var _ KeyshareStore = &BoltStateAccessor{}
+
+func NewBoltStateAccessor(dbFile string, localPartyID string, shareCipher *ShareCipher) *BoltStateAccessor {
+	return &BoltStateAccessor{
+		dbFile:       dbFile,
+		localPartyID: localPartyID,
+		shareCipher:  shareCipher,
+	}
+}
+
+// update runs fn in a read-write transaction on the keyshares and metadata buckets of local party
+func (b *BoltStateAccessor) update(fn func(keyshares, metadata *bolt.Bucket) error) error {
+	db, err := bolt.Open(b.dbFile, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return fmt.Errorf("fail to open database %s: %w", b.dbFile, err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	return db.Update(func(tx *bolt.Tx) error {
+		party, err := tx.CreateBucketIfNotExists([]byte(b.localPartyID))
+		if err != nil {
+			return fmt.Errorf("fail to create bucket %s: %w", b.localPartyID, err)
+		}
+		keyshares, err := party.CreateBucketIfNotExists(boltKeysharesBucket)
+		if err != nil {
+			return fmt.Errorf("fail to create keyshares bucket: %w", err)
+		}
+		metadata, err := party.CreateBucketIfNotExists(boltMetadataBucket)
+		if err != nil {
+			return fmt.Errorf("fail to create metadata bucket: %w", err)
+		}
+		return fn(keyshares, metadata)
+	})
+}
+
+// view runs fn in a read-only transaction, the buckets are nil when local party has nothing stored
+func (b *BoltStateAccessor) view(fn func(keyshares, metadata *bolt.Bucket) error) error {
+	db, err := bolt.Open(b.dbFile, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return fmt.Errorf("fail to open database %s: %w", b.dbFile, err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	return db.View(func(tx *bolt.Tx) error {
+		party := tx.Bucket([]byte(b.localPartyID))
+		if party == nil {
+			return fn(nil, nil)
+		}
+		return fn(party.Bucket(boltKeysharesBucket), party.Bucket(boltMetadataBucket))
+	})
+}
+
+// aad binds a sealed keyshare to the party and key it's stored under
+func (b *BoltStateAccessor) aad(pubKey string) []byte {
+	return []byte(b.localPartyID + "/" + pubKey)
+}
+
+func (b *BoltStateAccessor) GetLocalState(pubKey string) (string, error) {
+	var value []byte
+	if err := b.view(func(keyshares, _ *bolt.Bucket) error {
+		if keyshares != nil {
+			// the value is only valid during the transaction
+			if v := keyshares.Get([]byte(pubKey)); v != nil {
+				value = append([]byte{}, v...)
+			}
+		}
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	if value == nil {
+		return "", fmt.Errorf("keyshare %s does not exist", pubKey)
+	}
+	if b.shareCipher == nil {
+		if _, ok := parseEncryptedShare(value); ok {
+			return "", fmt.Errorf("keyshare %s is encrypted, passphrase file or key file is required", pubKey)
+		}
+		return string(value), nil
+	}
+	plaintext, err := b.shareCipher.Open(b.aad(pubKey), value)
+	if err != nil {
+		return "", fmt.Errorf("fail to decrypt keyshare %s: %w", pubKey, err)
+	}
+	return string(plaintext), nil
+}
+
+func (b *BoltStateAccessor) SaveLocalState(pubKey, localState string) error {
+	buf := []byte(localState)
+	if b.shareCipher != nil {
+		sealed, err := b.shareCipher.Seal(b.aad(pubKey), buf)
+		if err != nil {
+			return fmt.Errorf("fail to encrypt keyshare %s: %w", pubKey, err)
+		}
+		buf = sealed
+	}
+	return b.update(func(keyshares, _ *bolt.Bucket) error {
+		return keyshares.Put([]byte(pubKey), buf)
+	})
+}
+
+func (b *BoltStateAccessor) SaveMetadata(metadata KeyshareMetadata) error {
+	return b.update(func(_, metadataBucket *bolt.Bucket) error {
+		var previous *KeyshareMetadata
+		if v := metadataBucket.Get([]byte(metadata.PublicKey)); v != nil {
+			previous = &KeyshareMetadata{}
+			if err := json.Unmarshal(v, previous); err != nil {
+				return fmt.Errorf("fail to unmarshal metadata of %s: %w", metadata.PublicKey, err)
+			}
+		}
+		buf, err := json.Marshal(updateMetadata(previous, metadata))
+		if err != nil {
+			return fmt.Errorf("fail to marshal metadata: %w", err)
+		}
+		return metadataBucket.Put([]byte(metadata.PublicKey), buf)
+	})
+}
+
+func (b *BoltStateAccessor) List() ([]KeyshareMetadata, error) {
+	var result []KeyshareMetadata
+	err := b.view(func(keyshares, metadataBucket *bolt.Bucket) error {
+		if keyshares == nil {
+			return nil
+		}
+		return keyshares.ForEach(func(k, _ []byte) error {
+			pubKey := string(k)
+			if strings.HasSuffix(pubKey, chainCodeSuffix) || strings.HasSuffix(pubKey, pendingSuffix) || strings.Contains(pubKey, presignInfix) {
+				return nil
+			}
+			metadata := KeyshareMetadata{
+				PublicKey:    pubKey,
+				LocalPartyID: b.localPartyID,
+			}
+			if v := metadataBucket.Get(k); v != nil {
+				if err := json.Unmarshal(v, &metadata); err != nil {
+					return fmt.Errorf("fail to unmarshal metadata of %s: %w", pubKey, err)
+				}
+			} else if curve, err := curveOfPublicKey(pubKey); err == nil {
+				metadata.Curve = curve
+			}
+			result = append(result, metadata)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].PublicKey < result[j].PublicKey
+	})
+	return result, nil
+}
+
+func (b *BoltStateAccessor) Delete(pubKey string) error {
+	return b.update(func(keyshares, metadata *bolt.Bucket) error {
+		if keyshares.Get([]byte(pubKey)) == nil {
+			return fmt.Errorf("keyshare %s does not exist", pubKey)
+		}
+		if err := keyshares.Delete([]byte(pubKey)); err != nil {
+			return fmt.Errorf("fail to delete keyshare %s: %w", pubKey, err)
+		}
+		if err := keyshares.Delete([]byte(chainCodeKey(pubKey))); err != nil {
+			return fmt.Errorf("fail to delete chain code of %s: %w", pubKey, err)
+		}
+		if err := keyshares.Delete([]byte(pendingKeyshareKey(pubKey))); err != nil {
+			return fmt.Errorf("fail to delete pending keyshare of %s: %w", pubKey, err)
+		}
+		var presigns [][]byte
+		prefix := []byte(presignKey(pubKey, ""))
+		cursor := keyshares.Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			presigns = append(presigns, append([]byte{}, k...))
+		}
+		for _, k := range presigns {
+			if err := keyshares.Delete(k); err != nil {
+				return fmt.Errorf("fail to delete presign of %s: %w", pubKey, err)
+			}
+		}
+		return metadata.Delete([]byte(pubKey))
+	})
+}
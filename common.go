@@ -58,3 +58,19 @@ func GetThreshold(value int) (int, error) {
 	threshold := int(math.Ceil(float64(value)*2.0/3.0)) - 1
 	return threshold, nil
 }
+
+// ResolveThreshold returns the number of parties required to sign, when threshold is 0 the default 2/3 of the
+// committee is used, otherwise it needs to be between 2 and the committee size
+func ResolveThreshold(threshold int, committeeSize int) (int, error) {
+	if threshold == 0 {
+		defaultThreshold, err := GetThreshold(committeeSize)
+		if err != nil {
+			return 0, err
+		}
+		return defaultThreshold + 1, nil
+	}
+	if threshold < 2 || threshold > committeeSize {
+		return 0, fmt.Errorf("invalid threshold %d for a committee of %d parties", threshold, committeeSize)
+	}
+	return threshold, nil
+}
@@ -90,3 +90,37 @@ func compressPubKey(x, y *big.Int) []byte {
 	copy(compressedPubKey[1:], x.Bytes())
 	return compressedPubKey
 }
+
+func TestResolveThreshold(t *testing.T) {
+	cases := []struct {
+		threshold     int
+		committeeSize int
+		expected      int
+		expectErr     bool
+	}{
+		{0, 2, 2, false},
+		{0, 3, 2, false},
+		{0, 5, 4, false},
+		{2, 2, 2, false},
+		{3, 5, 3, false},
+		{1, 3, 0, true},
+		{4, 3, 0, true},
+		{0, 1, 0, true},
+	}
+	for _, c := range cases {
+		threshold, err := ResolveThreshold(c.threshold, c.committeeSize)
+		if c.expectErr {
+			if err == nil {
+				t.Errorf("threshold %d of %d should fail", c.threshold, c.committeeSize)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("threshold %d of %d: %v", c.threshold, c.committeeSize, err)
+			continue
+		}
+		if threshold != c.expected {
+			t.Errorf("threshold %d of %d: expect %d, got %d", c.threshold, c.committeeSize, c.expected, threshold)
+		}
+	}
+}
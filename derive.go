@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"filippo.io/edwards25519"
+)
+
+const chainCodeSuffix = "-chaincode"
+
+var ErrEdDSADerivePath = errors.New("EdDSA keysign only signs with the root key m")
+
+// chainCodeKey is the local state key the chain code is saved under, next to the keyshare
+func chainCodeKey(pubKey string) string {
+	return pubKey + chainCodeSuffix
+}
+
+// checkDerivePath rejects the derive paths the parties can't sign with. The schnorr wrapper can't tweak the
+// keyshare, so an EdDSA signature is always made with the root key.
+func (t *TssService) checkDerivePath(derivePath string) error {
+	if t.isEdDSA && derivePath != "m" {
+		return fmt.Errorf("%w, derive path %s is not supported", ErrEdDSADerivePath, derivePath)
+	}
+	return nil
+}
+
+// DeriveChildPublicKey loads the keyshare of the given public key and derives the child public key for derivePath.
+// A child EdDSA key can't be signed with, it's only derived when watchOnly is set.
+func (t *TssService) DeriveChildPublicKey(publicKey string, derivePath string, watchOnly bool) ([]byte, error) {
+	if publicKey == "" {
+		return nil, fmt.Errorf("public key is empty")
+	}
+	if derivePath == "" {
+		return nil, fmt.Errorf("derive path is empty")
+	}
+	if !watchOnly {
+		if err := t.checkDerivePath(derivePath); err != nil {
+			return nil, err
+		}
+	}
+	mpcWrapper := t.GetMPCKeygenWrapper()
+	keyshare, err := t.localStateAccessor.GetLocalState(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get keyshare: %w", err)
+	}
+	keyshareBytes, err := base64.StdEncoding.DecodeString(keyshare)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode keyshare: %w", err)
+	}
+	keyshareHandle, err := mpcWrapper.KeyshareFromBytes(keyshareBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create keyshare from bytes: %w", err)
+	}
+	defer func() {
+		if err := mpcWrapper.KeyshareFree(keyshareHandle); err != nil {
+			t.logger.Error("failed to free keyshare", "error", err)
+		}
+	}()
+	if !t.isEdDSA {
+		return mpcWrapper.KeyshareDeriveChildPublicKey(keyshareHandle, []byte(derivePath))
+	}
+	// the schnorr keyshare doesn't carry the chain code, it's saved next to the keyshare
+	chainCode, err := t.localStateAccessor.GetLocalState(chainCodeKey(publicKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chain code: %w", err)
+	}
+	chainCodeBytes, err := hex.DecodeString(chainCode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode chain code: %w", err)
+	}
+	keysharePublicKey, err := mpcWrapper.KeysharePublicKey(keyshareHandle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public key: %w", err)
+	}
+	return DeriveEdDSAChildPublicKey(keysharePublicKey, chainCodeBytes, derivePath)
+}
+
+// DeriveEdDSAChildPublicKey derives a child public key of an Ed25519 key following the non-hardened public
+// derivation of BIP32-Ed25519 (Khovratovich & Law). The child key is the parent key plus a tweak times the
+// base point. The schnorr wrapper only signs with the root key, so the child key is watch only, the parties
+// can't sign with it yet.
+func DeriveEdDSAChildPublicKey(publicKey []byte, chainCode []byte, derivePath string) ([]byte, error) {
+	indexes, err := parseNonHardenedPath(derivePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		publicKey, chainCode, _, err = deriveEdDSAChild(publicKey, chainCode, index)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive child %d: %w", index, err)
+		}
+	}
+	return publicKey, nil
+}
+
+func parseNonHardenedPath(derivePath string) ([]uint32, error) {
+	segments := strings.Split(strings.TrimSpace(derivePath), "/")
+	if len(segments) == 0 || segments[0] != "m" {
+		return nil, fmt.Errorf("invalid derive path %s, it should start with m", derivePath)
+	}
+	indexes := make([]uint32, 0, len(segments)-1)
+	for _, segment := range segments[1:] {
+		if strings.HasSuffix(segment, "'") || strings.HasSuffix(segment, "h") {
+			return nil, fmt.Errorf("hardened derivation is not supported for EdDSA: %s", segment)
+		}
+		index, err := strconv.ParseUint(segment, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid derive path segment %s: %w", segment, err)
+		}
+		if index >= 1<<31 {
+			return nil, fmt.Errorf("hardened derivation is not supported for EdDSA: %s", segment)
+		}
+		indexes = append(indexes, uint32(index))
+	}
+	return indexes, nil
+}
+
+// deriveEdDSAChild returns the child public key, the child chain code and the scalar the parent key was tweaked with
+func deriveEdDSAChild(publicKey []byte, chainCode []byte, index uint32) ([]byte, []byte, *edwards25519.Scalar, error) {
+	if len(chainCode) != 32 {
+		return nil, nil, nil, fmt.Errorf("chain code should be 32 bytes, got %d", len(chainCode))
+	}
+	parent, err := edwards25519.NewIdentityPoint().SetBytes(publicKey)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	data := make([]byte, 0, 1+len(publicKey)+4)
+	data = append(data, 0x02)
+	data = append(data, publicKey...)
+	data = binary.LittleEndian.AppendUint32(data, index)
+	z := hmacSHA512(chainCode, data)
+	data[0] = 0x03
+	childChainCode := hmacSHA512(chainCode, data)[32:]
+
+	// the tweak is 8*zL, zL being the first 28 bytes of z read as a little endian integer
+	tweakBytes := make([]byte, 32)
+	var carry byte
+	for i := 0; i < 28; i++ {
+		tweakBytes[i] = z[i]<<3 | carry
+		carry = z[i] >> 5
+	}
+	tweakBytes[28] = carry
+	tweak, err := edwards25519.NewScalar().SetCanonicalBytes(tweakBytes)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid tweak: %w", err)
+	}
+	child := edwards25519.NewIdentityPoint().Add(parent, edwards25519.NewIdentityPoint().ScalarBaseMult(tweak))
+	if child.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return nil, nil, nil, fmt.Errorf("derived key is the identity point")
+	}
+	return child.Bytes(), childChainCode, tweak, nil
+}
+
+func hmacSHA512(key []byte, data []byte) []byte {
+	h := hmac.New(sha512.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
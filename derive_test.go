@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"filippo.io/edwards25519"
+
+	"github.com/vultisig/test-dkls/relay"
+)
+
+func TestDeriveEdDSAChildPublicKey(t *testing.T) {
+	seed := make([]byte, 64)
+	if _, err := rand.Read(seed); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := edwards25519.NewScalar().SetUniformBytes(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := edwards25519.NewIdentityPoint().ScalarBaseMult(secret).Bytes()
+	chainCode := make([]byte, 32)
+	if _, err := rand.Read(chainCode); err != nil {
+		t.Fatal(err)
+	}
+
+	// the child key must be the parent secret plus the tweak
+	child, childChainCode, tweak, err := deriveEdDSAChild(publicKey, chainCode, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	childSecret := edwards25519.NewScalar().Add(secret, tweak)
+	if !bytes.Equal(edwards25519.NewIdentityPoint().ScalarBaseMult(childSecret).Bytes(), child) {
+		t.Fatal("child public key doesn't match the tweaked secret")
+	}
+
+	grandChild, _, _, err := deriveEdDSAChild(child, childChainCode, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived, err := DeriveEdDSAChildPublicKey(publicKey, chainCode, "m/7/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(derived, grandChild) {
+		t.Fatal("path derivation doesn't match step by step derivation")
+	}
+
+	if _, err := DeriveEdDSAChildPublicKey(publicKey, chainCode, "m/44'/501'/0'"); err == nil {
+		t.Fatal("hardened path should be rejected")
+	}
+	if _, err := DeriveEdDSAChildPublicKey(publicKey, chainCode, "44/501"); err == nil {
+		t.Fatal("path without m should be rejected")
+	}
+}
+
+func TestDeriveEdDSAChildPublicKeyWatchOnly(t *testing.T) {
+	tss, err := NewTssService(NewMemoryTransport(relay.NewServer()), newMemoryStateAccessor(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the parties can't sign with a child EdDSA key, it's refused unless it's asked for watch only
+	if _, err := tss.DeriveChildPublicKey("pub", "m/0/1", false); !errors.Is(err, ErrEdDSADerivePath) {
+		t.Fatalf("expected EdDSA derive path error, got %v", err)
+	}
+	if _, err := tss.DeriveChildPublicKey("pub", "m/0/1", true); err == nil || errors.Is(err, ErrEdDSADerivePath) {
+		t.Fatalf("watch only derivation should only fail on the missing keyshare, got %v", err)
+	}
+	if _, err := tss.DeriveChildPublicKey("pub", "m", false); err == nil || errors.Is(err, ErrEdDSADerivePath) {
+		t.Fatalf("root key derivation should only fail on the missing keyshare, got %v", err)
+	}
+}
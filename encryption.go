@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	keyPurposeMessage   = "dkls-relay-message"
+	keyPurposeThreshold = "dkls-setup-threshold"
+	keyPurposeMessageID = "dkls-message-id"
+)
+
+// deriveSessionKey derives a 32 bytes key of a session for purpose from the pre-shared encryption key,
+// so a key leaked from one session or purpose can't be used for another
+func deriveSessionKey(encryptionKey []byte, sessionID string, purpose string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, encryptionKey, []byte(sessionID), []byte(purpose)), key); err != nil {
+		return nil, fmt.Errorf("fail to derive session key: %w", err)
+	}
+	return key, nil
+}
+
+// messageAAD binds the ciphertext to its relay session, the session it's tagged with, sender, receiver and sequence
+// number, the relay can't replay it to someone else, in another multiplexed session or as another message
+func messageAAD(relaySessionID, sessionID, from, to string, sequenceNo int64) []byte {
+	return []byte(strings.Join([]string{relaySessionID, sessionID, from, to, strconv.FormatInt(sequenceNo, 10)}, "\x00"))
+}
+
+func newSessionAEAD(encryptionKey []byte, sessionID string) (cipher.AEAD, error) {
+	key, err := deriveSessionKey(encryptionKey, sessionID, keyPurposeMessage)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptMessage seals the body with AES-GCM under the key of the relay session, the result is
+// base64(nonce || ciphertext)
+func encryptMessage(encryptionKey []byte, relaySessionID, sessionID, from, to string, sequenceNo int64, body []byte) (string, error) {
+	aead, err := newSessionAEAD(encryptionKey, relaySessionID)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("fail to generate nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, body, messageAAD(relaySessionID, sessionID, from, to, sequenceNo))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptMessage(encryptionKey []byte, relaySessionID, sessionID, from, to string, sequenceNo int64, body string) ([]byte, error) {
+	aead, err := newSessionAEAD(encryptionKey, relaySessionID)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return nil, fmt.Errorf("fail to decode encrypted message: %w", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted message is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, messageAAD(relaySessionID, sessionID, from, to, sequenceNo))
+	if err != nil {
+		return nil, fmt.Errorf("fail to decrypt message: %w", err)
+	}
+	return plaintext, nil
+}
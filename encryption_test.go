@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+func TestEncryptMessage(t *testing.T) {
+	encryptionKey := make([]byte, 32)
+	if _, err := rand.Read(encryptionKey); err != nil {
+		t.Fatal(err)
+	}
+	body := []byte("protocol message")
+	encrypted, err := encryptMessage(encryptionKey, "session", "session-0", "first", "second", 1, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := decryptMessage(encryptionKey, "session", "session-0", "first", "second", 1, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != string(body) {
+		t.Fatalf("expected %s, got %s", body, decrypted)
+	}
+	if _, err := decryptMessage(encryptionKey, "other-session", "session-0", "first", "second", 1, encrypted); err == nil {
+		t.Fatal("message should not decrypt in another session")
+	}
+	if _, err := decryptMessage(encryptionKey, "session", "session-0", "third", "second", 1, encrypted); err == nil {
+		t.Fatal("message should not decrypt with another sender")
+	}
+	// the batch sub-sessions share the key of the relay session
+	if _, err := decryptMessage(encryptionKey, "session", "session-1", "first", "second", 1, encrypted); err == nil {
+		t.Fatal("message should not decrypt in another sub-session")
+	}
+	if _, err := decryptMessage(encryptionKey, "session", "session-0", "first", "second", 2, encrypted); err == nil {
+		t.Fatal("message should not decrypt with another sequence number")
+	}
+	otherKey := make([]byte, 32)
+	if _, err := decryptMessage(otherKey, "session", "session-0", "first", "second", 1, encrypted); err == nil {
+		t.Fatal("message should not decrypt with another key")
+	}
+}
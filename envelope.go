@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vultisig/test-dkls/relay"
+)
+
+var ErrInvalidMessageEnvelope = errors.New("invalid message envelope")
+
+// messageIDKey returns the key the message ids of the relay session are derived with, nil when the messages
+// are not encrypted
+func messageIDKey(encryptionKey []byte, relaySessionID string) ([]byte, error) {
+	if len(encryptionKey) == 0 {
+		return nil, nil
+	}
+	return deriveSessionKey(encryptionKey, relaySessionID, keyPurposeMessageID)
+}
+
+// messageID is the id a message is acknowledged and deduplicated by. It's the HMAC-SHA256 of the envelope under
+// idKey, so the relay can't make up the id of a message it forged, and the same body sent by another party, to
+// another party, in another session or as another message gets another id. Without idKey it's the SHA-256 of
+// the envelope, the envelope is then only authenticated when the parties sign the messages with their identity key.
+func messageID(idKey []byte, message relay.Message) string {
+	envelope := []byte(strings.Join([]string{
+		message.SessionID,
+		message.From,
+		strings.Join(message.To, ","),
+		strconv.FormatInt(message.SequenceNo, 10),
+		message.Body,
+	}, "\x00"))
+	if len(idKey) == 0 {
+		hash := sha256.Sum256(envelope)
+		return hex.EncodeToString(hash[:])
+	}
+	h := hmac.New(sha256.New, idKey)
+	h.Write(envelope)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// checkEnvelope rejects a message without a sequence number, or with an id that doesn't match its envelope
+func checkEnvelope(idKey []byte, message relay.Message) error {
+	if message.SequenceNo <= 0 {
+		return fmt.Errorf("%w: message from %s has no sequence number", ErrInvalidMessageEnvelope, message.From)
+	}
+	if !hmac.Equal([]byte(message.Hash), []byte(messageID(idKey, message))) {
+		return fmt.Errorf("%w: id of message %d from %s doesn't match its envelope", ErrInvalidMessageEnvelope, message.SequenceNo, message.From)
+	}
+	return nil
+}
+
+// inboundTracker follows the sequence numbers of the messages a party receives from every sender in every
+// session. It drops the duplicates, and reports the gaps and the messages that arrive out of order.
+type inboundTracker struct {
+	localPartyID string
+	received     map[string]bool
+	// next is the sequence number expected next from each sender
+	next    map[string]int64
+	missing map[string][]int64
+	logger  *logrus.Logger
+}
+
+func newInboundTracker(localPartyID string, logger *logrus.Logger) *inboundTracker {
+	return &inboundTracker{
+		localPartyID: localPartyID,
+		received:     make(map[string]bool),
+		next:         make(map[string]int64),
+		missing:      make(map[string][]int64),
+		logger:       logger,
+	}
+}
+
+func trackerStream(message relay.Message) string {
+	return message.SessionID + "/" + message.From
+}
+
+// Track records a message that passed checkEnvelope, it returns false when the message should be dropped,
+// because it was received before or it conflicts with another message of the same sequence number
+func (tr *inboundTracker) Track(message relay.Message) bool {
+	if tr.received[message.Hash] {
+		tr.logger.Debugf("drop duplicate message %d from %s", message.SequenceNo, message.From)
+		return false
+	}
+	stream := trackerStream(message)
+	next := max(tr.next[stream], 1)
+	switch {
+	case message.SequenceNo == next:
+		tr.next[stream] = next + 1
+	case message.SequenceNo > next:
+		for sequenceNo := next; sequenceNo < message.SequenceNo; sequenceNo++ {
+			tr.missing[stream] = append(tr.missing[stream], sequenceNo)
+		}
+		tr.logger.Warnf("gap in messages of %s from %s, got %d, missing %v", message.SessionID, message.From, message.SequenceNo, tr.missing[stream])
+		tr.next[stream] = message.SequenceNo + 1
+	default:
+		idx := slices.Index(tr.missing[stream], message.SequenceNo)
+		if idx < 0 {
+			tr.logger.Errorf("drop message %d from %s, another message with the same sequence number was received", message.SequenceNo, message.From)
+			return false
+		}
+		tr.missing[stream] = slices.Delete(tr.missing[stream], idx, idx+1)
+		tr.logger.Infof("message %d of %s from %s arrived out of order", message.SequenceNo, message.SessionID, message.From)
+	}
+	tr.received[message.Hash] = true
+	return true
+}
+
+// Missing returns the sequence numbers of the messages not received yet from each sender, as far as the
+// later messages tell
+func (tr *inboundTracker) Missing() map[string][]int64 {
+	result := make(map[string][]int64)
+	for stream, missing := range tr.missing {
+		if len(missing) > 0 {
+			result[stream] = slices.Clone(missing)
+		}
+	}
+	return result
+}
+
+// Undelivered returns the first round not delivered by every party of the sessions, and the rounds each party
+// didn't deliver although another party delivered them or later rounds
+func (tr *inboundTracker) Undelivered(sessionIDs []string, parties []string) (int64, []UndeliveredRounds) {
+	var round int64
+	var result []UndeliveredRounds
+	for _, sessionID := range sessionIDs {
+		var last int64
+		for _, party := range parties {
+			last = max(last, tr.next[sessionID+"/"+party]-1)
+		}
+		for _, party := range parties {
+			if party == tr.localPartyID {
+				continue
+			}
+			stream := sessionID + "/" + party
+			next := max(tr.next[stream], 1)
+			rounds := slices.Clone(tr.missing[stream])
+			for sequenceNo := next; sequenceNo <= last; sequenceNo++ {
+				rounds = append(rounds, sequenceNo)
+			}
+			first := next
+			if len(rounds) > 0 {
+				first = rounds[0]
+				result = append(result, UndeliveredRounds{
+					SessionID: sessionID,
+					Party:     party,
+					Rounds:    rounds,
+				})
+			}
+			if round == 0 || first < round {
+				round = first
+			}
+		}
+	}
+	return round, result
+}
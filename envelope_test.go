@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vultisig/test-dkls/relay"
+)
+
+func newEnvelope(sessionID, from string, sequenceNo int64, body string) relay.Message {
+	message := relay.Message{
+		SessionID:  sessionID,
+		From:       from,
+		To:         []string{"second"},
+		Body:       body,
+		SequenceNo: sequenceNo,
+	}
+	message.Hash = messageID(nil, message)
+	return message
+}
+
+func TestMessageID(t *testing.T) {
+	message := newEnvelope("session", "first", 1, "body")
+	if len(message.Hash) != 64 {
+		t.Fatalf("expected SHA-256 id, got %s", message.Hash)
+	}
+	for name, other := range map[string]relay.Message{
+		"session":     newEnvelope("other-session", "first", 1, "body"),
+		"sender":      newEnvelope("session", "third", 1, "body"),
+		"sequence no": newEnvelope("session", "first", 2, "body"),
+	} {
+		if other.Hash == message.Hash {
+			t.Fatalf("same body with another %s should get another id", name)
+		}
+	}
+	if err := checkEnvelope(nil, message); err != nil {
+		t.Fatal(err)
+	}
+	tampered := message
+	tampered.Body = "other body"
+	if err := checkEnvelope(nil, tampered); !errors.Is(err, ErrInvalidMessageEnvelope) {
+		t.Fatalf("expected invalid envelope, got %v", err)
+	}
+	unnumbered := newEnvelope("session", "first", 0, "body")
+	if err := checkEnvelope(nil, unnumbered); !errors.Is(err, ErrInvalidMessageEnvelope) {
+		t.Fatalf("expected invalid envelope, got %v", err)
+	}
+}
+
+func TestKeyedMessageID(t *testing.T) {
+	encryptionKey := make([]byte, 32)
+	if _, err := rand.Read(encryptionKey); err != nil {
+		t.Fatal(err)
+	}
+	idKey, err := messageIDKey(encryptionKey, "relay-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := messageIDKey(nil, "relay-session"); err != nil || key != nil {
+		t.Fatalf("expected no id key without an encryption key, got %x, %v", key, err)
+	}
+	message := newEnvelope("session", "first", 1, "body")
+	message.Hash = messageID(idKey, message)
+	if err := checkEnvelope(idKey, message); err != nil {
+		t.Fatal(err)
+	}
+	// the relay doesn't know the key, an envelope it made up with the unkeyed id is rejected
+	forged := newEnvelope("session", "first", 2, "forged body")
+	if err := checkEnvelope(idKey, forged); !errors.Is(err, ErrInvalidMessageEnvelope) {
+		t.Fatalf("expected invalid envelope, got %v", err)
+	}
+	otherKey, err := messageIDKey(encryptionKey, "other-relay-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEnvelope(otherKey, message); !errors.Is(err, ErrInvalidMessageEnvelope) {
+		t.Fatalf("message id should not be valid in another relay session, got %v", err)
+	}
+}
+
+func TestInboundTracker(t *testing.T) {
+	tracker := newInboundTracker("second", logrus.StandardLogger())
+	first := newEnvelope("session", "first", 1, "round 1")
+	if !tracker.Track(first) {
+		t.Fatal("first message should be accepted")
+	}
+	if tracker.Track(first) {
+		t.Fatal("duplicate should be dropped")
+	}
+	// the same body in another round is another message
+	if !tracker.Track(newEnvelope("session", "first", 4, "round 1")) {
+		t.Fatal("message after a gap should be accepted")
+	}
+	missing := tracker.Missing()
+	if len(missing) != 1 || len(missing["session/first"]) != 2 {
+		t.Fatalf("expected messages 2 and 3 to be missing, got %v", missing)
+	}
+	if !tracker.Track(newEnvelope("session", "first", 3, "round 3")) {
+		t.Fatal("out of order message should be accepted")
+	}
+	if tracker.Track(newEnvelope("session", "first", 3, "another round 3")) {
+		t.Fatal("conflicting message should be dropped")
+	}
+	// sequence numbers of another session or sender are independent
+	if !tracker.Track(newEnvelope("other-session", "first", 1, "round 1")) || !tracker.Track(newEnvelope("session", "third", 1, "round 1")) {
+		t.Fatal("first message of another stream should be accepted")
+	}
+	missing = tracker.Missing()
+	if len(missing) != 1 || len(missing["session/first"]) != 1 || missing["session/first"][0] != 2 {
+		t.Fatalf("expected message 2 to be missing, got %v", missing)
+	}
+}
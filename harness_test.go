@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"filippo.io/edwards25519"
+	"github.com/bnb-chain/tss-lib/v2/tss"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/vultisig/test-dkls/relay"
+)
+
+// memoryStateAccessor keeps the keyshares of one party in memory
+type memoryStateAccessor struct {
+	mu     sync.Mutex
+	states map[string]string
+}
+
+func newMemoryStateAccessor() *memoryStateAccessor {
+	return &memoryStateAccessor{
+		states: make(map[string]string),
+	}
+}
+
+func (m *memoryStateAccessor) GetLocalState(pubKey string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ok := m.states[pubKey]
+	if !ok {
+		return "", fmt.Errorf("state of %s does not exist", pubKey)
+	}
+	return state, nil
+}
+
+func (m *memoryStateAccessor) SaveLocalState(pubKey, localState string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.states[pubKey] = localState
+	return nil
+}
+
+// publicKeys returns the public keys the party holds a keyshare of
+func (m *memoryStateAccessor) publicKeys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var publicKeys []string
+	for key := range m.states {
+		if !strings.HasSuffix(key, chainCodeSuffix) && !strings.HasSuffix(key, pendingSuffix) && !strings.Contains(key, presignInfix) {
+			publicKeys = append(publicKeys, key)
+		}
+	}
+	return publicKeys
+}
+
+// harness runs every party as a TssService in its own goroutine, all of them talk over one in-memory relay
+type harness struct {
+	t         *testing.T
+	relay     *relay.Server
+	isEdDSA   bool
+	accessors map[string]*memoryStateAccessor
+	sessions  int
+	// services keeps the TssService of every party across the runs when it's not nil
+	services map[string]*TssService
+}
+
+func newHarness(t *testing.T, isEdDSA bool) *harness {
+	return &harness{
+		t:         t,
+		relay:     relay.NewServer(),
+		isEdDSA:   isEdDSA,
+		accessors: make(map[string]*memoryStateAccessor),
+	}
+}
+
+func (h *harness) accessor(party string) *memoryStateAccessor {
+	if _, ok := h.accessors[party]; !ok {
+		h.accessors[party] = newMemoryStateAccessor()
+	}
+	return h.accessors[party]
+}
+
+// run calls fn for every party concurrently, each party gets a new TssService as the CLI does, unless the
+// services are kept.
+// The leader is the party that initiates the session. When a party fails the session is deleted,
+// so the others stop waiting for it.
+func (h *harness) run(sessionID string, parties []string, leader string, fn func(tss *TssService, party string, isLeader bool) error) map[string]error {
+	services := make(map[string]*TssService, len(parties))
+	for _, party := range parties {
+		tss, ok := h.services[party]
+		if !ok {
+			var err error
+			tss, err = NewTssService(NewMemoryTransport(h.relay), h.accessor(party), h.isEdDSA)
+			if err != nil {
+				h.t.Fatal(err)
+			}
+			if h.services != nil {
+				h.services[party] = tss
+			}
+		}
+		services[party] = tss
+	}
+	var mu sync.Mutex
+	errs := make(map[string]error, len(parties))
+	wg := &sync.WaitGroup{}
+	for _, party := range parties {
+		wg.Add(1)
+		go func(party string) {
+			defer wg.Done()
+			err := fn(services[party], party, party == leader)
+			if err != nil {
+				h.relay.DeleteSession(sessionID)
+			}
+			mu.Lock()
+			errs[party] = err
+			mu.Unlock()
+		}(party)
+	}
+	wg.Wait()
+	return errs
+}
+
+func (h *harness) sessionID(name string) string {
+	h.sessions++
+	return fmt.Sprintf("%s-%d", name, h.sessions)
+}
+
+func (h *harness) keygen(parties []string, threshold int) string {
+	chainCode := make([]byte, 32)
+	if _, err := rand.Read(chainCode); err != nil {
+		h.t.Fatal(err)
+	}
+	sessionID := h.sessionID("keygen")
+	errs := h.run(sessionID, parties, parties[0], func(tss *TssService, party string, isLeader bool) error {
+		return tss.Keygen(context.Background(), sessionID, hex.EncodeToString(chainCode), party, parties, threshold, isLeader)
+	})
+	var publicKey string
+	for _, party := range parties {
+		if errs[party] != nil {
+			h.t.Fatalf("keygen of %s failed: %v", party, errs[party])
+		}
+		publicKeys := h.accessor(party).publicKeys()
+		if len(publicKeys) != 1 {
+			h.t.Fatalf("%s should have one keyshare, got %d", party, len(publicKeys))
+		}
+		if publicKey == "" {
+			publicKey = publicKeys[0]
+		}
+		if publicKeys[0] != publicKey {
+			h.t.Fatalf("%s got public key %s, expect %s", party, publicKeys[0], publicKey)
+		}
+	}
+	return publicKey
+}
+
+// keygenBoth generates the ECDSA and the EdDSA key in one run and returns both public keys
+func (h *harness) keygenBoth(parties []string, threshold int) (string, string) {
+	sessionID := h.sessionID("keygen-both")
+	sessionIDs := []string{ecdsaSessionID(sessionID), eddsaSessionID(sessionID)}
+	errs := h.run(sessionID, parties, parties[0], func(tss *TssService, party string, isLeader bool) error {
+		err := tss.KeygenBoth(context.Background(), sessionID, party, parties, threshold, isLeader)
+		if err != nil {
+			// the sub-sessions are the ones the other parties wait on
+			for _, id := range sessionIDs {
+				h.relay.DeleteSession(id)
+			}
+		}
+		return err
+	})
+	var ecdsaPublicKey, eddsaPublicKey string
+	for _, party := range parties {
+		if errs[party] != nil {
+			h.t.Fatalf("keygen of %s failed: %v", party, errs[party])
+		}
+		publicKeys := h.accessor(party).publicKeys()
+		if len(publicKeys) != 2 {
+			h.t.Fatalf("%s should have two keyshares, got %d", party, len(publicKeys))
+		}
+		var chainCodes []string
+		for _, publicKey := range publicKeys {
+			chainCodeHex, err := h.accessor(party).GetLocalState(chainCodeKey(publicKey))
+			if err != nil || chainCodeHex == "" {
+				h.t.Fatalf("%s should have a chain code for %s, got %v", party, publicKey, err)
+			}
+			chainCodes = append(chainCodes, chainCodeHex)
+			if len(publicKey) == 64 {
+				eddsaPublicKey = publicKey
+			} else {
+				ecdsaPublicKey = publicKey
+			}
+		}
+		if chainCodes[0] != chainCodes[1] {
+			h.t.Fatalf("%s should have the same chain code for both keys, got %v", party, chainCodes)
+		}
+	}
+	if ecdsaPublicKey == "" || eddsaPublicKey == "" {
+		h.t.Fatalf("expect an ECDSA and an EdDSA key, got %s and %s", ecdsaPublicKey, eddsaPublicKey)
+	}
+	return ecdsaPublicKey, eddsaPublicKey
+}
+
+// inspect checks every party holds a keyshare of publicKey with the same key id and chain code
+func (h *harness) inspect(publicKey string, parties []string) {
+	var first *KeyshareInfo
+	for _, party := range parties {
+		tss, err := NewTssService(NewMemoryTransport(h.relay), h.accessor(party), h.isEdDSA)
+		if err != nil {
+			h.t.Fatal(err)
+		}
+		info, err := tss.InspectKeyshare(publicKey)
+		if err != nil {
+			h.t.Fatalf("inspect keyshare of %s failed: %v", party, err)
+		}
+		if err := info.Check(); err != nil {
+			h.t.Fatal(err)
+		}
+		if first == nil {
+			first = info
+		}
+		if info.KeyID != first.KeyID || info.ChainCode != first.ChainCode || info.ChainCode == "" {
+			h.t.Fatalf("%s has key id %s and chain code %s, expect %s and %s", party, info.KeyID, info.ChainCode, first.KeyID, first.ChainCode)
+		}
+	}
+}
+
+// keysign signs with every subset of threshold parties and checks all the signatures
+func (h *harness) keysign(publicKey string, parties []string, threshold int) {
+	for _, signers := range combinations(parties, threshold) {
+		sessionID := h.sessionID("keysign")
+		message := "message signed by " + strings.Join(signers, ",")
+		derivePath := "m/0/0"
+		if h.isEdDSA {
+			derivePath = "m"
+		}
+		var mu sync.Mutex
+		results := make(map[string]*KeysignResult, len(signers))
+		errs := h.run(sessionID, signers, signers[0], func(tss *TssService, party string, isLeader bool) error {
+			result, err := tss.Keysign(context.Background(), sessionID, publicKey, message, EncodingUTF8, HashSHA256, derivePath, party, signers, isLeader)
+			mu.Lock()
+			results[party] = result
+			mu.Unlock()
+			return err
+		})
+		for _, party := range signers {
+			if errs[party] != nil {
+				h.t.Fatalf("keysign of %s with %v failed: %v", party, signers, errs[party])
+			}
+			if err := results[party].Verify(); err != nil {
+				h.t.Fatalf("signature of %s with %v is invalid: %v", party, signers, err)
+			}
+			if results[party].Signature != results[signers[0]].Signature {
+				h.t.Fatalf("%s and %s got different signatures", party, signers[0])
+			}
+		}
+	}
+}
+
+// refresh replaces the keyshares of publicKey of all the parties, the public key stays the same
+func (h *harness) refresh(publicKey string, parties []string, threshold int) {
+	oldKeyshares := make(map[string]string, len(parties))
+	for _, party := range parties {
+		keyshare, err := h.accessor(party).GetLocalState(publicKey)
+		if err != nil {
+			h.t.Fatal(err)
+		}
+		oldKeyshares[party] = keyshare
+	}
+	sessionID := h.sessionID("refresh")
+	errs := h.run(sessionID, parties, parties[0], func(tss *TssService, party string, isLeader bool) error {
+		return tss.Refresh(context.Background(), sessionID, publicKey, party, parties, threshold, isLeader)
+	})
+	for _, party := range parties {
+		if errs[party] != nil {
+			h.t.Fatalf("refresh of %s failed: %v", party, errs[party])
+		}
+		keyshare, err := h.accessor(party).GetLocalState(publicKey)
+		if err != nil {
+			h.t.Fatal(err)
+		}
+		if keyshare == oldKeyshares[party] {
+			h.t.Fatalf("keyshare of %s is not refreshed", party)
+		}
+	}
+}
+
+// presign makes a pre-signature with signers and finishes a signature with it in a second session
+func (h *harness) presign(publicKey string, signers []string) {
+	presignID := h.sessionID("presign")
+	errs := h.run(presignID, signers, signers[0], func(tss *TssService, party string, isLeader bool) error {
+		return tss.Presign(context.Background(), presignID, publicKey, "m/0/0", party, signers, isLeader)
+	})
+	for _, party := range signers {
+		if errors.Is(errs[party], ErrPresignNotSupported) {
+			h.t.Skip("the wrapper can't make pre-signatures")
+		}
+		if errs[party] != nil {
+			h.t.Fatalf("presign of %s with %v failed: %v", party, signers, errs[party])
+		}
+	}
+	sessionID := h.sessionID("keysign")
+	var mu sync.Mutex
+	results := make(map[string]*KeysignResult, len(signers))
+	errs = h.run(sessionID, signers, signers[0], func(tss *TssService, party string, isLeader bool) error {
+		result, err := tss.KeysignWithPresign(context.Background(), sessionID, publicKey, "presigned message", EncodingUTF8, HashSHA256, "m/0/0", presignID, party, signers, isLeader)
+		mu.Lock()
+		results[party] = result
+		mu.Unlock()
+		return err
+	})
+	for _, party := range signers {
+		if errs[party] != nil {
+			h.t.Fatalf("keysign with presign of %s failed: %v", party, errs[party])
+		}
+		if err := results[party].Verify(); err != nil {
+			h.t.Fatalf("signature of %s is invalid: %v", party, err)
+		}
+		if presign, err := h.accessor(party).GetLocalState(presignKey(publicKey, presignID)); err == nil && presign != "" {
+			h.t.Fatalf("presign of %s should be deleted once it's used", party)
+		}
+	}
+}
+
+// reshare moves the key from the old parties to the new ones, parties only in the old committee drop out
+func (h *harness) reshare(publicKey string, oldParties []string, newParties []string, threshold int) {
+	allParties := slices.Clone(oldParties)
+	for _, party := range newParties {
+		if !slices.Contains(allParties, party) {
+			allParties = append(allParties, party)
+		}
+	}
+	// the leader creates the setup message from its keyshare, so it has to be in both committees
+	leader := ""
+	for _, party := range oldParties {
+		if slices.Contains(newParties, party) {
+			leader = party
+			break
+		}
+	}
+	// the parties new to the committee get the chain code of the key from the leader
+	chainCode, err := h.accessor(leader).GetLocalState(chainCodeKey(publicKey))
+	if err != nil {
+		h.t.Fatalf("leader %s has no chain code of %s: %v", leader, publicKey, err)
+	}
+	sessionID := h.sessionID("reshare")
+	errs := h.run(sessionID, allParties, leader, func(tss *TssService, party string, isLeader bool) error {
+		partyPublicKey := ""
+		partyChainCode := chainCode
+		if slices.Contains(oldParties, party) {
+			partyPublicKey = publicKey
+			partyChainCode = ""
+		}
+		return tss.Reshare(context.Background(), sessionID, partyPublicKey, partyChainCode, party, newParties, oldParties, threshold, isLeader)
+	})
+	for _, party := range allParties {
+		if errs[party] != nil {
+			h.t.Fatalf("reshare of %s failed: %v", party, errs[party])
+		}
+	}
+	for _, party := range newParties {
+		if !slices.Contains(h.accessor(party).publicKeys(), publicKey) {
+			h.t.Fatalf("%s should have a keyshare of %s", party, publicKey)
+		}
+		if partyChainCode, err := h.accessor(party).GetLocalState(chainCodeKey(publicKey)); err != nil || partyChainCode != chainCode {
+			h.t.Fatalf("%s should have the chain code of %s, got %s, %v", party, publicKey, partyChainCode, err)
+		}
+	}
+}
+
+// gg20Vaults creates the GG20 vaults of the parties, the secret is shared with a random polynomial of degree
+// threshold-1 as tss-lib does
+func (h *harness) gg20Vaults(parties []string, threshold int) (string, map[string]*Vault) {
+	order := tss.EC().Params().N
+	if h.isEdDSA {
+		order = tss.Edwards().Params().N
+	}
+	chainCode := make([]byte, 32)
+	if _, err := rand.Read(chainCode); err != nil {
+		h.t.Fatal(err)
+	}
+	ks := make([]*big.Int, len(parties))
+	for i := range parties {
+		ks[i] = big.NewInt(int64(i + 1))
+	}
+	for {
+		coefficients := make([]*big.Int, threshold)
+		for i := range coefficients {
+			coefficient, err := rand.Int(rand.Reader, order)
+			if err != nil {
+				h.t.Fatal(err)
+			}
+			coefficients[i] = coefficient
+		}
+		secret := make([]byte, 32)
+		coefficients[0].FillBytes(secret)
+		var publicKey string
+		if h.isEdDSA {
+			scalar, err := edwards25519.NewScalar().SetCanonicalBytes(reverseBytes(secret))
+			if err != nil {
+				h.t.Fatal(err)
+			}
+			publicKey = hex.EncodeToString(edwards25519.NewIdentityPoint().ScalarBaseMult(scalar).Bytes())
+		} else {
+			publicKey = hex.EncodeToString(secp256k1.PrivKeyFromBytes(secret).PubKey().SerializeCompressed())
+		}
+		vaults := make(map[string]*Vault, len(parties))
+		complete := true
+		for i, party := range parties {
+			// Xi is the value of the polynomial at the share id of the party
+			xi := big.NewInt(0)
+			for j := len(coefficients) - 1; j >= 0; j-- {
+				xi.Mul(xi, ks[i]).Add(xi, coefficients[j]).Mod(xi, order)
+			}
+			localData := map[string]any{"Xi": xi, "ShareID": ks[i], "Ks": ks}
+			rawKeyshare := map[string]any{"public_key": publicKey}
+			vault := &Vault{
+				Name:         "gg20",
+				Signers:      parties,
+				HexChainCode: hex.EncodeToString(chainCode),
+				LocalPartyID: party,
+			}
+			if h.isEdDSA {
+				rawKeyshare["eddsa_local_data"] = localData
+				vault.PublicKeyEDDSA = publicKey
+			} else {
+				rawKeyshare["ecdsa_local_data"] = localData
+				vault.PublicKeyECDSA = publicKey
+			}
+			buf, err := json.Marshal(rawKeyshare)
+			if err != nil {
+				h.t.Fatal(err)
+			}
+			vault.KeyShares = []Keyshare{{PublicKey: publicKey, RawKeyshare: string(buf)}}
+			getLocalSecret := getECDSALocalSecret
+			if h.isEdDSA {
+				getLocalSecret = getEdDSALocalSecret
+			}
+			localSecret, err := getLocalSecret(vault)
+			if err != nil {
+				h.t.Fatal(err)
+			}
+			// the additive share is passed without leading zeros, draw again instead of handling short shares
+			complete = complete && len(localSecret) == 32
+			vaults[party] = vault
+		}
+		if complete {
+			return publicKey, vaults
+		}
+	}
+}
+
+// migrate moves a GG20 key of the parties to DKLS and returns its public key
+func (h *harness) migrate(parties []string, threshold int) string {
+	publicKey, vaults := h.gg20Vaults(parties, threshold)
+	dir := h.t.TempDir()
+	files := make(map[string]string, len(parties))
+	for _, party := range parties {
+		buf, err := json.Marshal(vaults[party])
+		if err != nil {
+			h.t.Fatal(err)
+		}
+		files[party] = filepath.Join(dir, party+".json")
+		if err := os.WriteFile(files[party], buf, 0600); err != nil {
+			h.t.Fatal(err)
+		}
+	}
+	sessionID := h.sessionID("migrate")
+	errs := h.run(sessionID, parties, parties[0], func(tss *TssService, party string, isLeader bool) error {
+		return tss.MigrateKey(context.Background(), sessionID, isLeader, files[party], nil, threshold)
+	})
+	for _, party := range parties {
+		if errs[party] != nil {
+			h.t.Fatalf("migrate of %s failed: %v", party, errs[party])
+		}
+		if !slices.Contains(h.accessor(party).publicKeys(), publicKey) {
+			h.t.Fatalf("%s should have a DKLS keyshare of %s", party, publicKey)
+		}
+	}
+	return publicKey
+}
+
+func combinations(parties []string, k int) [][]string {
+	if k == 0 {
+		return [][]string{{}}
+	}
+	var result [][]string
+	for i := 0; i+k <= len(parties); i++ {
+		for _, rest := range combinations(parties[i+1:], k-1) {
+			result = append(result, append([]string{parties[i]}, rest...))
+		}
+	}
+	return result
+}
+
+func TestCombinations(t *testing.T) {
+	result := combinations([]string{"first", "second", "third", "fourth"}, 3)
+	if len(result) != 4 {
+		t.Fatalf("expected 4 combinations, got %d", len(result))
+	}
+	if strings.Join(result[0], ",") != "first,second,third" || strings.Join(result[3], ",") != "second,third,fourth" {
+		t.Fatalf("unexpected combinations: %v", result)
+	}
+}
+
+func TestMultiPartySimulation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip multi-party simulation in short mode")
+	}
+	for name, isEdDSA := range map[string]bool{"ecdsa": false, "eddsa": true} {
+		t.Run(name, func(t *testing.T) {
+			h := newHarness(t, isEdDSA)
+			parties := []string{"first", "second", "third"}
+			publicKey := h.keygen(parties, 2)
+			h.inspect(publicKey, parties)
+			h.keysign(publicKey, parties, 2)
+			h.refresh(publicKey, parties, 2)
+			h.keysign(publicKey, parties, 2)
+
+			// add a party
+			newParties := []string{"first", "second", "third", "fourth"}
+			h.reshare(publicKey, parties, newParties, 3)
+			h.keysign(publicKey, newParties, 3)
+
+			// remove a party
+			parties, newParties = newParties, []string{"second", "third", "fourth"}
+			h.reshare(publicKey, parties, newParties, 2)
+			h.keysign(publicKey, newParties, 2)
+		})
+	}
+}
+
+func TestKeygenBoth(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip multi-party simulation in short mode")
+	}
+	h := newHarness(t, false)
+	parties := []string{"first", "second", "third"}
+	ecdsaPublicKey, eddsaPublicKey := h.keygenBoth(parties, 2)
+	h.keysign(ecdsaPublicKey, parties, 2)
+	h.isEdDSA = true
+	h.keysign(eddsaPublicKey, parties, 2)
+}
+
+func TestPresignSimulation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip multi-party simulation in short mode")
+	}
+	h := newHarness(t, false)
+	parties := []string{"first", "second", "third"}
+	publicKey := h.keygen(parties, 2)
+	h.presign(publicKey, parties[:2])
+}
+
+func TestTssServiceReuse(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip multi-party simulation in short mode")
+	}
+	h := newHarness(t, false)
+	// every ceremony runs on the same TssService of the party, as an application embedding it does
+	h.services = make(map[string]*TssService)
+	parties := []string{"first", "second", "third"}
+	publicKey := h.keygen(parties, 2)
+	h.keysign(publicKey, parties, 2)
+	h.keysign(publicKey, parties, 2)
+}
+
+func TestMigrateSimulation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip multi-party simulation in short mode")
+	}
+	for name, isEdDSA := range map[string]bool{"ecdsa": false, "eddsa": true} {
+		t.Run(name, func(t *testing.T) {
+			h := newHarness(t, isEdDSA)
+			parties := []string{"first", "second", "third"}
+			publicKey := h.migrate(parties, 2)
+			h.keysign(publicKey, parties, 2)
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/vultisig/test-dkls/relay"
+)
+
+var ErrInvalidMessageSignature = errors.New("invalid message signature")
+
+// SetIdentityKeys configures the identity key of the local party and the identity public keys of the committee.
+// identityKeyFile holds the hex encoded ed25519 seed, partyKeys are "party=hex public key" entries.
+// Once set, every outbound message is signed and inbound messages without a valid signature are rejected.
+func (t *TssService) SetIdentityKeys(localPartyID string, identityKeyFile string, partyKeys []string) error {
+	if identityKeyFile == "" && len(partyKeys) == 0 {
+		t.identityKey = nil
+		t.partyKeys = nil
+		return nil
+	}
+	if identityKeyFile == "" || len(partyKeys) == 0 {
+		return fmt.Errorf("identity key and party keys need to be set together")
+	}
+	identityKey, err := LoadIdentityKey(identityKeyFile)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]ed25519.PublicKey, len(partyKeys))
+	for _, item := range partyKeys {
+		party, hexPublicKey, ok := strings.Cut(item, "=")
+		if !ok || party == "" {
+			return fmt.Errorf("invalid party key %s, expect party=public key", item)
+		}
+		publicKey, err := hex.DecodeString(hexPublicKey)
+		if err != nil {
+			return fmt.Errorf("failed to decode public key of %s: %w", party, err)
+		}
+		if len(publicKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("public key of %s should be %d bytes, got %d", party, ed25519.PublicKeySize, len(publicKey))
+		}
+		keys[party] = publicKey
+	}
+	localPublicKey, ok := keys[localPartyID]
+	if !ok {
+		return fmt.Errorf("public key of local party %s is not in party keys", localPartyID)
+	}
+	if !localPublicKey.Equal(identityKey.Public()) {
+		return fmt.Errorf("identity key doesn't match the public key of local party %s", localPartyID)
+	}
+	t.identityKey = identityKey
+	t.partyKeys = keys
+	return nil
+}
+
+// GenerateIdentityKey creates a new ed25519 identity key, writes the seed to file and returns the hex encoded public key
+func GenerateIdentityKey(file string) (string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("fail to generate identity key: %w", err)
+	}
+	if err := os.WriteFile(file, []byte(hex.EncodeToString(privateKey.Seed())), 0600); err != nil {
+		return "", fmt.Errorf("fail to write identity key file %s: %w", file, err)
+	}
+	return hex.EncodeToString(publicKey), nil
+}
+
+// LoadIdentityKey reads a hex encoded ed25519 seed from file
+func LoadIdentityKey(file string) (ed25519.PrivateKey, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read identity key file %s: %w", file, err)
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return nil, fmt.Errorf("fail to decode identity key: %w", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("identity key should be %d bytes, got %d", ed25519.SeedSize, len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// partyName is the name of the party in the setup messages, it carries the identity public key of the party
+// when identity keys are configured, so keygen binds the identity keys into the keyshares
+func (t *TssService) partyName(partyID string) string {
+	publicKey, ok := t.partyKeys[partyID]
+	if !ok {
+		return partyID
+	}
+	return partyID + "@" + hex.EncodeToString(publicKey)
+}
+
+func (t *TssService) partyNames(parties []string) []string {
+	names := make([]string, len(parties))
+	for i, party := range parties {
+		names[i] = t.partyName(party)
+	}
+	return names
+}
+
+// relayPartyID turns a party name returned by the MPC library back to the id the party uses on the relay
+func (t *TssService) relayPartyID(partyName string) string {
+	if len(t.partyKeys) == 0 {
+		return partyName
+	}
+	if idx := strings.LastIndex(partyName, "@"); idx >= 0 {
+		return partyName[:idx]
+	}
+	return partyName
+}
+
+// verifySetupPartyNames checks that the parties in the keygen setup message carry the expected identity keys
+func (t *TssService) verifySetupPartyNames(setupMsg []byte, parties []string) error {
+	if len(t.partyKeys) == 0 {
+		return nil
+	}
+	mpcWrapper := t.GetMPCKeygenWrapper()
+	expected := t.partyNames(parties)
+	for i := range parties {
+		name, err := mpcWrapper.DecodePartyName(setupMsg, i)
+		if err != nil {
+			return fmt.Errorf("failed to decode party name %d: %w", i, err)
+		}
+		if !slices.Contains(expected, string(name)) {
+			return fmt.Errorf("party %s in setup message doesn't match the configured identity keys", name)
+		}
+	}
+	return nil
+}
+
+// messageSigningPayload is what the sender signs, it covers the session, both ends, the sequence number and
+// the body on the wire
+func messageSigningPayload(relaySessionID string, sessionID string, from string, to string, sequenceNo int64, body string) []byte {
+	return []byte(strings.Join([]string{relaySessionID, sessionID, from, to, strconv.FormatInt(sequenceNo, 10), body}, "\x00"))
+}
+
+// verifyMessage checks the signature of an inbound message against the identity key of its sender
+func (t *TssService) verifyMessage(relaySessionID string, localPartyID string, message relay.Message) error {
+	if len(t.partyKeys) == 0 {
+		return nil
+	}
+	publicKey, ok := t.partyKeys[message.From]
+	if !ok {
+		return fmt.Errorf("%w: unknown sender %s", ErrInvalidMessageSignature, message.From)
+	}
+	signature, err := hex.DecodeString(message.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidMessageSignature, err)
+	}
+	payload := messageSigningPayload(relaySessionID, message.SessionID, message.From, localPartyID, message.SequenceNo, message.Body)
+	if !ed25519.Verify(publicKey, payload, signature) {
+		return fmt.Errorf("%w: from %s", ErrInvalidMessageSignature, message.From)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"github.com/vultisig/test-dkls/relay"
+)
+
+func TestVerifyMessage(t *testing.T) {
+	dir := t.TempDir()
+	firstFile := filepath.Join(dir, "first.key")
+	secondFile := filepath.Join(dir, "second.key")
+	firstPublicKey, err := GenerateIdentityKey(firstFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondPublicKey, err := GenerateIdentityKey(secondFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partyKeys := []string{"first=" + firstPublicKey, "second=" + secondPublicKey}
+	first := &TssService{}
+	if err := first.SetIdentityKeys("first", firstFile, partyKeys); err != nil {
+		t.Fatal(err)
+	}
+	second := &TssService{}
+	if err := second.SetIdentityKeys("second", secondFile, partyKeys); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.SetIdentityKeys("second", firstFile, partyKeys); err == nil {
+		t.Fatal("identity key of another party should be rejected")
+	}
+	if err := second.SetIdentityKeys("second", secondFile, nil); err == nil {
+		t.Fatal("identity key without party keys should be rejected")
+	}
+
+	message := relay.Message{
+		SessionID:  "session",
+		From:       "first",
+		To:         []string{"second"},
+		Body:       "protocol message",
+		SequenceNo: 1,
+	}
+	signature := ed25519.Sign(first.identityKey, messageSigningPayload("session", message.SessionID, "first", "second", message.SequenceNo, message.Body))
+	message.Signature = hex.EncodeToString(signature)
+	if err := second.verifyMessage("session", "second", message); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.verifyMessage("other-session", "second", message); err == nil {
+		t.Fatal("message should not verify in another session")
+	}
+	forged := message
+	forged.From = "second"
+	if err := second.verifyMessage("session", "second", forged); err == nil {
+		t.Fatal("message should not verify with another sender")
+	}
+	forged = message
+	forged.Body = "forged message"
+	if err := second.verifyMessage("session", "second", forged); err == nil {
+		t.Fatal("message should not verify with another body")
+	}
+	forged = message
+	forged.SequenceNo = 2
+	if err := second.verifyMessage("session", "second", forged); err == nil {
+		t.Fatal("message should not verify with another sequence number")
+	}
+
+	name := first.partyName("second")
+	if name != "second@"+secondPublicKey {
+		t.Fatalf("unexpected party name %s", name)
+	}
+	if first.relayPartyID(name) != "second" {
+		t.Fatalf("unexpected relay party id %s", first.relayPartyID(name))
+	}
+}
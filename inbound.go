@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vultisig/test-dkls/relay"
+)
+
+const (
+	// InboundStream keeps a server-sent events stream open to the relay, it falls back to polling
+	// when the relay doesn't support streaming
+	InboundStream = "stream"
+	// InboundPoll polls the relay for new messages
+	InboundPoll = "poll"
+)
+
+var errStreamNotSupported = errors.New("relay doesn't support message stream")
+
+// MessageReceiver delivers the relay messages addressed to the local party
+type MessageReceiver interface {
+	// Messages returns the channel the inbound messages are delivered on, a message stays on the relay
+	// and may be delivered again until it is acknowledged
+	Messages() <-chan []relay.Message
+	// Ack removes the message with the given hash from the relay
+	Ack(hash string) error
+	// Close stops receiving messages
+	Close()
+}
+
+type relayReceiver struct {
+	server       string
+	retryPolicy  RetryPolicy
+	sessionID    string
+	localPartyID string
+	messages     chan []relay.Message
+	ctx          context.Context
+	cancel       context.CancelFunc
+	logger       *logrus.Logger
+}
+
+var _ MessageReceiver = &relayReceiver{}
+
+func newRelayReceiver(ctx context.Context, server, sessionID, localPartyID string, streaming bool, retryPolicy RetryPolicy) *relayReceiver {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &relayReceiver{
+		server:       server,
+		retryPolicy:  retryPolicy,
+		sessionID:    sessionID,
+		localPartyID: localPartyID,
+		messages:     make(chan []relay.Message),
+		ctx:          ctx,
+		cancel:       cancel,
+		logger:       logrus.WithField("service", "receiver").Logger,
+	}
+	if streaming {
+		go r.stream()
+	} else {
+		go r.poll()
+	}
+	return r
+}
+
+func (r *relayReceiver) Messages() <-chan []relay.Message {
+	return r.messages
+}
+
+func (r *relayReceiver) Close() {
+	r.cancel()
+}
+
+func (r *relayReceiver) Ack(hash string) error {
+	resp, err := r.retryPolicy.request(r.ctx, http.MethodDelete, r.server+"/message/"+r.sessionID+"/"+r.localPartyID+"/"+hash, nil)
+	if err != nil {
+		return fmt.Errorf("fail to delete message: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fail to delete message: %s", resp.Status)
+	}
+	return nil
+}
+
+// deliver hands the messages to the consumer, it returns false once the receiver is closed
+func (r *relayReceiver) deliver(messages []relay.Message) bool {
+	select {
+	case r.messages <- messages:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+func (r *relayReceiver) poll() {
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(time.Millisecond * 100):
+			messages, err := r.getMessages()
+			if err != nil {
+				r.logger.Error("fail to get data from server", "error", err)
+				continue
+			}
+			if len(messages) == 0 {
+				continue
+			}
+			if !r.deliver(messages) {
+				return
+			}
+		}
+	}
+}
+
+func (r *relayReceiver) getMessages() ([]relay.Message, error) {
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, r.server+"/message/"+r.sessionID+"/"+r.localPartyID, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("response code is not 200 OK: %s", resp.Status)
+	}
+	var messages []relay.Message
+	if err := json.NewDecoder(resp.Body).Decode(&messages); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("fail to decode messages: %w", err)
+	}
+	return messages, nil
+}
+
+// stream keeps a message stream open to the relay and reconnects when it drops
+func (r *relayReceiver) stream() {
+	for {
+		err := r.readStream()
+		if r.ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errStreamNotSupported) {
+			r.logger.Warn("relay doesn't support message stream, fall back to polling")
+			r.poll()
+			return
+		}
+		r.logger.Error("message stream closed", "error", err)
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+}
+
+func (r *relayReceiver) readStream() error {
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, r.server+"/message/"+r.sessionID+"/"+r.localPartyID, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusMethodNotAllowed:
+		return errStreamNotSupported
+	case resp.StatusCode == http.StatusNotFound:
+		// the session is not registered yet, the stream is opened again
+		return fmt.Errorf("session %s not found", r.sessionID)
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("response code is not 200 OK: %s", resp.Status)
+	case !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream"):
+		// a relay without streaming answers with the plain message list
+		return errStreamNotSupported
+	}
+	reader := bufio.NewReader(resp.Body)
+	var data strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			// an empty line ends the event
+			if data.Len() == 0 {
+				continue
+			}
+			var message relay.Message
+			if err := json.Unmarshal([]byte(data.String()), &message); err != nil {
+				r.logger.Error("fail to decode message", "error", err)
+			} else if !r.deliver([]relay.Message{message}) {
+				return nil
+			}
+			data.Reset()
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteString("\n")
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		// comments and other fields are ignored
+	}
+}
+
+// acceptMessage checks an inbound message of the session and acknowledges it on the relay. It returns the
+// decoded protocol message, or false when the message has to be skipped.
+func (t *TssService) acceptMessage(sessionID string,
+	localPartyID string,
+	message relay.Message,
+	inbound MessageReceiver,
+	tracker *inboundTracker,
+	rejected map[string]bool) ([]byte, bool) {
+	if message.From == localPartyID {
+		return nil, false
+	}
+	if err := t.verifyMessage(sessionID, localPartyID, message); err != nil {
+		// not acknowledged, so a forged copy can't make the genuine message with the same body disappear
+		if !rejected[message.Signature] {
+			t.logger.Error("reject message", "from", message.From, "error", err)
+			rejected[message.Signature] = true
+		}
+		return nil, false
+	}
+	idKey, err := messageIDKey(t.encryptionKey, sessionID)
+	if err != nil {
+		t.logger.Error("fail to derive message id key", "error", err)
+		return nil, false
+	}
+	if err := checkEnvelope(idKey, message); err != nil {
+		// not acknowledged either, the id may be the one of a genuine message
+		if !rejected[message.Hash] {
+			t.logger.Error("reject message", "from", message.From, "error", err)
+			rejected[message.Hash] = true
+		}
+		return nil, false
+	}
+	if err := inbound.Ack(message.Hash); err != nil {
+		t.logger.Error("fail to delete message", "error", err)
+		return nil, false
+	}
+	if !tracker.Track(message) {
+		return nil, false
+	}
+	decodedBody, err := t.decodeMessageBody(sessionID, message, localPartyID)
+	if err != nil {
+		t.logger.Error("fail to decode message", "error", err)
+		return nil, false
+	}
+	return decodedBody, true
+}
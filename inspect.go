@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// KeyshareInfo is what the MPC library tells about a stored keyshare, together with the metadata the
+// keyshare store has of it. All binary fields are hex encoded.
+type KeyshareInfo struct {
+	KeyshareMetadata
+	KeyID string `json:"key_id"`
+	// KeysharePublicKey is the public key read from the keyshare, it should be the one it's stored under
+	KeysharePublicKey string `json:"keyshare_public_key"`
+	ChainCode         string `json:"chain_code,omitempty"`
+	Size              int    `json:"size"`
+}
+
+// InspectKeyshare loads the keyshare of publicKey and reports its key id, public key, chain code and party info
+func (t *TssService) InspectKeyshare(publicKey string) (*KeyshareInfo, error) {
+	if publicKey == "" {
+		return nil, fmt.Errorf("public key is empty")
+	}
+	mpcWrapper := t.GetMPCKeygenWrapper()
+	keyshare, err := t.localStateAccessor.GetLocalState(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get keyshare: %w", err)
+	}
+	keyshareBytes, err := base64.StdEncoding.DecodeString(keyshare)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode keyshare: %w", err)
+	}
+	keyshareHandle, err := mpcWrapper.KeyshareFromBytes(keyshareBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create keyshare from bytes: %w", err)
+	}
+	defer func() {
+		if err := mpcWrapper.KeyshareFree(keyshareHandle); err != nil {
+			t.logger.Error("failed to free keyshare", "error", err)
+		}
+	}()
+
+	info := &KeyshareInfo{
+		KeyshareMetadata: KeyshareMetadata{
+			PublicKey: publicKey,
+			Curve:     CurveECDSA,
+		},
+		Size: len(keyshareBytes),
+	}
+	if t.isEdDSA {
+		info.Curve = CurveEdDSA
+	}
+	if store, ok := t.localStateAccessor.(KeyshareStore); ok {
+		list, err := store.List()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list keyshares: %w", err)
+		}
+		for _, metadata := range list {
+			if metadata.PublicKey == publicKey {
+				info.KeyshareMetadata = metadata
+				break
+			}
+		}
+	}
+	keyID, err := mpcWrapper.KeyshareKeyID(keyshareHandle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key id: %w", err)
+	}
+	info.KeyID = hex.EncodeToString(keyID)
+	keysharePublicKey, err := mpcWrapper.KeysharePublicKey(keyshareHandle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public key: %w", err)
+	}
+	info.KeysharePublicKey = hex.EncodeToString(keysharePublicKey)
+
+	// schnorr keyshare doesn't keep the chain code, it's only known when it's saved next to the keyshare
+	if t.isEdDSA {
+		chainCode, err := t.localStateAccessor.GetLocalState(chainCodeKey(publicKey))
+		if err != nil {
+			t.logger.Warnf("no chain code for %s: %v", publicKey, err)
+			return info, nil
+		}
+		info.ChainCode = chainCode
+		return info, nil
+	}
+	chainCode, err := mpcWrapper.KeyshareChainCode(keyshareHandle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chain code: %w", err)
+	}
+	info.ChainCode = hex.EncodeToString(chainCode)
+	return info, nil
+}
+
+// Check reports a keyshare that doesn't belong to the public key it's stored under
+func (i *KeyshareInfo) Check() error {
+	if !strings.EqualFold(i.PublicKey, i.KeysharePublicKey) {
+		return fmt.Errorf("keyshare stored under %s has public key %s", i.PublicKey, i.KeysharePublicKey)
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyshareInfoCheck(t *testing.T) {
+	publicKey := strings.Repeat("cd", 32)
+	info := &KeyshareInfo{
+		KeyshareMetadata:  KeyshareMetadata{PublicKey: publicKey},
+		KeysharePublicKey: strings.ToUpper(publicKey),
+	}
+	if err := info.Check(); err != nil {
+		t.Fatal(err)
+	}
+	info.KeysharePublicKey = strings.Repeat("ab", 32)
+	if err := info.Check(); err == nil {
+		t.Fatal("keyshare of another public key should be reported")
+	}
+}
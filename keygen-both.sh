@@ -0,0 +1,15 @@
+#!/bin/bash
+session=$RANDOM
+
+echo "Generating ECDSA and EdDSA keys, session: $session"
+# first party
+./test-dkls --key first --parties first,second,third --session $session --vault first.json --leader keygen --both &
+
+# second party
+./test-dkls --key second --parties first,second,third --session $session --vault second.json keygen --both &
+
+# third party
+
+./test-dkls --key third --parties first,second,third --session $session --vault third.json keygen --both &
+
+wait
@@ -2,18 +2,16 @@ package main
 
 import (
 	"bytes"
-	"crypto/ecdsa"
+	"context"
 	"crypto/ed25519"
-	"crypto/md5"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"math/big"
-	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,125 +19,235 @@ import (
 	"github.com/bnb-chain/tss-lib/v2/common"
 	"github.com/bnb-chain/tss-lib/v2/ecdsa/keygen"
 	"github.com/bnb-chain/tss-lib/v2/tss"
-	"github.com/decred/dcrd/dcrec/secp256k1/v4"
 	"github.com/sirupsen/logrus"
-	"github.com/vultisig/mobile-tss-lib/coordinator"
+	"github.com/vultisig/test-dkls/relay"
 	session "go-wrapper/go-dkls/sessions"
 )
 
 var TssKeyGenTimeout = errors.New("keygen timeout")
+var ErrKeysignTimeout = errors.New("keysign timeout")
 
 type TssService struct {
-	relayServer        string
+	transport          Transport
 	messenger          *MessengerImp
 	logger             *logrus.Logger
 	localStateAccessor LocalStateAccessor
 	isKeygenFinished   *atomic.Bool
 	isKeysignFinished  *atomic.Bool
 	isEdDSA            bool
+	encryptionKey      []byte
+	identityKey        ed25519.PrivateKey
+	partyKeys          map[string]ed25519.PublicKey
+	timeouts           Timeouts
+	journal            *SessionJournal
 }
 
-func NewTssService(server string, localStateAccessor LocalStateAccessor, isEdDSA bool) (*TssService, error) {
+func NewTssService(transport Transport, localStateAccessor LocalStateAccessor, isEdDSA bool) (*TssService, error) {
 	return &TssService{
-		relayServer:        server,
+		transport:          transport,
 		messenger:          nil,
 		localStateAccessor: localStateAccessor,
 		logger:             logrus.WithField("service", "tss").Logger,
 		isKeygenFinished:   &atomic.Bool{},
 		isKeysignFinished:  &atomic.Bool{},
 		isEdDSA:            isEdDSA,
+		timeouts:           DefaultTimeouts(),
 	}, nil
 }
 func (t *TssService) GetMPCKeygenWrapper() *MPCWrapperImp {
 	return NewMPCWrapperImp(t.isEdDSA)
 }
 
-func (t *TssService) Keygen(sessionID string,
+// SetEncryptionKey sets the hex encoded pre-shared key used to encrypt the messages between parties,
+// all parties need to use the same key. Messages are sent in clear text when it's empty.
+func (t *TssService) SetEncryptionKey(hexEncryptionKey string) error {
+	if hexEncryptionKey == "" {
+		t.encryptionKey = nil
+		return nil
+	}
+	encryptionKey, err := hex.DecodeString(hexEncryptionKey)
+	if err != nil {
+		return fmt.Errorf("failed to decode encryption key: %w", err)
+	}
+	if len(encryptionKey) != 32 {
+		return fmt.Errorf("encryption key should be 32 bytes, got %d", len(encryptionKey))
+	}
+	t.encryptionKey = encryptionKey
+	return nil
+}
+
+func (t *TssService) newMessenger(sessionID string) *MessengerImp {
+	messenger := NewMessageImp(t.transport, sessionID)
+	messenger.encryptionKey = t.encryptionKey
+	messenger.identityKey = t.identityKey
+	return messenger
+}
+
+// decodeMessageBody turns the body of a message received over the relay session back to the protocol message
+func (t *TssService) decodeMessageBody(relaySessionID string, message relay.Message, localPartyID string) ([]byte, error) {
+	body := message.Body
+	if len(t.encryptionKey) > 0 {
+		decrypted, err := decryptMessage(t.encryptionKey, relaySessionID, message.SessionID, message.From, localPartyID, message.SequenceNo, body)
+		if err != nil {
+			return nil, err
+		}
+		body = string(decrypted)
+	}
+	return base64.StdEncoding.DecodeString(body)
+}
+
+func (t *TssService) Keygen(ctx context.Context,
+	sessionID string,
 	chainCode string,
 	localPartyID string,
 	keygenCommittee []string,
+	threshold int,
 	isInitiateDevice bool) error {
+	_, err := t.keygen(ctx, sessionID, chainCode, localPartyID, keygenCommittee, threshold, isInitiateDevice)
+	return err
+}
+
+// keygen runs the keygen and returns the public key of the new keyshare
+func (t *TssService) keygen(ctx context.Context,
+	sessionID string,
+	chainCode string,
+	localPartyID string,
+	keygenCommittee []string,
+	threshold int,
+	isInitiateDevice bool) (string, error) {
 	t.logger.WithFields(logrus.Fields{
 		"session_id":         sessionID,
 		"chain_code":         chainCode,
 		"local_party_id":     localPartyID,
 		"keygen_committee":   keygenCommittee,
+		"threshold":          threshold,
 		"is_initiate_device": isInitiateDevice,
 	}).Info("Keygen")
+	threshold, err := ResolveThreshold(threshold, len(keygenCommittee))
+	if err != nil {
+		return "", fmt.Errorf("failed to get threshold: %w", err)
+	}
+	t.logger.Infof("Threshold is %v", threshold)
+	if t.isEdDSA {
+		chainCodeBytes, err := hex.DecodeString(chainCode)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode chain code: %w", err)
+		}
+		if len(chainCodeBytes) != 32 {
+			return "", fmt.Errorf("chain code should be 32 bytes, got %d", len(chainCodeBytes))
+		}
+	}
 
-	if err := RegisterSession(t.relayServer, sessionID, localPartyID); err != nil {
-		return fmt.Errorf("failed to register session: %w", err)
+	joinCtx, cancelJoin := withTimeout(ctx, t.timeouts.Join)
+	defer cancelJoin()
+	session, err := t.beginSession(OperationKeygen, sessionID, localPartyID, keygenCommittee)
+	if err != nil {
+		return "", fmt.Errorf("failed to begin session: %w", err)
+	}
+	defer t.endSession(session)
+	if err := t.transport.RegisterSession(joinCtx, sessionID, localPartyID); err != nil {
+		return "", fmt.Errorf("failed to register session: %w", err)
 	}
 	mpcKeygenWrapper := t.GetMPCKeygenWrapper()
 	var encodedSetupMsg string = ""
 	if isInitiateDevice {
-		if coordinator.WaitAllParties(keygenCommittee, t.relayServer, sessionID) != nil {
-			return fmt.Errorf("failed to wait for all parties to join")
+		if err := t.transport.WaitAllParties(joinCtx, sessionID, keygenCommittee); err != nil {
+			return "", fmt.Errorf("failed to wait for all parties to join: %w", err)
 		}
 		fmt.Println("I am the leader , construct the setup message")
 		keygenCommitteeBytes, err := t.convertKeygenCommitteeToBytes(keygenCommittee)
 		if err != nil {
-			return fmt.Errorf("failed to get keygen committee: %v", err)
+			return "", fmt.Errorf("failed to get keygen committee: %v", err)
 		}
-		threshold, err := GetThreshold(len(keygenCommittee))
+		setupMsg, err := mpcKeygenWrapper.KeygenSetupMsgNew(threshold, nil, keygenCommitteeBytes)
 		if err != nil {
-			return fmt.Errorf("failed to get threshold: %v", err)
-		}
-		t.logger.Infof("Threshold is %v", threshold+1)
-		setupMsg, err := mpcKeygenWrapper.KeygenSetupMsgNew(threshold+1, nil, keygenCommitteeBytes)
-		if err != nil {
-			return fmt.Errorf("failed to create setup message: %v", err)
+			return "", fmt.Errorf("failed to create setup message: %v", err)
 		}
 		encodedSetupMsg = base64.StdEncoding.EncodeToString(setupMsg)
 		t.logger.Infoln("setup message is:", encodedSetupMsg)
-		if err := UploadPayload(t.relayServer, sessionID, encodedSetupMsg); err != nil {
-			return fmt.Errorf("failed to upload setup message: %v", err)
+		setupCtx, cancelSetup := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelSetup()
+		if err := t.transport.UploadPayload(setupCtx, sessionID, encodedSetupMsg); err != nil {
+			return "", fmt.Errorf("failed to upload setup message: %v", err)
+		}
+		if err := t.uploadThreshold(setupCtx, sessionID, localPartyID, threshold, setupMsg); err != nil {
+			return "", fmt.Errorf("failed to upload threshold: %w", err)
 		}
 
-		if err := StartSession(t.relayServer, sessionID, keygenCommittee); err != nil {
-			return fmt.Errorf("failed to start session: %w", err)
+		if err := t.transport.StartSession(setupCtx, sessionID, keygenCommittee); err != nil {
+			return "", fmt.Errorf("failed to start session: %w", err)
 		}
 	} else {
 		// wait for the keygen to start
-		_, err := WaitForSessionStart(t.relayServer, sessionID)
+		_, err := t.transport.WaitForSessionStart(joinCtx, sessionID)
 		if err != nil {
-			return fmt.Errorf("failed to wait for session to start: %w", err)
+			return "", fmt.Errorf("failed to wait for session to start: %w", err)
 		}
+		setupCtx, cancelSetup := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelSetup()
 		// retrieve the setup Message
-		encodedSetupMsg, err = GetPayload(t.relayServer, sessionID)
+		encodedSetupMsg, err = t.transport.GetPayload(setupCtx, sessionID)
+		if err != nil {
+			return "", fmt.Errorf("failed to get setup message: %w", err)
+		}
 	}
 	setupMessageBytes, err := base64.StdEncoding.DecodeString(encodedSetupMsg)
 	if err != nil {
-		return fmt.Errorf("failed to decode setup message: %w", err)
+		return "", fmt.Errorf("failed to decode setup message: %w", err)
+	}
+	if !isInitiateDevice {
+		verifyCtx, cancelVerify := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelVerify()
+		if err := t.verifyThreshold(verifyCtx, sessionID, keygenCommittee, threshold, setupMessageBytes); err != nil {
+			return "", fmt.Errorf("failed to verify setup message: %w", err)
+		}
 	}
 
-	handle, err := mpcKeygenWrapper.KeygenSessionFromSetup(setupMessageBytes, []byte(localPartyID))
+	if err := t.verifySetupPartyNames(setupMessageBytes, keygenCommittee); err != nil {
+		return "", fmt.Errorf("failed to verify setup message: %w", err)
+	}
+	handle, err := mpcKeygenWrapper.KeygenSessionFromSetup(setupMessageBytes, []byte(t.partyName(localPartyID)))
 	if err != nil {
-		return fmt.Errorf("failed to create session from setup message: %w", err)
+		return "", fmt.Errorf("failed to create session from setup message: %w", err)
 	}
 	defer func() {
 		if err := mpcKeygenWrapper.KeygenSessionFree(handle); err != nil {
 			t.logger.Error("failed to free keygen session", "error", err)
 		}
 	}()
+	protocolCtx, cancelProtocol := withTimeout(ctx, t.timeouts.Protocol)
+	defer cancelProtocol()
+	// the protocol stalls on a message that can't be delivered, so a failed outbound aborts it
+	protocolCtx, abortProtocol := context.WithCancelCause(protocolCtx)
+	defer abortProtocol(nil)
+	go t.watchParties(protocolCtx, abortProtocol, sessionID, localPartyID, keygenCommittee)
+	// the service may have finished a ceremony before, the outbound loop would stop right away
+	t.isKeygenFinished.Store(false)
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
 	go func() {
-		if err := t.processKeygenOutbound(handle, sessionID, keygenCommittee, localPartyID, wg); err != nil {
+		if err := t.processKeygenOutbound(protocolCtx, handle, sessionID, keygenCommittee, localPartyID, wg); err != nil {
 			t.logger.Error("failed to process keygen outbound", "error", err)
+			abortProtocol(err)
 		}
 	}()
-	err = t.processKeygenInbound(handle, sessionID, localPartyID, wg)
+	// the ECDSA keyshare comes with its own chain code, the given one is only the chain code of an EdDSA key
+	expectedChainCode := ""
+	if t.isEdDSA {
+		expectedChainCode = chainCode
+	}
+	publicKey, err := t.processKeygenInbound(protocolCtx, handle, sessionID, localPartyID, expectedChainCode, keygenCommittee, threshold, wg)
 	wg.Wait()
-	return err
+	return publicKey, err
 }
 
-func (t *TssService) processKeygenOutbound(handle Handle,
+func (t *TssService) processKeygenOutbound(ctx context.Context,
+	handle Handle,
 	sessionID string, parties []string,
 	localPartyID string,
 	wg *sync.WaitGroup) error {
 	defer wg.Done()
-	messenger := NewMessageImp(t.relayServer, sessionID)
+	messenger := t.newMessenger(sessionID)
 	mpcKeygenWrapper := t.GetMPCKeygenWrapper()
 	for {
 		outbound, err := mpcKeygenWrapper.KeygenSessionOutputMessage(handle)
@@ -166,79 +274,37 @@ func (t *TssService) processKeygenOutbound(handle Handle,
 
 			t.logger.Infoln("Sending message to", string(receiver))
 			// send the message to the receiver
-			if err := messenger.Send(localPartyID, string(receiver), encodedOutbound); err != nil {
-				t.logger.Errorf("failed to send message: %v", err)
+			if err := messenger.Send(ctx, localPartyID, t.relayPartyID(string(receiver)), encodedOutbound); err != nil {
+				return fmt.Errorf("failed to send message to %s: %w", receiver, err)
 			}
 		}
 	}
 }
 
-func (t *TssService) processKeygenInbound(handle Handle,
+func (t *TssService) processKeygenInbound(ctx context.Context,
+	handle Handle,
 	sessionID string,
 	localPartyID string,
-	wg *sync.WaitGroup) error {
+	chainCode string,
+	keygenCommittee []string,
+	threshold int,
+	wg *sync.WaitGroup) (string, error) {
 	defer wg.Done()
-	cache := make(map[string]bool)
+	tracker := newInboundTracker(localPartyID, t.logger)
+	rejected := make(map[string]bool)
+	inbound := t.transport.Receive(ctx, sessionID, localPartyID)
+	defer inbound.Close()
 	mpcKeygenWrapper := t.GetMPCKeygenWrapper()
 	for {
 		select {
-		case <-time.After(time.Minute):
+		case <-ctx.Done():
 			// set isKeygenFinished to true , so the other go routine can be stopped
 			t.isKeygenFinished.Store(true)
-			return TssKeyGenTimeout
-		case <-time.After(time.Millisecond * 100):
-			resp, err := http.Get(t.relayServer + "/message/" + sessionID + "/" + localPartyID)
-			if err != nil {
-				t.logger.Error("fail to get data from server", "error", err)
-				continue
-			}
-			if resp.StatusCode != http.StatusOK {
-				t.logger.Debug("fail to get data from server", "status", resp.Status)
-				continue
-			}
-			decoder := json.NewDecoder(resp.Body)
-			var messages []struct {
-				SessionID string   `json:"session_id,omitempty"`
-				From      string   `json:"from,omitempty"`
-				To        []string `json:"to,omitempty"`
-				Body      string   `json:"body,omitempty"`
-			}
-			if err := decoder.Decode(&messages); err != nil {
-				if err != io.EOF {
-					t.logger.Error("fail to decode messages", "error", err)
-				}
-				continue
-			}
+			return "", protocolError(ctx, TssKeyGenTimeout, tracker, []string{sessionID}, keygenCommittee)
+		case messages := <-inbound.Messages():
 			for _, message := range messages {
-				if message.From == localPartyID {
-					continue
-				}
-
-				hash := md5.Sum([]byte(message.Body))
-				hashStr := hex.EncodeToString(hash[:])
-
-				client := http.Client{}
-				req, err := http.NewRequest(http.MethodDelete, t.relayServer+"/message/"+sessionID+"/"+localPartyID+"/"+hashStr, nil)
-				if err != nil {
-					t.logger.Error("fail to delete message", "error", err)
-					continue
-				}
-				resp, err := client.Do(req)
-				if err != nil {
-					t.logger.Error("fail to delete message", "error", err)
-					continue
-				}
-				if resp.StatusCode != http.StatusOK {
-					t.logger.Error("fail to delete message", "status", resp.Status)
-					continue
-				}
-				if _, ok := cache[hashStr]; ok {
-					continue
-				}
-				cache[hashStr] = true
-				decodedBody, err := base64.StdEncoding.DecodeString(message.Body)
-				if err != nil {
-					t.logger.Error("fail to decode message", "error", err)
+				decodedBody, ok := t.acceptMessage(sessionID, localPartyID, message, inbound, tracker, rejected)
+				if !ok {
 					continue
 				}
 				t.logger.Infoln("Received message from", message.From)
@@ -252,192 +318,263 @@ func (t *TssService) processKeygenInbound(handle Handle,
 					result, err := mpcKeygenWrapper.KeygenSessionFinish(handle)
 					if err != nil {
 						t.logger.Error("fail to finish keygen", "error", err)
-						return err
+						return "", err
 					}
 					buf, err := mpcKeygenWrapper.KeyshareToBytes(result)
 					if err != nil {
 						t.logger.Error("fail to convert keyshare to bytes", "error", err)
-						return err
+						return "", err
 					}
 					encodedShare := base64.StdEncoding.EncodeToString(buf)
 					publicKeyECDSABytes, err := mpcKeygenWrapper.KeysharePublicKey(result)
 					if err != nil {
 						t.logger.Error("fail to get public key", "error", err)
-						return err
+						return "", err
 					}
 					encodedPublicKey := hex.EncodeToString(publicKeyECDSABytes)
 					t.logger.Infof("Public key: %s", encodedPublicKey)
 					// This sleep give the local party a chance to send last message to others
 					t.isKeygenFinished.Store(true)
-					return t.localStateAccessor.SaveLocalState(encodedPublicKey, encodedShare)
+					// schnorr keyshare doesn't keep the chain code, it's needed for child key derivation. The ECDSA
+					// keyshare has its own, it's saved as well so a vault gets the chain code from either curve, and it
+					// has to be the expected one when there is one
+					if !t.isEdDSA {
+						keyshareChainCode, err := mpcKeygenWrapper.KeyshareChainCode(result)
+						if err != nil {
+							return "", fmt.Errorf("fail to get chain code: %w", err)
+						}
+						if chainCode != "" && !strings.EqualFold(chainCode, hex.EncodeToString(keyshareChainCode)) {
+							return "", fmt.Errorf("chain code of keyshare %s is %x, expect %s", encodedPublicKey, keyshareChainCode, chainCode)
+						}
+						chainCode = hex.EncodeToString(keyshareChainCode)
+					}
+					if err := t.localStateAccessor.SaveLocalState(chainCodeKey(encodedPublicKey), chainCode); err != nil {
+						return "", fmt.Errorf("fail to save chain code: %w", err)
+					}
+					if err := t.saveKeyshare(encodedPublicKey, encodedShare, localPartyID, keygenCommittee, threshold); err != nil {
+						return "", err
+					}
+					return encodedPublicKey, nil
 				}
 			}
 		}
 	}
 }
 
-func (t *TssService) Keysign(sessionID string,
+func (t *TssService) Keysign(ctx context.Context,
+	sessionID string,
 	publicKeyECDSA string,
 	message string,
+	messageEncoding string,
+	hashFunction string,
 	derivePath string,
 	localPartyID string,
 	keysignCommittee []string,
-	isInitiateDevice bool) error {
+	isInitiateDevice bool) (*KeysignResult, error) {
 	if publicKeyECDSA == "" {
-		return fmt.Errorf("public key is empty")
+		return nil, fmt.Errorf("public key is empty")
 	}
 	if message == "" {
-		return fmt.Errorf("message is empty")
+		return nil, fmt.Errorf("message is empty")
 	}
 	if derivePath == "" {
-		return fmt.Errorf("derive path is empty")
+		return nil, fmt.Errorf("derive path is empty")
+	}
+	if err := t.checkDerivePath(derivePath); err != nil {
+		return nil, err
 	}
 	if localPartyID == "" {
-		return fmt.Errorf("local party id is empty")
+		return nil, fmt.Errorf("local party id is empty")
 	}
 	if len(keysignCommittee) == 0 {
-		return fmt.Errorf("keysign committee is empty")
+		return nil, fmt.Errorf("keysign committee is empty")
+	}
+	decodedMessage, err := DecodeInputMessage(message, messageEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode message: %w", err)
+	}
+	// every party hashes the message by itself, the hash in the setup message is checked against it
+	msgHash, err := HashMessage(decodedMessage, hashFunction)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash message: %w", err)
+	}
+	if !t.isEdDSA && len(msgHash) != 32 {
+		return nil, fmt.Errorf("message hash should be 32 bytes, got %d", len(msgHash))
 	}
 	mpcWrapper := t.GetMPCKeygenWrapper()
 	t.logger.WithFields(logrus.Fields{
 		"session_id":         sessionID,
 		"public_key_ecdsa":   publicKeyECDSA,
 		"message":            message,
+		"message_encoding":   messageEncoding,
+		"hash_function":      hashFunction,
 		"derive_path":        derivePath,
 		"local_party_id":     localPartyID,
 		"keysign_committee":  keysignCommittee,
 		"is_initiate_device": isInitiateDevice,
 	}).Info("Keysign")
 
-	if err := RegisterSession(t.relayServer, sessionID, localPartyID); err != nil {
-		return fmt.Errorf("failed to start session: %w", err)
+	joinCtx, cancelJoin := withTimeout(ctx, t.timeouts.Join)
+	defer cancelJoin()
+	session, err := t.beginSession(OperationKeysign, sessionID, localPartyID, keysignCommittee)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin session: %w", err)
+	}
+	defer t.endSession(session)
+	if err := t.transport.RegisterSession(joinCtx, sessionID, localPartyID); err != nil {
+		return nil, fmt.Errorf("failed to start session: %w", err)
 	}
 	// we need to get the shares
 	keyshare, err := t.localStateAccessor.GetLocalState(publicKeyECDSA)
 	if err != nil {
-		return fmt.Errorf("failed to get keyshare: %w", err)
+		return nil, fmt.Errorf("failed to get keyshare: %w", err)
 	}
 	keyshareBytes, err := base64.StdEncoding.DecodeString(keyshare)
 	if err != nil {
-		return fmt.Errorf("failed to decode keyshare: %w", err)
+		return nil, fmt.Errorf("failed to decode keyshare: %w", err)
 	}
 	keyshareHandle, err := mpcWrapper.KeyshareFromBytes(keyshareBytes)
 	if err != nil {
-		return fmt.Errorf("failed to create keyshare from bytes: %w", err)
+		return nil, fmt.Errorf("failed to create keyshare from bytes: %w", err)
 	}
 	defer func() {
 		if err := mpcWrapper.KeyshareFree(keyshareHandle); err != nil {
 			t.logger.Error("failed to free keyshare", "error", err)
 		}
 	}()
-	msgHash := SHA256HashBytes([]byte(message))
 	var encodedSetupMsg string = ""
 	if isInitiateDevice {
-		if coordinator.WaitAllParties(keysignCommittee, t.relayServer, sessionID) != nil {
-			return fmt.Errorf("failed to wait for all parties to join")
+		if err := t.transport.WaitAllParties(joinCtx, sessionID, keysignCommittee); err != nil {
+			return nil, fmt.Errorf("failed to wait for all parties to join: %w", err)
 		}
 		keyID, err := mpcWrapper.KeyshareKeyID(keyshareHandle)
 		if err != nil {
-			return fmt.Errorf("failed to get key id: %w", err)
+			return nil, fmt.Errorf("failed to get key id: %w", err)
 		}
 		keysignCommitteeBytes, err := t.convertKeygenCommitteeToBytes(keysignCommittee)
 		if err != nil {
-			return fmt.Errorf("failed to get keysign committee: %w", err)
+			return nil, fmt.Errorf("failed to get keysign committee: %w", err)
 		}
-		intialMsg, err := mpcWrapper.SignSetupMsgNew(keyID, []byte("m/44/931/0/0/0"), msgHash, keysignCommitteeBytes)
+		intialMsg, err := mpcWrapper.SignSetupMsgNew(keyID, []byte(derivePath), msgHash, keysignCommitteeBytes)
 		if err != nil {
-			return fmt.Errorf("failed to create initial message: %w", err)
+			return nil, fmt.Errorf("failed to create initial message: %w", err)
 		}
 		encodedInitialMsg := base64.StdEncoding.EncodeToString(intialMsg)
 		t.logger.Infoln("initial message is:", encodedInitialMsg)
-		if err := UploadPayload(t.relayServer, sessionID, encodedInitialMsg); err != nil {
-			return fmt.Errorf("failed to upload initial message: %w", err)
+		setupCtx, cancelSetup := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelSetup()
+		if err := t.transport.UploadPayload(setupCtx, sessionID, encodedInitialMsg); err != nil {
+			return nil, fmt.Errorf("failed to upload initial message: %w", err)
 		}
 		encodedSetupMsg = encodedInitialMsg
-		if err := StartSession(t.relayServer, sessionID, keysignCommittee); err != nil {
-			return fmt.Errorf("failed to start session: %w", err)
+		if err := t.transport.StartSession(setupCtx, sessionID, keysignCommittee); err != nil {
+			return nil, fmt.Errorf("failed to start session: %w", err)
 		}
 	} else {
-		_, err := WaitForSessionStart(t.relayServer, sessionID)
+		_, err := t.transport.WaitForSessionStart(joinCtx, sessionID)
 		if err != nil {
-			return fmt.Errorf("failed to wait for session to start: %w", err)
+			return nil, fmt.Errorf("failed to wait for session to start: %w", err)
 		}
+		setupCtx, cancelSetup := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelSetup()
 		// retrieve the setup Message
-		encodedSetupMsg, err = GetPayload(t.relayServer, sessionID)
+		encodedSetupMsg, err = t.transport.GetPayload(setupCtx, sessionID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get setup message: %w", err)
+		}
 	}
 	setupMessageBytes, err := base64.StdEncoding.DecodeString(encodedSetupMsg)
 	if err != nil {
-		return fmt.Errorf("failed to decode setup message: %w", err)
+		return nil, fmt.Errorf("failed to decode setup message: %w", err)
 	}
 	messageHashInSetupMsg, err := mpcWrapper.DecodeMessage(setupMessageBytes)
 	if err != nil {
-		return fmt.Errorf("failed to decode message: %w", err)
+		return nil, fmt.Errorf("failed to decode message: %w", err)
 	}
 	if !bytes.Equal(messageHashInSetupMsg, msgHash) {
-		return fmt.Errorf("message hash in setup message is not equal to the message, stop keysign")
+		return nil, fmt.Errorf("message hash in setup message is not equal to the message, stop keysign")
 	}
-	sessionHandle, err := mpcWrapper.SignSessionFromSetup(setupMessageBytes, []byte(localPartyID), keyshareHandle)
+	sessionHandle, err := mpcWrapper.SignSessionFromSetup(setupMessageBytes, []byte(t.partyName(localPartyID)), keyshareHandle)
 	if err != nil {
-		return fmt.Errorf("failed to create session from setup message: %w", err)
+		return nil, fmt.Errorf("failed to create session from setup message: %w", err)
 	}
 	defer func() {
 		if err := mpcWrapper.SignSessionFree(sessionHandle); err != nil {
 			t.logger.Error("failed to free keysign session", "error", err)
 		}
 	}()
-	wg := &sync.WaitGroup{}
-	wg.Add(2)
-	go func() {
-		if err := t.processKeysignOutbound(sessionHandle, sessionID, keysignCommittee, localPartyID, message, wg); err != nil {
-			t.logger.Error("failed to process keygen outbound", "error", err)
-		}
-	}()
-	sig, err := t.processKeysignInbound(sessionHandle, sessionID, localPartyID, wg)
-	wg.Wait()
+	sig, err := t.runSignSession(ctx, sessionHandle, sessionID, localPartyID, keysignCommittee, message, mpcWrapper.SignSessionFinish)
+	if err != nil {
+		return nil, err
+	}
 	t.logger.Infoln("Keysign result is:", len(sig))
+	var pubKeyBytes []byte
 	if t.isEdDSA {
-		pubKeyBytes, err := hex.DecodeString(publicKeyECDSA)
+		pubKeyBytes, err = hex.DecodeString(publicKeyECDSA)
 		if err != nil {
-			return fmt.Errorf("failed to decode public key: %w", err)
-		}
-
-		if ed25519.Verify(pubKeyBytes, msgHash, sig) {
-			t.logger.Infoln("Signature is valid")
-		} else {
-			t.logger.Error("Signature is invalid")
+			return nil, fmt.Errorf("failed to decode public key: %w", err)
 		}
 	} else {
-		if len(sig) != 65 {
-			return fmt.Errorf("signature length is not 64")
-		}
-		r := sig[:32]
-		s := sig[32:64]
-		// recovery := sig[64]
-		pubKeyBytes, err := hex.DecodeString(publicKeyECDSA)
-		if err != nil {
-			return fmt.Errorf("failed to decode public key: %w", err)
-		}
-		publicKey, err := secp256k1.ParsePubKey(pubKeyBytes)
+		// the signature is produced with the key derived from derivePath, not the root key
+		pubKeyBytes, err = mpcWrapper.KeyshareDeriveChildPublicKey(keyshareHandle, []byte(derivePath))
 		if err != nil {
-			return fmt.Errorf("failed to parse public key: %w", err)
+			return nil, fmt.Errorf("failed to derive child public key: %w", err)
 		}
+		t.logger.Infof("Derived public key: %s", hex.EncodeToString(pubKeyBytes))
+	}
+	result, err := NewKeysignResult(msgHash, derivePath, pubKeyBytes, sig, t.isEdDSA)
+	if err != nil {
+		return nil, err
+	}
+	if err := result.Verify(); err != nil {
+		t.logger.Error("Signature is invalid")
+		return result, err
+	}
+	t.logger.Infoln("Signature is valid")
+	return result, nil
+}
 
-		if ecdsa.Verify(publicKey.ToECDSA(), msgHash, new(big.Int).SetBytes(r), new(big.Int).SetBytes(s)) {
-			t.logger.Infoln("Signature is valid")
-		} else {
-			t.logger.Error("Signature is invalid")
+// runSignSession exchanges the messages of a sign session until it's finished, finish turns the finished
+// session into the result
+func (t *TssService) runSignSession(ctx context.Context,
+	sessionHandle Handle,
+	sessionID string,
+	localPartyID string,
+	keysignCommittee []string,
+	message string,
+	finish func(session Handle) ([]byte, error)) ([]byte, error) {
+	protocolCtx, cancelProtocol := withTimeout(ctx, t.timeouts.Protocol)
+	defer cancelProtocol()
+	// the protocol stalls on a message that can't be delivered, so a failed outbound aborts it
+	protocolCtx, abortProtocol := context.WithCancelCause(protocolCtx)
+	defer abortProtocol(nil)
+	go t.watchParties(protocolCtx, abortProtocol, sessionID, localPartyID, keysignCommittee)
+	t.isKeysignFinished.Store(false)
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		if err := t.processKeysignOutbound(protocolCtx, sessionHandle, sessionID, keysignCommittee, localPartyID, message, wg); err != nil {
+			t.logger.Error("failed to process keygen outbound", "error", err)
+			abortProtocol(err)
 		}
+	}()
+	result, err := t.processKeysignInbound(protocolCtx, sessionHandle, sessionID, localPartyID, keysignCommittee, finish, wg)
+	wg.Wait()
+	if err != nil {
+		return nil, fmt.Errorf("failed to process keysign inbound: %w", err)
 	}
-	return nil
+	return result, nil
 }
-func (t *TssService) processKeysignOutbound(handle Handle,
+
+func (t *TssService) processKeysignOutbound(ctx context.Context,
+	handle Handle,
 	sessionID string,
 	parties []string,
 	localPartyID string,
 	message string,
 	wg *sync.WaitGroup) error {
 	defer wg.Done()
-	messenger := NewMessageImp(t.relayServer, sessionID)
+	messenger := t.newMessenger(sessionID)
 	mpcWrapper := t.GetMPCKeygenWrapper()
 	for {
 		outbound, err := mpcWrapper.SignSessionOutputMessage(handle)
@@ -452,7 +589,7 @@ func (t *TssService) processKeysignOutbound(handle Handle,
 			time.Sleep(time.Millisecond * 100)
 			continue
 		}
-		fmt.Println("Outbound message is:", len(outbound))
+		t.logger.Infoln("Outbound message is:", len(outbound))
 		encodedOutbound := base64.StdEncoding.EncodeToString(outbound)
 		for i := 0; i < len(parties); i++ {
 			receiver, err := mpcWrapper.SignSessionMessageReceiver(handle, outbound, i)
@@ -465,78 +602,35 @@ func (t *TssService) processKeysignOutbound(handle Handle,
 
 			t.logger.Infoln("Sending message to", string(receiver))
 			// send the message to the receiver
-			if err := messenger.Send(localPartyID, string(receiver), encodedOutbound); err != nil {
-				t.logger.Errorf("failed to send message: %v", err)
+			if err := messenger.Send(ctx, localPartyID, t.relayPartyID(string(receiver)), encodedOutbound); err != nil {
+				return fmt.Errorf("failed to send message to %s: %w", receiver, err)
 			}
 		}
 	}
 }
-func (t *TssService) processKeysignInbound(handle Handle,
+func (t *TssService) processKeysignInbound(ctx context.Context,
+	handle Handle,
 	sessionID string,
 	localPartyID string,
+	parties []string,
+	finish func(session Handle) ([]byte, error),
 	wg *sync.WaitGroup) ([]byte, error) {
 	defer wg.Done()
-	cache := make(map[string]bool)
+	tracker := newInboundTracker(localPartyID, t.logger)
+	rejected := make(map[string]bool)
+	inbound := t.transport.Receive(ctx, sessionID, localPartyID)
+	defer inbound.Close()
 	mpcWrapper := t.GetMPCKeygenWrapper()
 	for {
 		select {
-		case <-time.After(time.Minute):
+		case <-ctx.Done():
 			// set isKeygenFinished to true , so the other go routine can be stopped
 			t.isKeysignFinished.Store(true)
-			return nil, TssKeyGenTimeout
-		case <-time.After(time.Millisecond * 100):
-			resp, err := http.Get(t.relayServer + "/message/" + sessionID + "/" + localPartyID)
-			if err != nil {
-				t.logger.Error("fail to get data from server", "error", err)
-				continue
-			}
-			if resp.StatusCode != http.StatusOK {
-				t.logger.Debug("fail to get data from server", "status", resp.Status)
-				continue
-			}
-			decoder := json.NewDecoder(resp.Body)
-			var messages []struct {
-				SessionID string   `json:"session_id,omitempty"`
-				From      string   `json:"from,omitempty"`
-				To        []string `json:"to,omitempty"`
-				Body      string   `json:"body,omitempty"`
-			}
-			if err := decoder.Decode(&messages); err != nil {
-				if err != io.EOF {
-					t.logger.Error("fail to decode messages", "error", err)
-				}
-				continue
-			}
+			return nil, protocolError(ctx, ErrKeysignTimeout, tracker, []string{sessionID}, parties)
+		case messages := <-inbound.Messages():
 			for _, message := range messages {
-				if message.From == localPartyID {
-					continue
-				}
-
-				hash := md5.Sum([]byte(message.Body))
-				hashStr := hex.EncodeToString(hash[:])
-
-				client := http.Client{}
-				req, err := http.NewRequest(http.MethodDelete, t.relayServer+"/message/"+sessionID+"/"+localPartyID+"/"+hashStr, nil)
-				if err != nil {
-					t.logger.Error("fail to delete message", "error", err)
-					continue
-				}
-				resp, err := client.Do(req)
-				if err != nil {
-					t.logger.Error("fail to delete message", "error", err)
-					continue
-				}
-				if resp.StatusCode != http.StatusOK {
-					t.logger.Error("fail to delete message", "status", resp.Status)
-					continue
-				}
-				if _, ok := cache[hashStr]; ok {
-					continue
-				}
-				cache[hashStr] = true
-				decodedBody, err := base64.StdEncoding.DecodeString(message.Body)
-				if err != nil {
-					t.logger.Error("fail to decode message", "error", err)
+				decodedBody, ok := t.acceptMessage(sessionID, localPartyID, message, inbound, tracker, rejected)
+				if !ok {
 					continue
 				}
 				t.logger.Infoln("Received message from", message.From)
@@ -547,9 +641,11 @@ func (t *TssService) processKeysignInbound(handle Handle,
 				}
 				if isFinished {
 					t.logger.Infoln("keysign finished")
-					result, err := mpcWrapper.SignSessionFinish(handle)
+					result, err := finish(handle)
 					if err != nil {
-						t.logger.Error("fail to finish keygen", "error", err)
+						t.logger.Error("fail to finish keysign", "error", err)
+						// stop the outbound go routine
+						t.isKeysignFinished.Store(true)
 						return nil, err
 					}
 					encodedKeysignResult := base64.StdEncoding.EncodeToString(result)
@@ -568,7 +664,7 @@ func (t *TssService) convertKeygenCommitteeToBytes(paries []string) ([]byte, err
 	}
 	result := make([]byte, 0)
 	for _, party := range paries {
-		result = append(result, []byte(party)...)
+		result = append(result, []byte(t.partyName(party))...)
 		result = append(result, byte(0))
 	}
 	// remove the last 0
@@ -730,67 +826,95 @@ func ExportRootKey(parts []string, parties []string) error {
 	}
 	return nil
 }
-func (t *TssService) MigrateKey(sessionID string,
+func (t *TssService) MigrateKey(ctx context.Context,
+	sessionID string,
 	isInitiateDevice bool,
-	keyshareFile string) error {
+	keyshareFile string,
+	shareCipher *ShareCipher,
+	threshold int) error {
 	t.logger.WithFields(logrus.Fields{
 		"session_id":         sessionID,
 		"is_initiate_device": isInitiateDevice,
 		"keyshare_file":      keyshareFile,
+		"threshold":          threshold,
 		"eddsa":              t.isEdDSA,
 	}).Info("migrate key")
 
-	vault, err := GetVaultFromFile(keyshareFile)
+	vault, err := GetVaultFromFile(keyshareFile, shareCipher)
 	if err != nil {
 		return fmt.Errorf("fail to get vault from file: %w", err)
 	}
 	localPartyID := vault.LocalPartyID
 	keygenCommittee := vault.Signers
-	if err := RegisterSession(t.relayServer, sessionID, localPartyID); err != nil {
+	threshold, err = ResolveThreshold(threshold, len(keygenCommittee))
+	if err != nil {
+		return fmt.Errorf("failed to get threshold: %w", err)
+	}
+	t.logger.Infof("Threshold is %v", threshold)
+	joinCtx, cancelJoin := withTimeout(ctx, t.timeouts.Join)
+	defer cancelJoin()
+	session, err := t.beginSession(OperationMigrate, sessionID, localPartyID, keygenCommittee)
+	if err != nil {
+		return fmt.Errorf("failed to begin session: %w", err)
+	}
+	defer t.endSession(session)
+	if err := t.transport.RegisterSession(joinCtx, sessionID, localPartyID); err != nil {
 		return fmt.Errorf("failed to register session: %w", err)
 	}
 	mpcKeygenWrapper := t.GetMPCKeygenWrapper()
 	var encodedSetupMsg = ""
 	if isInitiateDevice {
-		if coordinator.WaitAllParties(keygenCommittee, t.relayServer, sessionID) != nil {
-			return fmt.Errorf("failed to wait for all parties to join")
+		if err := t.transport.WaitAllParties(joinCtx, sessionID, keygenCommittee); err != nil {
+			return fmt.Errorf("failed to wait for all parties to join: %w", err)
 		}
 		fmt.Println("I am the leader , construct the setup message")
 		keygenCommitteeBytes, err := t.convertKeygenCommitteeToBytes(keygenCommittee)
 		if err != nil {
 			return fmt.Errorf("failed to get keygen committee: %v", err)
 		}
-		threshold, err := GetThreshold(len(keygenCommittee))
-		if err != nil {
-			return fmt.Errorf("failed to get threshold: %v", err)
-		}
-		t.logger.Infof("Threshold is %v", threshold+1)
-		setupMsg, err := mpcKeygenWrapper.KeygenSetupMsgNew(threshold+1, nil, keygenCommitteeBytes)
+		setupMsg, err := mpcKeygenWrapper.KeygenSetupMsgNew(threshold, nil, keygenCommitteeBytes)
 		if err != nil {
 			return fmt.Errorf("failed to create setup message: %v", err)
 		}
 		encodedSetupMsg = base64.StdEncoding.EncodeToString(setupMsg)
 		t.logger.Infoln("setup message is:", encodedSetupMsg)
-		if err := UploadPayload(t.relayServer, sessionID, encodedSetupMsg); err != nil {
+		setupCtx, cancelSetup := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelSetup()
+		if err := t.transport.UploadPayload(setupCtx, sessionID, encodedSetupMsg); err != nil {
 			return fmt.Errorf("failed to upload setup message: %v", err)
 		}
+		if err := t.uploadThreshold(setupCtx, sessionID, localPartyID, threshold, setupMsg); err != nil {
+			return fmt.Errorf("failed to upload threshold: %w", err)
+		}
 
-		if err := StartSession(t.relayServer, sessionID, keygenCommittee); err != nil {
+		if err := t.transport.StartSession(setupCtx, sessionID, keygenCommittee); err != nil {
 			return fmt.Errorf("failed to start session: %w", err)
 		}
 	} else {
 		// wait for the keygen to start
-		_, err := WaitForSessionStart(t.relayServer, sessionID)
+		_, err := t.transport.WaitForSessionStart(joinCtx, sessionID)
 		if err != nil {
 			return fmt.Errorf("failed to wait for session to start: %w", err)
 		}
+		setupCtx, cancelSetup := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelSetup()
 		// retrieve the setup Message
-		encodedSetupMsg, err = GetPayload(t.relayServer, sessionID)
+		encodedSetupMsg, err = t.transport.GetPayload(setupCtx, sessionID)
+		if err != nil {
+			return fmt.Errorf("failed to get setup message: %w", err)
+		}
 	}
 	setupMessageBytes, err := base64.StdEncoding.DecodeString(encodedSetupMsg)
 	if err != nil {
 		return fmt.Errorf("failed to decode setup message: %w", err)
 	}
+	if !isInitiateDevice {
+		verifyCtx, cancelVerify := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelVerify()
+		if err := t.verifyThreshold(verifyCtx, sessionID, keygenCommittee, threshold, setupMessageBytes); err != nil {
+			return fmt.Errorf("failed to verify setup message: %w", err)
+		}
+	}
 
 	var secret []byte
 	var publicKeyBytes []byte
@@ -824,7 +948,7 @@ func (t *TssService) MigrateKey(sessionID string,
 	}
 
 	handle, err := mpcKeygenWrapper.MigrateSessionFromSetup(setupMessageBytes,
-		[]byte(localPartyID),
+		[]byte(t.partyName(localPartyID)),
 		publicKeyBytes,
 		chainCodeBytes,
 		secret)
@@ -836,14 +960,22 @@ func (t *TssService) MigrateKey(sessionID string,
 			t.logger.Error("failed to free keygen session", "error", err)
 		}
 	}()
+	protocolCtx, cancelProtocol := withTimeout(ctx, t.timeouts.Protocol)
+	defer cancelProtocol()
+	// the protocol stalls on a message that can't be delivered, so a failed outbound aborts it
+	protocolCtx, abortProtocol := context.WithCancelCause(protocolCtx)
+	defer abortProtocol(nil)
+	go t.watchParties(protocolCtx, abortProtocol, sessionID, localPartyID, keygenCommittee)
+	t.isKeygenFinished.Store(false)
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
 	go func() {
-		if err := t.processKeygenOutbound(handle, sessionID, keygenCommittee, localPartyID, wg); err != nil {
+		if err := t.processKeygenOutbound(protocolCtx, handle, sessionID, keygenCommittee, localPartyID, wg); err != nil {
 			t.logger.Error("failed to process keygen outbound", "error", err)
+			abortProtocol(err)
 		}
 	}()
-	err = t.processKeygenInbound(handle, sessionID, localPartyID, wg)
+	_, err = t.processKeygenInbound(protocolCtx, handle, sessionID, localPartyID, vault.HexChainCode, keygenCommittee, threshold, wg)
 	wg.Wait()
 	return err
 }
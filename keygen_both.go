@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ecdsaSessionID and eddsaSessionID are the sub-sessions KeygenBoth runs the two keygens in
+func ecdsaSessionID(sessionID string) string {
+	return sessionID + "-ecdsa"
+}
+
+func eddsaSessionID(sessionID string) string {
+	return sessionID + "-eddsa"
+}
+
+// forCurve returns a TssService sharing the transport, local state and keys of t for the given curve.
+// The protocol state is not shared, so it can run next to t.
+func (t *TssService) forCurve(isEdDSA bool) *TssService {
+	return &TssService{
+		transport:          t.transport,
+		localStateAccessor: t.localStateAccessor,
+		logger:             t.logger,
+		isKeygenFinished:   &atomic.Bool{},
+		isKeysignFinished:  &atomic.Bool{},
+		isEdDSA:            isEdDSA,
+		encryptionKey:      t.encryptionKey,
+		identityKey:        t.identityKey,
+		partyKeys:          t.partyKeys,
+		timeouts:           t.timeouts,
+		journal:            t.journal,
+	}
+}
+
+// KeygenBoth generates the ECDSA and the EdDSA key of a wallet in one run, each in its own sub-session
+// derived from sessionID, the leader initiates both of them. The ECDSA keygen comes first, its keyshare has
+// its own chain code and the EdDSA key takes it, so both keys of the wallet share one chain code. Both
+// keyshares end up in the local state accessor, a VaultStateAccessor keeps them together in one vault file.
+func (t *TssService) KeygenBoth(ctx context.Context,
+	sessionID string,
+	localPartyID string,
+	keygenCommittee []string,
+	threshold int,
+	isInitiateDevice bool) error {
+	t.logger.WithFields(logrus.Fields{
+		"session_id":         sessionID,
+		"local_party_id":     localPartyID,
+		"keygen_committee":   keygenCommittee,
+		"is_initiate_device": isInitiateDevice,
+	}).Info("Keygen ECDSA and EdDSA")
+	ecdsaPublicKey, err := t.forCurve(false).keygen(ctx, ecdsaSessionID(sessionID), "", localPartyID, keygenCommittee, threshold, isInitiateDevice)
+	if err != nil {
+		return fmt.Errorf("ECDSA keygen failed: %w", err)
+	}
+	chainCode, err := t.localStateAccessor.GetLocalState(chainCodeKey(ecdsaPublicKey))
+	if err != nil {
+		return fmt.Errorf("failed to get chain code of %s: %w", ecdsaPublicKey, err)
+	}
+	eddsaPublicKey, err := t.forCurve(true).keygen(ctx, eddsaSessionID(sessionID), chainCode, localPartyID, keygenCommittee, threshold, isInitiateDevice)
+	if err != nil {
+		return fmt.Errorf("EdDSA keygen failed: %w", err)
+	}
+	eddsaChainCode, err := t.localStateAccessor.GetLocalState(chainCodeKey(eddsaPublicKey))
+	if err != nil {
+		return fmt.Errorf("failed to get chain code of %s: %w", eddsaPublicKey, err)
+	}
+	if !strings.EqualFold(eddsaChainCode, chainCode) {
+		return fmt.Errorf("chain code of EdDSA key %s is %s, the one of ECDSA key %s is %s", eddsaPublicKey, eddsaChainCode, ecdsaPublicKey, chainCode)
+	}
+	return nil
+}
@@ -23,7 +23,7 @@ func TestGetLocalSecret(t *testing.T) {
 	secret := big.NewInt(0)
 	tmp := big.NewInt(0)
 	for _, file := range files {
-		vault, err := GetVaultFromFile(file)
+		vault, err := GetVaultFromFile(file, nil)
 		if err != nil {
 			t.Errorf("Error: %v", err)
 			t.Fail()
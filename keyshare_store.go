@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	CurveECDSA = "ecdsa"
+	CurveEdDSA = "eddsa"
+
+	storeSchemeDir  = "dir"
+	storeSchemeBolt = "bolt"
+)
+
+// KeyshareMetadata describes a stored keyshare, it's kept in clear text next to the keyshare
+type KeyshareMetadata struct {
+	PublicKey    string    `json:"public_key"`
+	Curve        string    `json:"curve"`
+	LocalPartyID string    `json:"local_party_id"`
+	Committee    []string  `json:"committee,omitempty"`
+	Threshold    int       `json:"threshold,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// KeyshareStore is a LocalStateAccessor that keeps track of the keyshares it holds. It doesn't assume
+// anything about where the keyshares live, so a secret store such as an OS keyring can implement it as well.
+type KeyshareStore interface {
+	LocalStateAccessor
+	// SaveMetadata records the metadata of a saved keyshare, the creation time of an existing keyshare is kept
+	SaveMetadata(metadata KeyshareMetadata) error
+	// List returns the keyshares of local party, keyshares saved without metadata only have the public key and curve
+	List() ([]KeyshareMetadata, error)
+	// Delete removes the keyshare, its chain code, pending refreshed keyshare, pre-signatures and metadata
+	Delete(pubKey string) error
+}
+
+// OpenKeyshareStore opens the keyshare store of local party described by storeURI:
+//
+//	dir://<directory> or a plain directory, one file per keyshare, the current directory when empty
+//	bolt://<file>, all keyshares in a bbolt database file
+//
+// The keyshares are sealed with shareCipher when it's not nil.
+func OpenKeyshareStore(storeURI string, localPartyID string, shareCipher *ShareCipher) (KeyshareStore, error) {
+	scheme, location, found := strings.Cut(storeURI, "://")
+	if !found {
+		return NewDirectoryStateAccessor(storeURI, localPartyID, shareCipher), nil
+	}
+	switch scheme {
+	case storeSchemeDir:
+		return NewDirectoryStateAccessor(location, localPartyID, shareCipher), nil
+	case storeSchemeBolt:
+		if location == "" {
+			return nil, fmt.Errorf("bolt store requires a database file")
+		}
+		return NewBoltStateAccessor(location, localPartyID, shareCipher), nil
+	default:
+		return nil, fmt.Errorf("unsupported store %s, expect %s:// or %s://", scheme, storeSchemeDir, storeSchemeBolt)
+	}
+}
+
+// curveOfPublicKey tells the curve of a hex encoded public key, a compressed secp256k1 public key is 33 bytes,
+// an ed25519 public key is 32 bytes
+func curveOfPublicKey(pubKey string) (string, error) {
+	switch len(pubKey) {
+	case 66:
+		return CurveECDSA, nil
+	case 64:
+		return CurveEdDSA, nil
+	default:
+		return "", fmt.Errorf("invalid public key %s", pubKey)
+	}
+}
+
+// updateMetadata keeps the creation time of a keyshare replaced by reshare or refresh
+func updateMetadata(previous *KeyshareMetadata, metadata KeyshareMetadata) KeyshareMetadata {
+	now := time.Now().UTC()
+	metadata.CreatedAt = now
+	if previous != nil && !previous.CreatedAt.IsZero() {
+		metadata.CreatedAt = previous.CreatedAt
+	}
+	metadata.UpdatedAt = now
+	return metadata
+}
+
+// keyshareMetadata returns the metadata of the keyshare of publicKey, nil when the local state accessor doesn't
+// keep track of the keyshares or has no metadata of it
+func (t *TssService) keyshareMetadata(publicKey string) (*KeyshareMetadata, error) {
+	store, ok := t.localStateAccessor.(KeyshareStore)
+	if !ok {
+		return nil, nil
+	}
+	list, err := store.List()
+	if err != nil {
+		return nil, fmt.Errorf("fail to list keyshares: %w", err)
+	}
+	for _, metadata := range list {
+		if metadata.PublicKey == publicKey {
+			return &metadata, nil
+		}
+	}
+	return nil, nil
+}
+
+// deleteLocalState drops the local state saved under key next to a keyshare, a local state accessor that can't
+// delete gets an empty state instead
+func (t *TssService) deleteLocalState(key string) error {
+	if store, ok := t.localStateAccessor.(KeyshareStore); ok {
+		return store.Delete(key)
+	}
+	return t.localStateAccessor.SaveLocalState(key, "")
+}
+
+// saveKeyshare saves the keyshare, and its metadata when the local state accessor keeps track of them
+func (t *TssService) saveKeyshare(publicKey string,
+	keyshare string,
+	localPartyID string,
+	keygenCommittee []string,
+	threshold int) error {
+	if err := t.localStateAccessor.SaveLocalState(publicKey, keyshare); err != nil {
+		return err
+	}
+	store, ok := t.localStateAccessor.(KeyshareStore)
+	if !ok {
+		return nil
+	}
+	curve := CurveECDSA
+	if t.isEdDSA {
+		curve = CurveEdDSA
+	}
+	if err := store.SaveMetadata(KeyshareMetadata{
+		PublicKey:    publicKey,
+		Curve:        curve,
+		LocalPartyID: localPartyID,
+		Committee:    keygenCommittee,
+		Threshold:    threshold,
+	}); err != nil {
+		return fmt.Errorf("fail to save keyshare metadata: %w", err)
+	}
+	return nil
+}
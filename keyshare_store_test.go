@@ -0,0 +1,129 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenKeyshareStore(t *testing.T) {
+	dir := t.TempDir()
+	for uri, isBolt := range map[string]bool{
+		"":                                false,
+		dir:                               false,
+		"dir://" + dir:                    false,
+		"bolt://" + dir + "/keyshares.db": true,
+	} {
+		store, err := OpenKeyshareStore(uri, "first", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := store.(*BoltStateAccessor); ok != isBolt {
+			t.Fatalf("%s opened the wrong store %T", uri, store)
+		}
+	}
+	for _, uri := range []string{"bolt://", "s3://bucket"} {
+		if _, err := OpenKeyshareStore(uri, "first", nil); err == nil {
+			t.Fatalf("%s should be rejected", uri)
+		}
+	}
+}
+
+func TestKeyshareStore(t *testing.T) {
+	ecdsaPublicKey := "02" + strings.Repeat("ab", 32)
+	eddsaPublicKey := strings.Repeat("cd", 32)
+	keyCipher := &ShareCipher{key: make([]byte, 32)}
+	for cipherName, shareCipher := range map[string]*ShareCipher{"clear": nil, "encrypted": keyCipher} {
+		dir := t.TempDir()
+		stores := map[string]func(party string) KeyshareStore{
+			"dir": func(party string) KeyshareStore {
+				return NewDirectoryStateAccessor(dir, party, shareCipher)
+			},
+			"bolt": func(party string) KeyshareStore {
+				return NewBoltStateAccessor(filepath.Join(dir, "keyshares.db"), party, shareCipher)
+			},
+		}
+		for name, newStore := range stores {
+			t.Run(name+"/"+cipherName, func(t *testing.T) {
+				store := newStore("first")
+				for key, value := range map[string]string{
+					ecdsaPublicKey:                     "ecdsa keyshare",
+					chainCodeKey(ecdsaPublicKey):       "chain code",
+					pendingKeyshareKey(ecdsaPublicKey): "pending keyshare",
+					presignKey(ecdsaPublicKey, "1"):    "presign",
+					eddsaPublicKey:                     "eddsa keyshare",
+				} {
+					if err := store.SaveLocalState(key, value); err != nil {
+						t.Fatal(err)
+					}
+				}
+				// another party sharing the store
+				if err := newStore("second").SaveLocalState(ecdsaPublicKey, "keyshare of second"); err != nil {
+					t.Fatal(err)
+				}
+				metadata := KeyshareMetadata{
+					PublicKey:    ecdsaPublicKey,
+					Curve:        CurveECDSA,
+					LocalPartyID: "first",
+					Committee:    []string{"first", "second", "third"},
+					Threshold:    1,
+				}
+				if err := store.SaveMetadata(metadata); err != nil {
+					t.Fatal(err)
+				}
+				list, err := store.List()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(list) != 2 {
+					t.Fatalf("expected 2 keyshares, got %+v", list)
+				}
+				created := list[0].CreatedAt
+				if list[0].PublicKey != ecdsaPublicKey || list[0].Threshold != 1 || len(list[0].Committee) != 3 || created.IsZero() {
+					t.Fatalf("unexpected metadata: %+v", list[0])
+				}
+				if list[1].PublicKey != eddsaPublicKey || list[1].Curve != CurveEdDSA || list[1].LocalPartyID != "first" {
+					t.Fatalf("unexpected metadata: %+v", list[1])
+				}
+				// reshare keeps the creation time
+				if err := store.SaveMetadata(metadata); err != nil {
+					t.Fatal(err)
+				}
+				list, err = store.List()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !list[0].CreatedAt.Equal(created) {
+					t.Fatalf("creation time changed from %v to %v", created, list[0].CreatedAt)
+				}
+
+				if err := store.Delete(ecdsaPublicKey); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := store.GetLocalState(ecdsaPublicKey); err == nil {
+					t.Fatal("deleted keyshare should not exist")
+				}
+				if _, err := store.GetLocalState(chainCodeKey(ecdsaPublicKey)); err == nil {
+					t.Fatal("chain code of deleted keyshare should not exist")
+				}
+				if _, err := store.GetLocalState(pendingKeyshareKey(ecdsaPublicKey)); err == nil {
+					t.Fatal("pending keyshare of deleted keyshare should not exist")
+				}
+				if _, err := store.GetLocalState(presignKey(ecdsaPublicKey, "1")); err == nil {
+					t.Fatal("presign of deleted keyshare should not exist")
+				}
+				if err := store.Delete(ecdsaPublicKey); err == nil {
+					t.Fatal("deleting a missing keyshare should fail")
+				}
+				value, err := store.GetLocalState(eddsaPublicKey)
+				if err != nil || value != "eddsa keyshare" {
+					t.Fatalf("expected eddsa keyshare, got %s, %v", value, err)
+				}
+				value, err = newStore("second").GetLocalState(ecdsaPublicKey)
+				if err != nil || value != "keyshare of second" {
+					t.Fatalf("expected keyshare of second, got %s, %v", value, err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// KeysignRequest is one message hash to sign in a batch keysign
+type KeysignRequest struct {
+	MessageHash string `json:"message_hash"`
+	DerivePath  string `json:"derive_path"`
+}
+
+// LoadKeysignRequests reads a json array of KeysignRequest from file
+func LoadKeysignRequests(file string) ([]KeysignRequest, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read file %s: %w", file, err)
+	}
+	var requests []KeysignRequest
+	if err := json.Unmarshal(buf, &requests); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal keysign requests: %w", err)
+	}
+	return requests, nil
+}
+
+// batchSubSessionID is the session id the messages of the sign session at index are tagged with
+func batchSubSessionID(sessionID string, index int) string {
+	return sessionID + "-" + strconv.Itoa(index)
+}
+
+// KeysignBatch signs all the message hashes in one relay session, every hash gets its own sign session and the
+// sessions run concurrently. The leader uploads all the setup messages as one json array.
+func (t *TssService) KeysignBatch(ctx context.Context,
+	sessionID string,
+	publicKey string,
+	requests []KeysignRequest,
+	localPartyID string,
+	keysignCommittee []string,
+	isInitiateDevice bool) ([]*KeysignResult, error) {
+	if publicKey == "" {
+		return nil, fmt.Errorf("public key is empty")
+	}
+	if len(requests) == 0 {
+		return nil, fmt.Errorf("no message to sign")
+	}
+	if localPartyID == "" {
+		return nil, fmt.Errorf("local party id is empty")
+	}
+	if len(keysignCommittee) == 0 {
+		return nil, fmt.Errorf("keysign committee is empty")
+	}
+	msgHashes, err := decodeKeysignRequests(requests)
+	if err != nil {
+		return nil, err
+	}
+	for i, request := range requests {
+		if err := t.checkDerivePath(request.DerivePath); err != nil {
+			return nil, fmt.Errorf("message %d: %w", i, err)
+		}
+	}
+	mpcWrapper := t.GetMPCKeygenWrapper()
+	t.logger.WithFields(logrus.Fields{
+		"session_id":         sessionID,
+		"public_key":         publicKey,
+		"messages":           len(requests),
+		"local_party_id":     localPartyID,
+		"keysign_committee":  keysignCommittee,
+		"is_initiate_device": isInitiateDevice,
+	}).Info("Keysign batch")
+
+	joinCtx, cancelJoin := withTimeout(ctx, t.timeouts.Join)
+	defer cancelJoin()
+	session, err := t.beginSession(OperationKeysignBatch, sessionID, localPartyID, keysignCommittee)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin session: %w", err)
+	}
+	defer t.endSession(session)
+	if err := t.transport.RegisterSession(joinCtx, sessionID, localPartyID); err != nil {
+		return nil, fmt.Errorf("failed to register session: %w", err)
+	}
+	keyshare, err := t.localStateAccessor.GetLocalState(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get keyshare: %w", err)
+	}
+	keyshareBytes, err := base64.StdEncoding.DecodeString(keyshare)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode keyshare: %w", err)
+	}
+	keyshareHandle, err := mpcWrapper.KeyshareFromBytes(keyshareBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create keyshare from bytes: %w", err)
+	}
+	defer func() {
+		if err := mpcWrapper.KeyshareFree(keyshareHandle); err != nil {
+			t.logger.Error("failed to free keyshare", "error", err)
+		}
+	}()
+	var encodedSetupMsgs []string
+	if isInitiateDevice {
+		if err := t.transport.WaitAllParties(joinCtx, sessionID, keysignCommittee); err != nil {
+			return nil, fmt.Errorf("failed to wait for all parties to join: %w", err)
+		}
+		keyID, err := mpcWrapper.KeyshareKeyID(keyshareHandle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get key id: %w", err)
+		}
+		keysignCommitteeBytes, err := t.convertKeygenCommitteeToBytes(keysignCommittee)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get keysign committee: %w", err)
+		}
+		for i, request := range requests {
+			setupMsg, err := mpcWrapper.SignSetupMsgNew(keyID, []byte(request.DerivePath), msgHashes[i], keysignCommitteeBytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create setup message %d: %w", i, err)
+			}
+			encodedSetupMsgs = append(encodedSetupMsgs, base64.StdEncoding.EncodeToString(setupMsg))
+		}
+		payload, err := json.Marshal(encodedSetupMsgs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal setup messages: %w", err)
+		}
+		setupCtx, cancelSetup := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelSetup()
+		if err := t.transport.UploadPayload(setupCtx, sessionID, string(payload)); err != nil {
+			return nil, fmt.Errorf("failed to upload setup messages: %w", err)
+		}
+		if err := t.transport.StartSession(setupCtx, sessionID, keysignCommittee); err != nil {
+			return nil, fmt.Errorf("failed to start session: %w", err)
+		}
+	} else {
+		if _, err := t.transport.WaitForSessionStart(joinCtx, sessionID); err != nil {
+			return nil, fmt.Errorf("failed to wait for session to start: %w", err)
+		}
+		setupCtx, cancelSetup := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelSetup()
+		payload, err := t.transport.GetPayload(setupCtx, sessionID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get setup messages: %w", err)
+		}
+		if err := json.Unmarshal([]byte(payload), &encodedSetupMsgs); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal setup messages: %w", err)
+		}
+	}
+	if len(encodedSetupMsgs) != len(requests) {
+		return nil, fmt.Errorf("expect %d setup messages, got %d", len(requests), len(encodedSetupMsgs))
+	}
+	handles := make([]Handle, 0, len(requests))
+	defer func() {
+		for _, handle := range handles {
+			if err := mpcWrapper.SignSessionFree(handle); err != nil {
+				t.logger.Error("failed to free keysign session", "error", err)
+			}
+		}
+	}()
+	for i, encodedSetupMsg := range encodedSetupMsgs {
+		setupMessageBytes, err := base64.StdEncoding.DecodeString(encodedSetupMsg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode setup message %d: %w", i, err)
+		}
+		messageHashInSetupMsg, err := mpcWrapper.DecodeMessage(setupMessageBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode message %d: %w", i, err)
+		}
+		if !bytes.Equal(messageHashInSetupMsg, msgHashes[i]) {
+			return nil, fmt.Errorf("message hash in setup message %d is not equal to the message, stop keysign", i)
+		}
+		handle, err := mpcWrapper.SignSessionFromSetup(setupMessageBytes, []byte(t.partyName(localPartyID)), keyshareHandle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create session %d from setup message: %w", i, err)
+		}
+		handles = append(handles, handle)
+	}
+
+	finished := make([]*atomic.Bool, len(handles))
+	protocolCtx, cancelProtocol := withTimeout(ctx, t.timeouts.Protocol)
+	defer cancelProtocol()
+	// the protocol stalls on a message that can't be delivered, so a failed outbound aborts it
+	protocolCtx, abortProtocol := context.WithCancelCause(protocolCtx)
+	defer abortProtocol(nil)
+	go t.watchParties(protocolCtx, abortProtocol, sessionID, localPartyID, keysignCommittee)
+	wg := &sync.WaitGroup{}
+	for i, handle := range handles {
+		finished[i] = &atomic.Bool{}
+		wg.Add(1)
+		go func(index int, handle Handle) {
+			defer wg.Done()
+			if err := t.processBatchKeysignOutbound(protocolCtx, handle, sessionID, batchSubSessionID(sessionID, index), keysignCommittee, localPartyID, finished[index]); err != nil {
+				t.logger.Error("failed to process keysign outbound", "error", err)
+				abortProtocol(err)
+			}
+		}(i, handle)
+	}
+	sigs, err := t.processBatchKeysignInbound(protocolCtx, handles, sessionID, localPartyID, keysignCommittee, finished)
+	wg.Wait()
+	if err != nil {
+		return nil, fmt.Errorf("failed to process keysign inbound: %w", err)
+	}
+
+	return t.batchKeysignResults(publicKey, requests, msgHashes, sigs, func(derivePath string) ([]byte, error) {
+		return mpcWrapper.KeyshareDeriveChildPublicKey(keyshareHandle, []byte(derivePath))
+	})
+}
+
+// decodeKeysignRequests checks the requests and returns their message hashes, in the order of the requests
+func decodeKeysignRequests(requests []KeysignRequest) ([][]byte, error) {
+	msgHashes := make([][]byte, len(requests))
+	for i, request := range requests {
+		if request.DerivePath == "" {
+			return nil, fmt.Errorf("derive path of message %d is empty", i)
+		}
+		msgHash, err := hex.DecodeString(request.MessageHash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode message hash %d: %w", i, err)
+		}
+		if len(msgHash) != 32 {
+			return nil, fmt.Errorf("message hash %d should be 32 bytes, got %d", i, len(msgHash))
+		}
+		msgHashes[i] = msgHash
+	}
+	return msgHashes, nil
+}
+
+// batchKeysignResults builds the result of every message, in the order of the requests. childPublicKey returns
+// the ECDSA public key of a derive path. A signature that doesn't verify doesn't drop the other results, the
+// error names the messages that failed.
+func (t *TssService) batchKeysignResults(publicKey string,
+	requests []KeysignRequest,
+	msgHashes [][]byte,
+	sigs [][]byte,
+	childPublicKey func(derivePath string) ([]byte, error)) ([]*KeysignResult, error) {
+	results := make([]*KeysignResult, len(requests))
+	var verifyErr error
+	for i, request := range requests {
+		var pubKeyBytes []byte
+		var err error
+		derivePath := request.DerivePath
+		if t.isEdDSA {
+			pubKeyBytes, err = hex.DecodeString(publicKey)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode public key: %w", err)
+			}
+			if err := t.checkDerivePath(derivePath); err != nil {
+				return nil, fmt.Errorf("message %d: %w", i, err)
+			}
+		} else {
+			pubKeyBytes, err = childPublicKey(derivePath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to derive child public key of message %d: %w", i, err)
+			}
+		}
+		result, err := NewKeysignResult(msgHashes[i], derivePath, pubKeyBytes, sigs[i], t.isEdDSA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get keysign result of message %d: %w", i, err)
+		}
+		if err := result.Verify(); err != nil {
+			t.logger.Errorf("Signature of message %d is invalid", i)
+			verifyErr = errors.Join(verifyErr, fmt.Errorf("message %d: %w", i, err))
+		}
+		results[i] = result
+	}
+	return results, verifyErr
+}
+
+func (t *TssService) processBatchKeysignOutbound(ctx context.Context,
+	handle Handle,
+	sessionID string,
+	subSessionID string,
+	parties []string,
+	localPartyID string,
+	finished *atomic.Bool) error {
+	messenger := t.newMessenger(sessionID)
+	mpcWrapper := t.GetMPCKeygenWrapper()
+	for {
+		outbound, err := mpcWrapper.SignSessionOutputMessage(handle)
+		if err != nil {
+			t.logger.Error("failed to get output message", "error", err)
+		}
+		if len(outbound) == 0 {
+			if finished.Load() {
+				return nil
+			}
+			time.Sleep(time.Millisecond * 100)
+			continue
+		}
+		encodedOutbound := base64.StdEncoding.EncodeToString(outbound)
+		for i := 0; i < len(parties); i++ {
+			receiver, err := mpcWrapper.SignSessionMessageReceiver(handle, outbound, i)
+			if err != nil {
+				t.logger.Error("failed to get receiver message", "error", err)
+			}
+			if len(receiver) == 0 {
+				break
+			}
+			t.logger.Infoln("Sending message of", subSessionID, "to", string(receiver))
+			if err := messenger.SendWithSessionID(ctx, subSessionID, localPartyID, t.relayPartyID(string(receiver)), encodedOutbound); err != nil {
+				return fmt.Errorf("failed to send message to %s: %w", receiver, err)
+			}
+		}
+	}
+}
+
+// processBatchKeysignInbound polls the relay session once for all the sign sessions, and dispatches the messages
+// by the session id they are tagged with. It returns the signatures in the order of the handles.
+func (t *TssService) processBatchKeysignInbound(ctx context.Context,
+	handles []Handle,
+	sessionID string,
+	localPartyID string,
+	parties []string,
+	finished []*atomic.Bool) ([][]byte, error) {
+	stopAll := func() {
+		for _, item := range finished {
+			item.Store(true)
+		}
+	}
+	subSessions := make(map[string]int, len(handles))
+	subSessionIDs := make([]string, len(handles))
+	for i := range handles {
+		subSessionIDs[i] = batchSubSessionID(sessionID, i)
+		subSessions[subSessionIDs[i]] = i
+	}
+	sigs := make([][]byte, len(handles))
+	remaining := len(handles)
+	tracker := newInboundTracker(localPartyID, t.logger)
+	rejected := make(map[string]bool)
+	inbound := t.transport.Receive(ctx, sessionID, localPartyID)
+	defer inbound.Close()
+	mpcWrapper := t.GetMPCKeygenWrapper()
+	for {
+		select {
+		case <-ctx.Done():
+			stopAll()
+			return nil, protocolError(ctx, ErrKeysignTimeout, tracker, subSessionIDs, parties)
+		case messages := <-inbound.Messages():
+			for _, message := range messages {
+				decodedBody, ok := t.acceptMessage(sessionID, localPartyID, message, inbound, tracker, rejected)
+				if !ok {
+					continue
+				}
+				index, ok := subSessions[message.SessionID]
+				if !ok {
+					t.logger.Error("message of unknown session", "session_id", message.SessionID)
+					continue
+				}
+				if finished[index].Load() {
+					continue
+				}
+				t.logger.Infoln("Received message of", message.SessionID, "from", message.From)
+				isFinished, err := mpcWrapper.SignSessionInputMessage(handles[index], decodedBody)
+				if err != nil {
+					t.logger.Error("fail to apply input message", "error", err)
+					continue
+				}
+				if isFinished {
+					t.logger.Infoln("keysign of", message.SessionID, "finished")
+					sig, err := mpcWrapper.SignSessionFinish(handles[index])
+					if err != nil {
+						stopAll()
+						return nil, fmt.Errorf("fail to finish keysign of %s: %w", message.SessionID, err)
+					}
+					sigs[index] = sig
+					finished[index].Store(true)
+					remaining--
+					if remaining == 0 {
+						return sigs, nil
+					}
+				}
+			}
+		}
+	}
+}
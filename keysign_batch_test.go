@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/vultisig/test-dkls/relay"
+)
+
+func TestDecodeKeysignRequests(t *testing.T) {
+	first := SHA256HashBytes([]byte("first"))
+	second := SHA256HashBytes([]byte("second"))
+	msgHashes, err := decodeKeysignRequests([]KeysignRequest{
+		{MessageHash: hex.EncodeToString(first), DerivePath: "m/44'/60'/0'/0/0"},
+		{MessageHash: hex.EncodeToString(second), DerivePath: "m/44'/60'/0'/0/1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgHashes) != 2 || !bytes.Equal(msgHashes[0], first) || !bytes.Equal(msgHashes[1], second) {
+		t.Fatalf("message hashes are not in the order of the requests: %x", msgHashes)
+	}
+
+	for name, request := range map[string]KeysignRequest{
+		"empty derive path": {MessageHash: hex.EncodeToString(first)},
+		"invalid hex":       {MessageHash: "not hex", DerivePath: "m/0"},
+		"short hash":        {MessageHash: hex.EncodeToString(first[:16]), DerivePath: "m/0"},
+	} {
+		_, err := decodeKeysignRequests([]KeysignRequest{{MessageHash: hex.EncodeToString(first), DerivePath: "m/0"}, request})
+		if err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+		if !strings.Contains(err.Error(), " 1") {
+			t.Fatalf("%s: error should name message 1, got %v", name, err)
+		}
+	}
+}
+
+func TestKeysignBatchValidation(t *testing.T) {
+	tss, err := NewTssService(NewMemoryTransport(relay.NewServer()), newMemoryStateAccessor(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := KeysignRequest{MessageHash: hex.EncodeToString(SHA256HashBytes([]byte("hello"))), DerivePath: "m/0"}
+	for name, args := range map[string]struct {
+		publicKey string
+		requests  []KeysignRequest
+		party     string
+		committee []string
+	}{
+		"empty public key": {"", []KeysignRequest{request}, "first", []string{"first", "second"}},
+		"no message":       {"pub", nil, "first", []string{"first", "second"}},
+		"empty party":      {"pub", []KeysignRequest{request}, "", []string{"first", "second"}},
+		"empty committee":  {"pub", []KeysignRequest{request}, "first", nil},
+		"invalid request":  {"pub", []KeysignRequest{request, {MessageHash: "00", DerivePath: "m/0"}}, "first", []string{"first", "second"}},
+	} {
+		if _, err := tss.KeysignBatch(context.Background(), "session", args.publicKey, args.requests, args.party, args.committee, false); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestBatchKeysignResults(t *testing.T) {
+	tss, err := NewTssService(NewMemoryTransport(relay.NewServer()), newMemoryStateAccessor(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every derive path has its own key, like the child keys of the keyshare
+	privateKeys := make(map[string]*ecdsa.PrivateKey)
+	childPublicKey := func(derivePath string) ([]byte, error) {
+		key, ok := privateKeys[derivePath]
+		if !ok {
+			return nil, fmt.Errorf("unknown derive path %s", derivePath)
+		}
+		return crypto.CompressPubkey(&key.PublicKey), nil
+	}
+	var requests []KeysignRequest
+	var msgHashes, sigs [][]byte
+	for i := 0; i < 3; i++ {
+		derivePath := fmt.Sprintf("m/44'/60'/0'/0/%d", i)
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		privateKeys[derivePath] = key
+		msgHash := SHA256HashBytes([]byte(derivePath))
+		sig, err := crypto.Sign(msgHash, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests = append(requests, KeysignRequest{MessageHash: hex.EncodeToString(msgHash), DerivePath: derivePath})
+		msgHashes = append(msgHashes, msgHash)
+		sigs = append(sigs, sig)
+	}
+
+	results, err := tss.batchKeysignResults("", requests, msgHashes, sigs, childPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		publicKey, _ := childPublicKey(requests[i].DerivePath)
+		if result.MessageHash != requests[i].MessageHash || result.DerivePath != requests[i].DerivePath ||
+			result.PublicKey != hex.EncodeToString(publicKey) {
+			t.Fatalf("result %d doesn't belong to request %d: %+v", i, i, result)
+		}
+	}
+
+	// the signature of message 1 is the one of message 2, the other results are still returned
+	sigs[1] = sigs[2]
+	results, err = tss.batchKeysignResults("", requests, msgHashes, sigs, childPublicKey)
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected invalid signature, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "message 1") || strings.Contains(err.Error(), "message 0") || strings.Contains(err.Error(), "message 2") {
+		t.Fatalf("error should only name message 1, got %v", err)
+	}
+	if len(results) != 3 || results[0].Verify() != nil || results[2].Verify() != nil {
+		t.Fatal("the valid signatures should still be returned")
+	}
+}
+
+func TestBatchKeysignResultsEdDSA(t *testing.T) {
+	tss, err := NewTssService(NewMemoryTransport(relay.NewServer()), newMemoryStateAccessor(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgHash := SHA256HashBytes([]byte("hello"))
+	requests := []KeysignRequest{{MessageHash: hex.EncodeToString(msgHash), DerivePath: "m"}}
+	sigs := [][]byte{ed25519.Sign(privateKey, msgHash)}
+	results, err := tss.batchKeysignResults(hex.EncodeToString(publicKey), requests, [][]byte{msgHash}, sigs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].DerivePath != "m" || results[0].PublicKey != hex.EncodeToString(publicKey) {
+		t.Fatalf("EdDSA result should be the one of the root key, got %+v", results[0])
+	}
+
+	// the schnorr wrapper signs with the root key, a child key can't be claimed
+	requests[0].DerivePath = "m/44'/501'/0'/0'"
+	if _, err := tss.batchKeysignResults(hex.EncodeToString(publicKey), requests, [][]byte{msgHash}, sigs, nil); !errors.Is(err, ErrEdDSADerivePath) {
+		t.Fatalf("expected EdDSA derive path error, got %v", err)
+	}
+	if _, err := tss.KeysignBatch(context.Background(), "session", hex.EncodeToString(publicKey), requests, "first", []string{"first", "second"}, false); !errors.Is(err, ErrEdDSADerivePath) {
+		t.Fatalf("expected EdDSA derive path error, got %v", err)
+	}
+	if _, err := tss.Keysign(context.Background(), "session", hex.EncodeToString(publicKey), "hello", "", "", "m/0", "first", []string{"first", "second"}, false); !errors.Is(err, ErrEdDSADerivePath) {
+		t.Fatalf("expected EdDSA derive path error, got %v", err)
+	}
+}
+
+func TestLoadKeysignRequests(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "requests.json")
+	if err := os.WriteFile(file, []byte(`[{"message_hash":"aa","derive_path":"m/0"},{"message_hash":"bb","derive_path":"m/1"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	requests, err := LoadKeysignRequests(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 || requests[0].MessageHash != "aa" || requests[1].DerivePath != "m/1" {
+		t.Fatalf("unexpected requests %+v", requests)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+var ErrInvalidSignature = errors.New("signature is invalid")
+
+// KeysignResult is the machine-readable output of a keysign, all binary fields are hex encoded
+type KeysignResult struct {
+	MessageHash  string `json:"message_hash"`
+	DerivePath   string `json:"derive_path"`
+	PublicKey    string `json:"public_key"`
+	Signature    string `json:"signature"`
+	R            string `json:"r"`
+	S            string `json:"s"`
+	RecoveryID   *byte  `json:"recovery_id,omitempty"`
+	DerSignature string `json:"der_signature,omitempty"`
+	IsEdDSA      bool   `json:"is_eddsa"`
+}
+
+// NewKeysignResult builds the keysign result from the raw signature returned by the MPC library,
+// ECDSA signature is r || s || recovery id, EdDSA signature is R || s
+func NewKeysignResult(msgHash []byte, derivePath string, publicKey []byte, sig []byte, isEdDSA bool) (*KeysignResult, error) {
+	result := &KeysignResult{
+		MessageHash: hex.EncodeToString(msgHash),
+		DerivePath:  derivePath,
+		PublicKey:   hex.EncodeToString(publicKey),
+		Signature:   hex.EncodeToString(sig),
+		IsEdDSA:     isEdDSA,
+	}
+	if isEdDSA {
+		if len(sig) != ed25519.SignatureSize {
+			return nil, fmt.Errorf("signature length is not %d", ed25519.SignatureSize)
+		}
+		result.R = hex.EncodeToString(sig[:32])
+		result.S = hex.EncodeToString(sig[32:])
+		return result, nil
+	}
+	if len(sig) != 65 {
+		return nil, fmt.Errorf("signature length is not 65")
+	}
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:64])
+	derSignature, err := asn1.Marshal(struct {
+		R *big.Int
+		S *big.Int
+	}{R: r, S: s})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode signature to DER: %w", err)
+	}
+	recoveryID := sig[64]
+	result.R = hex.EncodeToString(sig[:32])
+	result.S = hex.EncodeToString(sig[32:64])
+	result.RecoveryID = &recoveryID
+	result.DerSignature = hex.EncodeToString(derSignature)
+	return result, nil
+}
+
+// Verify checks the signature against the public key and message hash of the result
+func (r *KeysignResult) Verify() error {
+	msgHash, err := hex.DecodeString(r.MessageHash)
+	if err != nil {
+		return fmt.Errorf("failed to decode message hash: %w", err)
+	}
+	pubKeyBytes, err := hex.DecodeString(r.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to decode public key: %w", err)
+	}
+	sig, err := hex.DecodeString(r.Signature)
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %w", err)
+	}
+	if r.IsEdDSA {
+		if len(pubKeyBytes) != ed25519.PublicKeySize {
+			return fmt.Errorf("public key length is not %d", ed25519.PublicKeySize)
+		}
+		if !ed25519.Verify(pubKeyBytes, msgHash, sig) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	publicKey, err := secp256k1.ParsePubKey(pubKeyBytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse public key: %w", err)
+	}
+	if !ecdsa.Verify(publicKey.ToECDSA(), msgHash, new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:64])) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// WriteJSON writes the result to the given file, or to stdout when file is empty
+func (r *KeysignResult) WriteJSON(file string) error {
+	return writeJSON(r, file)
+}
+
+func writeJSON(v any, file string) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal result: %w", err)
+	}
+	if file == "" {
+		fmt.Println(string(buf))
+		return nil
+	}
+	if err := os.WriteFile(file, buf, 0644); err != nil {
+		return fmt.Errorf("failed to write result to %s: %w", file, err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestKeysignResultVerify(t *testing.T) {
+	msgHash := SHA256HashBytes([]byte("hello"))
+
+	privateKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := crypto.Sign(msgHash, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := NewKeysignResult(msgHash, "m/44'/60'/0'/0/0", crypto.CompressPubkey(&privateKey.PublicKey), sig, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := result.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if result.RecoveryID == nil || *result.RecoveryID != sig[64] {
+		t.Fatal("recovery id is not set")
+	}
+	if result.DerSignature == "" {
+		t.Fatal("der signature is not set")
+	}
+	otherHash := SHA256HashBytes([]byte("world"))
+	result, err = NewKeysignResult(otherHash, "m/44'/60'/0'/0/0", crypto.CompressPubkey(&privateKey.PublicKey), sig, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := result.Verify(); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected invalid signature, got %v", err)
+	}
+
+	publicKey, edPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = NewKeysignResult(msgHash, "m/0", publicKey, ed25519.Sign(edPrivateKey, msgHash), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := result.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if result.RecoveryID != nil || result.DerSignature != "" {
+		t.Fatal("EdDSA result should not have recovery id or DER signature")
+	}
+}
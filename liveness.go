@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrPartyUnresponsive aborts a protocol when a party of the committee stops sending heartbeats
+type ErrPartyUnresponsive struct {
+	Party string
+	// Silence is how long the party has not sent a heartbeat
+	Silence time.Duration
+}
+
+func (e *ErrPartyUnresponsive) Error() string {
+	return fmt.Sprintf("party %s is unresponsive, no heartbeat for %v", e.Party, e.Silence.Round(time.Second))
+}
+
+// UndeliveredRounds are the rounds a party didn't deliver to the local party in a session. A round is the
+// sequence number of the messages, the n-th message from a party belongs to its n-th round.
+type UndeliveredRounds struct {
+	SessionID string  `json:"session_id"`
+	Party     string  `json:"party"`
+	Rounds    []int64 `json:"rounds"`
+}
+
+// ErrProtocolAbort is returned when a protocol stops before it's finished, it tells the round it stopped at
+// and the rounds each party never delivered
+type ErrProtocolAbort struct {
+	// Round is the first round not delivered by every party
+	Round       int64
+	Reason      string
+	Undelivered []UndeliveredRounds
+	// Err is why the protocol stopped, a timeout of the operation, ErrPartyUnresponsive, or the error of ctx
+	Err error
+}
+
+func (e *ErrProtocolAbort) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "protocol aborted at round %d: %s", e.Round, e.Reason)
+	for _, undelivered := range e.Undelivered {
+		fmt.Fprintf(&sb, ", %s never delivered rounds %v", undelivered.Party, undelivered.Rounds)
+	}
+	return sb.String()
+}
+
+func (e *ErrProtocolAbort) Unwrap() error {
+	return e.Err
+}
+
+// protocolError is what the inbound loops return once ctx is done, it says why the protocol stopped, timeoutErr
+// when it ran out of time, and which of the parties held it up according to tracker
+func protocolError(ctx context.Context, timeoutErr error, tracker *inboundTracker, sessionIDs []string, parties []string) error {
+	err := ctx.Err()
+	if cause := context.Cause(ctx); cause != nil && cause != err {
+		err = cause
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		err = timeoutErr
+	}
+	round, undelivered := tracker.Undelivered(sessionIDs, parties)
+	return &ErrProtocolAbort{
+		Round:       round,
+		Reason:      err.Error(),
+		Undelivered: undelivered,
+		Err:         err,
+	}
+}
+
+// watchParties sends the heartbeats of the local party until ctx is done. It aborts the protocol with
+// ErrPartyUnresponsive once another party of the committee doesn't send any for the liveness timeout.
+func (t *TssService) watchParties(ctx context.Context, abort context.CancelCauseFunc, sessionID string, localPartyID string, parties []string) {
+	liveness := t.timeouts.Liveness
+	if liveness <= 0 {
+		return
+	}
+	start := time.Now()
+	ticker := time.NewTicker(max(liveness/5, 100*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		if err := t.transport.Heartbeat(ctx, sessionID, localPartyID); err != nil {
+			if errors.Is(err, errHeartbeatNotSupported) {
+				t.logger.Warn("relay doesn't support heartbeats, unresponsive parties are not detected")
+				return
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			t.logger.Error("fail to send heartbeat", "error", err)
+		}
+		heartbeats, err := t.transport.Heartbeats(ctx, sessionID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			t.logger.Error("fail to get heartbeats", "error", err)
+		}
+		// a party gets the liveness timeout from the moment the local party started watching
+		for _, party := range parties {
+			if party == localPartyID || err != nil {
+				continue
+			}
+			silence, ok := heartbeats[party]
+			if !ok || silence > time.Since(start) {
+				silence = time.Since(start)
+			}
+			if silence > liveness {
+				abort(&ErrPartyUnresponsive{Party: party, Silence: silence})
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
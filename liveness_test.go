@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vultisig/test-dkls/relay"
+)
+
+func TestProtocolError(t *testing.T) {
+	parties := []string{"first", "second", "third"}
+	tracker := newInboundTracker("second", logrus.StandardLogger())
+	for _, message := range []relay.Message{
+		newEnvelope("session", "first", 1, "round 1"),
+		newEnvelope("session", "first", 2, "round 2"),
+		newEnvelope("session", "third", 1, "round 1"),
+	} {
+		tracker.Track(message)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+	err := protocolError(ctx, ErrKeysignTimeout, tracker, []string{"session"}, parties)
+	if !errors.Is(err, ErrKeysignTimeout) {
+		t.Fatalf("expected keysign timeout, got %v", err)
+	}
+	var abortErr *ErrProtocolAbort
+	if !errors.As(err, &abortErr) {
+		t.Fatalf("expected protocol abort, got %v", err)
+	}
+	if abortErr.Round != 2 || len(abortErr.Undelivered) != 1 {
+		t.Fatalf("unexpected abort: %+v", abortErr)
+	}
+	if undelivered := abortErr.Undelivered[0]; undelivered.Party != "third" || len(undelivered.Rounds) != 1 || undelivered.Rounds[0] != 2 {
+		t.Fatalf("expected third to miss round 2, got %+v", undelivered)
+	}
+
+	ctx, abort := context.WithCancelCause(context.Background())
+	abort(&ErrPartyUnresponsive{Party: "third"})
+	var unresponsive *ErrPartyUnresponsive
+	if err := protocolError(ctx, ErrKeysignTimeout, tracker, []string{"session"}, parties); !errors.As(err, &unresponsive) || unresponsive.Party != "third" {
+		t.Fatalf("expected third to be unresponsive, got %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := protocolError(ctx, ErrKeysignTimeout, tracker, []string{"session"}, parties); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+}
+
+func TestWatchParties(t *testing.T) {
+	relayServer := relay.NewServer()
+	sessionID := "test-session"
+	relayServer.Register(sessionID, []string{"first", "second", "third"})
+	tss, err := NewTssService(NewMemoryTransport(relayServer), newMemoryStateAccessor(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tss.SetTimeouts(Timeouts{Liveness: 300 * time.Millisecond})
+
+	ctx, abort := context.WithCancelCause(context.Background())
+	defer abort(nil)
+	// first stays alive, third never sends a heartbeat
+	go func() {
+		for ctx.Err() == nil {
+			relayServer.Heartbeat(sessionID, []string{"first"})
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	go tss.watchParties(ctx, abort, sessionID, "second", []string{"first", "second", "third"})
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("unresponsive party is not detected")
+	}
+	var unresponsive *ErrPartyUnresponsive
+	if !errors.As(context.Cause(ctx), &unresponsive) || unresponsive.Party != "third" {
+		t.Fatalf("expected third to be unresponsive, got %v", context.Cause(ctx))
+	}
+	heartbeats, ok := relayServer.Heartbeats(sessionID)
+	if !ok || heartbeats["second"] > time.Second {
+		t.Fatalf("local party should send heartbeats, got %v", heartbeats)
+	}
+}
+
+func TestHTTPHeartbeats(t *testing.T) {
+	server := httptest.NewServer(relay.NewServer())
+	defer server.Close()
+	ctx := context.Background()
+	if err := newHTTPTransport(t, server.URL).RegisterSession(ctx, "test-session", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := newHTTPTransport(t, server.URL).Heartbeat(ctx, "test-session", "first"); err != nil {
+		t.Fatal(err)
+	}
+	heartbeats, err := newHTTPTransport(t, server.URL).Heartbeats(ctx, "test-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if age, ok := heartbeats["first"]; !ok || age > time.Second {
+		t.Fatalf("expected a recent heartbeat of first, got %v", heartbeats)
+	}
+
+	// a relay without heartbeats
+	plainServer := httptest.NewServer(http.NotFoundHandler())
+	defer plainServer.Close()
+	if err := newHTTPTransport(t, plainServer.URL).Heartbeat(ctx, "test-session", "first"); !errors.Is(err, errHeartbeatNotSupported) {
+		t.Fatalf("expected heartbeats not supported, got %v", err)
+	}
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
 type LocalStateAccessor interface {
@@ -11,17 +16,48 @@ type LocalStateAccessor interface {
 }
 
 type LocalStateAccessorImp struct {
+	dir          string
 	localPartyID string
+	shareCipher  *ShareCipher
 }
 
+var _ KeyshareStore = &LocalStateAccessorImp{}
+
 func NewLocalStateAccessorImp(localPartyID string) *LocalStateAccessorImp {
 	return &LocalStateAccessorImp{
 		localPartyID: localPartyID,
 	}
 }
 
+// NewEncryptedLocalStateAccessor creates a local state accessor that seals the keyshares with shareCipher,
+// it behaves like NewLocalStateAccessorImp when shareCipher is nil
+func NewEncryptedLocalStateAccessor(localPartyID string, shareCipher *ShareCipher) *LocalStateAccessorImp {
+	return &LocalStateAccessorImp{
+		localPartyID: localPartyID,
+		shareCipher:  shareCipher,
+	}
+}
+
+// NewDirectoryStateAccessor creates a local state accessor keeping the keyshares in dir instead of the
+// current directory
+func NewDirectoryStateAccessor(dir string, localPartyID string, shareCipher *ShareCipher) *LocalStateAccessorImp {
+	return &LocalStateAccessorImp{
+		dir:          dir,
+		localPartyID: localPartyID,
+		shareCipher:  shareCipher,
+	}
+}
+
+func (l *LocalStateAccessorImp) fileName(pubKey string) string {
+	return filepath.Join(l.dir, pubKey+"-"+l.localPartyID+".json")
+}
+
+func (l *LocalStateAccessorImp) metadataFileName(pubKey string) string {
+	return filepath.Join(l.dir, pubKey+"-"+l.localPartyID+".meta.json")
+}
+
 func (l *LocalStateAccessorImp) GetLocalState(pubKey string) (string, error) {
-	fileName := pubKey + "-" + l.localPartyID + ".json"
+	fileName := l.fileName(pubKey)
 	if _, err := os.Stat(fileName); os.IsNotExist(err) {
 		return "", fmt.Errorf("file %s does not exist", pubKey)
 	}
@@ -29,10 +65,126 @@ func (l *LocalStateAccessorImp) GetLocalState(pubKey string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("fail to read file %s: %w", fileName, err)
 	}
-	return string(buf), nil
+	if l.shareCipher == nil {
+		if _, ok := parseEncryptedShare(buf); ok {
+			return "", fmt.Errorf("file %s is encrypted, passphrase file or key file is required", fileName)
+		}
+		return string(buf), nil
+	}
+	// the file name without the directory, so the store can be moved
+	plaintext, err := l.shareCipher.Open([]byte(filepath.Base(fileName)), buf)
+	if err != nil {
+		return "", fmt.Errorf("fail to decrypt file %s: %w", fileName, err)
+	}
+	return string(plaintext), nil
 }
 
 func (l *LocalStateAccessorImp) SaveLocalState(pubKey, localState string) error {
-	fileName := pubKey + "-" + l.localPartyID + ".json"
-	return os.WriteFile(fileName, []byte(localState), 0644)
+	fileName := l.fileName(pubKey)
+	buf := []byte(localState)
+	if l.shareCipher != nil {
+		sealed, err := l.shareCipher.Seal([]byte(filepath.Base(fileName)), buf)
+		if err != nil {
+			return fmt.Errorf("fail to encrypt file %s: %w", fileName, err)
+		}
+		buf = sealed
+	}
+	return writeFileAtomic(fileName, buf, 0600)
+}
+
+func (l *LocalStateAccessorImp) loadMetadata(pubKey string) (*KeyshareMetadata, error) {
+	fileName := l.metadataFileName(pubKey)
+	buf, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fail to read file %s: %w", fileName, err)
+	}
+	var metadata KeyshareMetadata
+	if err := json.Unmarshal(buf, &metadata); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal file %s: %w", fileName, err)
+	}
+	return &metadata, nil
+}
+
+func (l *LocalStateAccessorImp) SaveMetadata(metadata KeyshareMetadata) error {
+	previous, err := l.loadMetadata(metadata.PublicKey)
+	if err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(updateMetadata(previous, metadata), "", "  ")
+	if err != nil {
+		return fmt.Errorf("fail to marshal metadata: %w", err)
+	}
+	return writeFileAtomic(l.metadataFileName(metadata.PublicKey), buf, 0600)
+}
+
+// List finds the keyshare files of local party in the directory, chain code, pending and metadata files are skipped
+func (l *LocalStateAccessorImp) List() ([]KeyshareMetadata, error) {
+	suffix := "-" + l.localPartyID + ".json"
+	dir := l.dir
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read directory %s: %w", dir, err)
+	}
+	var result []KeyshareMetadata
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), suffix) {
+			continue
+		}
+		pubKey := strings.TrimSuffix(entry.Name(), suffix)
+		if _, err := hex.DecodeString(pubKey); err != nil {
+			continue
+		}
+		curve, err := curveOfPublicKey(pubKey)
+		if err != nil {
+			continue
+		}
+		metadata, err := l.loadMetadata(pubKey)
+		if err != nil {
+			return nil, err
+		}
+		if metadata == nil {
+			metadata = &KeyshareMetadata{
+				PublicKey:    pubKey,
+				Curve:        curve,
+				LocalPartyID: l.localPartyID,
+			}
+		}
+		result = append(result, *metadata)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].PublicKey < result[j].PublicKey
+	})
+	return result, nil
+}
+
+func (l *LocalStateAccessorImp) Delete(pubKey string) error {
+	if _, err := os.Stat(l.fileName(pubKey)); os.IsNotExist(err) {
+		return fmt.Errorf("file %s does not exist", pubKey)
+	}
+	fileNames := []string{l.fileName(pubKey), l.fileName(chainCodeKey(pubKey)), l.fileName(pendingKeyshareKey(pubKey)), l.metadataFileName(pubKey)}
+	dir := l.dir
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("fail to read directory %s: %w", dir, err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), presignKey(pubKey, "")) && strings.HasSuffix(entry.Name(), "-"+l.localPartyID+".json") {
+			fileNames = append(fileNames, filepath.Join(l.dir, entry.Name()))
+		}
+	}
+	for _, fileName := range fileNames {
+		if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("fail to remove file %s: %w", fileName, err)
+		}
+	}
+	return nil
 }
@@ -1,9 +1,19 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+
+	"github.com/vultisig/test-dkls/relay"
 )
 
 func main() {
@@ -40,6 +50,78 @@ func main() {
 				HasBeenSet: false,
 				Hidden:     false,
 			},
+			&cli.StringFlag{
+				Name:  "encryption-key",
+				Usage: "hex encoded 32 bytes key shared by all parties to encrypt the messages sent through the relay",
+			},
+			&cli.StringFlag{
+				Name:  "identity-key",
+				Usage: "file holding the hex encoded ed25519 seed used to sign the messages of local party",
+			},
+			&cli.StringSliceFlag{
+				Name:  "party-keys",
+				Usage: "comma separated list of party=hex encoded ed25519 public key, used to verify the messages of each party",
+			},
+			&cli.StringFlag{
+				Name:  "passphrase-file",
+				Usage: "file holding the passphrase to encrypt the keyshares at rest",
+			},
+			&cli.StringFlag{
+				Name:  "share-key-file",
+				Usage: "file holding the hex encoded 32 bytes key to encrypt the keyshares at rest, instead of a passphrase",
+			},
+			&cli.StringFlag{
+				Name:  "store",
+				Usage: "where the keyshares are stored, dir://<directory> or bolt://<database file>, default to the current directory",
+			},
+			&cli.StringFlag{
+				Name:  "vault",
+				Usage: "vault file holding the ECDSA and EdDSA keyshares of local party, instead of one file per keyshare",
+			},
+			&cli.StringFlag{
+				Name:  "inbound",
+				Usage: "how to receive messages from the relay, stream or poll, stream falls back to poll when the relay doesn't support it",
+				Value: InboundStream,
+			},
+			&cli.DurationFlag{
+				Name:  "join-timeout",
+				Usage: "how long to wait for all parties to join the session and the leader to start it, 0 to wait forever",
+				Value: DefaultTimeouts().Join,
+			},
+			&cli.DurationFlag{
+				Name:  "setup-timeout",
+				Usage: "how long uploading or fetching the setup message may take, 0 to wait forever",
+				Value: DefaultTimeouts().Setup,
+			},
+			&cli.DurationFlag{
+				Name:  "protocol-timeout",
+				Usage: "how long the protocol may run after the session started, 0 to wait forever",
+				Value: DefaultTimeouts().Protocol,
+			},
+			&cli.DurationFlag{
+				Name:  "liveness-timeout",
+				Usage: "how long a party may not send heartbeats during the protocol before the ceremony is aborted, 0 to not watch the parties",
+				Value: DefaultTimeouts().Liveness,
+			},
+			&cli.DurationFlag{
+				Name:  "complete-timeout",
+				Usage: "how long to wait for the other parties to finish a refresh before the new keyshare is left pending for refresh-commit, 0 to wait until interrupted",
+				Value: DefaultTimeouts().Complete,
+			},
+			&cli.IntFlag{
+				Name:  "relay-retries",
+				Usage: "how many times a failed request to the relay is sent, including the first time",
+				Value: DefaultRetryPolicy().MaxAttempts,
+			},
+			&cli.DurationFlag{
+				Name:  "relay-retry-budget",
+				Usage: "how long a request to the relay may be retried, 0 to retry until relay-retries is reached",
+				Value: DefaultRetryPolicy().Budget,
+			},
+			&cli.StringFlag{
+				Name:  "session-dir",
+				Usage: "directory to record the running sessions in, so a party restarted in the middle of a session fails fast instead of rejoining it, the session can't be resumed and has to be started again, empty to not record",
+			},
 			&cli.BoolFlag{
 				Name:       "leader",
 				Usage:      "leader will make sure all parties present , and kick off the process(keygen/reshare/keysign)",
@@ -56,8 +138,8 @@ func main() {
 					&cli.StringFlag{
 						Name:       "chaincode",
 						Aliases:    []string{"cc"},
-						Usage:      "hex encoded chain code",
-						Required:   true,
+						Usage:      "hex encoded chain code, not used with --both, the EdDSA key takes the chain code of the ECDSA keyshare",
+						Required:   false,
 						HasBeenSet: false,
 						Hidden:     false,
 					},
@@ -68,6 +150,16 @@ func main() {
 						HasBeenSet: false,
 						Value:      false,
 					},
+					&cli.BoolFlag{
+						Name:  "both",
+						Usage: "generate the ECDSA and the EdDSA key in one run, saved together in the vault file",
+						Value: false,
+					},
+					&cli.IntFlag{
+						Name:  "threshold",
+						Usage: "number of parties required to sign, default to 2/3 of the committee",
+						Value: 0,
+					},
 				},
 				Action: keygenCmd,
 			},
@@ -96,6 +188,11 @@ func main() {
 						HasBeenSet: false,
 						Hidden:     false,
 					},
+					&cli.StringFlag{
+						Name:    "chaincode",
+						Aliases: []string{"cc"},
+						Usage:   "hex encoded chain code, needed by a party new to the committee of an EdDSA key",
+					},
 					&cli.StringSliceFlag{
 						Name:       "old-parties",
 						Usage:      "Old parties",
@@ -110,9 +207,58 @@ func main() {
 						HasBeenSet: false,
 						Value:      false,
 					},
+					&cli.IntFlag{
+						Name:  "threshold",
+						Usage: "number of parties required to sign, default to 2/3 of the committee",
+						Value: 0,
+					},
 				},
 				Action: reshareCmd,
 			},
+			{
+				Name:  "refresh",
+				Usage: "refresh the keyshares of the committee without changing the public key",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "pubkey",
+						Aliases:  []string{"pk"},
+						Usage:    "public key of the keyshare to refresh",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "eddsa",
+						Value: false,
+					},
+					&cli.IntFlag{
+						Name:  "threshold",
+						Usage: "number of parties required to sign, read from the keyshare metadata, only needed for a keyshare saved without it",
+						Value: 0,
+					},
+				},
+				Action: refreshCmd,
+			},
+			{
+				Name:  "refresh-commit",
+				Usage: "settle a refresh that didn't complete on every party, commit the pending keyshare once all the parties saved theirs",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "pubkey",
+						Aliases:  []string{"pk"},
+						Usage:    "public key of the refreshed keyshare",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "eddsa",
+						Value: false,
+					},
+					&cli.BoolFlag{
+						Name:  "rollback",
+						Usage: "drop the pending keyshare and keep the old one, when a party kept its old keyshare",
+						Value: false,
+					},
+				},
+				Action: refreshCommitCmd,
+			},
 			{
 				Name: "keysign",
 				Flags: []cli.Flag{
@@ -134,7 +280,7 @@ func main() {
 					},
 					&cli.StringFlag{
 						Name:     "derivepath",
-						Usage:    "derive path for bitcoin, e.g. m/84'/0'/0'/0/0",
+						Usage:    "derive path for bitcoin, e.g. m/84'/0'/0'/0/0, EdDSA only signs with m",
 						Required: true,
 					},
 					&cli.BoolFlag{
@@ -144,9 +290,71 @@ func main() {
 						HasBeenSet: false,
 						Value:      false,
 					},
+					&cli.StringFlag{
+						Name:  "hash",
+						Usage: "hash function applied to the message: sha256, sha256d, keccak256 or none for a pre-hashed digest",
+						Value: HashSHA256,
+					},
+					&cli.StringFlag{
+						Name:  "encoding",
+						Usage: "encoding of the message: utf8, hex or base64",
+						Value: EncodingUTF8,
+					},
+					&cli.StringFlag{
+						Name:  "out",
+						Usage: "file to write the keysign result json to, print to stdout if not set",
+					},
+					&cli.StringFlag{
+						Name:  "use-presign",
+						Usage: "id of a pre-signature made by presign, the signature is finished in one round and the pre-signature is deleted",
+					},
 				},
 				Action: keysignCmd,
 			},
+			{
+				Name:  "presign",
+				Usage: "make an ECDSA pre-signature ahead of the message, its id is the session id",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "pubkey",
+						Aliases:  []string{"pk"},
+						Usage:    "ECDSA pubkey the pre-signature is made with",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "derivepath",
+						Usage:    "derive path the pre-signature signs with, e.g. m/84'/0'/0'/0/0",
+						Required: true,
+					},
+				},
+				Action: presignCmd,
+			},
+			{
+				Name:  "keysign-batch",
+				Usage: "sign many message hashes in one session",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "pubkey",
+						Aliases:  []string{"pk"},
+						Usage:    "pubkey that will be used to do keysign",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "file",
+						Usage:    "json file with a list of {\"message_hash\": hex, \"derive_path\": path}",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "eddsa",
+						Value: false,
+					},
+					&cli.StringFlag{
+						Name:  "out",
+						Usage: "file to write the keysign results json to, print to stdout if not set",
+					},
+				},
+				Action: keysignBatchCmd,
+			},
 			{
 				Name: "migrate",
 				Flags: []cli.Flag{
@@ -164,9 +372,83 @@ func main() {
 						HasBeenSet: false,
 						Value:      false,
 					},
+					&cli.IntFlag{
+						Name:  "threshold",
+						Usage: "number of parties required to sign, default to 2/3 of the committee",
+						Value: 0,
+					},
 				},
 				Action: migrationCmd,
 			},
+			{
+				Name:  "derive",
+				Usage: "print the child public key and addresses of a keyshare",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "pubkey",
+						Aliases:  []string{"pk"},
+						Usage:    "public key of the keyshare",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "path",
+						Usage:    "derive path, e.g. m/84'/0'/0'/0/0, EdDSA only supports non-hardened path",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "eddsa",
+						Value: false,
+					},
+					&cli.BoolFlag{
+						Name:  "watch-only",
+						Usage: "derive a child EdDSA key the parties can't sign with, for watching addresses only",
+						Value: false,
+					},
+				},
+				Action: deriveCmd,
+			},
+			{
+				Name:   "list",
+				Usage:  "list the keyshares of local party in the store",
+				Action: listCmd,
+			},
+			{
+				Name:  "inspect",
+				Usage: "print the key id, public key, chain code and party info of a keyshare",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "pubkey",
+						Aliases:  []string{"pk"},
+						Usage:    "public key of the keyshare",
+						Required: true,
+					},
+				},
+				Action: inspectCmd,
+			},
+			{
+				Name:  "relay",
+				Usage: "run an in-memory relay server",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "listen",
+						Usage: "address the relay server listens on",
+						Value: "127.0.0.1:9090",
+					},
+				},
+				Action: relayCmd,
+			},
+			{
+				Name:  "identity",
+				Usage: "generate an ed25519 identity key for local party",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "out",
+						Usage:    "file to write the hex encoded seed to",
+						Required: true,
+					},
+				},
+				Action: identityCmd,
+			},
 		},
 		Before: func(c *cli.Context) error {
 			if c.Command.Name == "export" {
@@ -176,25 +458,105 @@ func main() {
 		},
 	}
 
-	if err := app.Run(os.Args); err != nil {
+	// interrupting the ceremony cancels it, the relay requests in flight and the inbound stream are closed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		// tell the operator who held up the ceremony
+		var abortErr *ErrProtocolAbort
+		if errors.As(err, &abortErr) {
+			for _, undelivered := range abortErr.Undelivered {
+				logrus.WithFields(logrus.Fields{
+					"session_id": undelivered.SessionID,
+					"party":      undelivered.Party,
+					"rounds":     undelivered.Rounds,
+				}).Error("party never delivered rounds")
+			}
+		}
 		panic(err)
 	}
 }
 
+// newLocalStateAccessor creates the keyshare store of local party from the global options
+func newLocalStateAccessor(c *cli.Context, localPartyID string) (KeyshareStore, error) {
+	shareCipher, err := LoadShareCipher(c.String("passphrase-file"), c.String("share-key-file"))
+	if err != nil {
+		return nil, err
+	}
+	if vaultFile := c.String("vault"); vaultFile != "" {
+		if c.String("store") != "" {
+			return nil, fmt.Errorf("only one of --vault and --store can be set")
+		}
+		return NewVaultStateAccessor(vaultFile, localPartyID, shareCipher), nil
+	}
+	return OpenKeyshareStore(c.String("store"), localPartyID, shareCipher)
+}
+
+// setupTssService creates the TssService and applies the global options to it
+func setupTssService(c *cli.Context, localStateAccessor LocalStateAccessor, isEdDSA bool) (*TssService, error) {
+	retryPolicy := DefaultRetryPolicy()
+	retryPolicy.MaxAttempts = c.Int("relay-retries")
+	retryPolicy.Budget = c.Duration("relay-retry-budget")
+	transport, err := NewHTTPTransport(c.String("server"), c.String("inbound"))
+	if err != nil {
+		return nil, err
+	}
+	transport.SetRetryPolicy(retryPolicy)
+	tss, err := NewTssService(transport, localStateAccessor, isEdDSA)
+	if err != nil {
+		return nil, err
+	}
+	if err := tss.SetEncryptionKey(c.String("encryption-key")); err != nil {
+		return nil, err
+	}
+	if err := tss.SetIdentityKeys(c.String("key"), c.String("identity-key"), c.StringSlice("party-keys")); err != nil {
+		return nil, err
+	}
+	tss.SetTimeouts(Timeouts{
+		Join:     c.Duration("join-timeout"),
+		Setup:    c.Duration("setup-timeout"),
+		Protocol: c.Duration("protocol-timeout"),
+		Liveness: c.Duration("liveness-timeout"),
+		Complete: c.Duration("complete-timeout"),
+	})
+	if sessionDir := c.String("session-dir"); sessionDir != "" {
+		tss.SetSessionJournal(NewSessionJournal(sessionDir))
+	}
+	return tss, nil
+}
+
 func keygenCmd(c *cli.Context) error {
 	key := c.String("key")
 	parties := c.StringSlice("parties")
 	sessionID := c.String("session")
-	server := c.String("server")
 	chaincode := c.String("chaincode")
 	isLeader := c.Bool("leader")
-	localStateAccessorImp := NewLocalStateAccessorImp(key)
+	localStateAccessorImp, err := newLocalStateAccessor(c, key)
+	if err != nil {
+		return err
+	}
 	isEdDSA := c.Bool("eddsa")
-	tss, err := NewTssService(server, localStateAccessorImp, isEdDSA)
+	if c.Bool("both") {
+		if isEdDSA {
+			return fmt.Errorf("--both and --eddsa can't be used together")
+		}
+		if c.String("vault") == "" {
+			return fmt.Errorf("--both requires --vault to save the keyshares together")
+		}
+		if chaincode != "" {
+			return fmt.Errorf("--both takes the chain code of the ECDSA keyshare, --chaincode can't be used")
+		}
+	} else if chaincode == "" {
+		return fmt.Errorf("--chaincode is required")
+	}
+	tss, err := setupTssService(c, localStateAccessorImp, isEdDSA)
 	if err != nil {
 		return err
 	}
-	return tss.Keygen(sessionID, chaincode, key, parties, isLeader)
+	if c.Bool("both") {
+		return tss.KeygenBoth(c.Context, sessionID, key, parties, c.Int("threshold"), isLeader)
+	}
+	return tss.Keygen(c.Context, sessionID, chaincode, key, parties, c.Int("threshold"), isLeader)
 }
 
 // reshare doesn't work yet
@@ -202,34 +564,122 @@ func reshareCmd(c *cli.Context) error {
 	key := c.String("key")
 	parties := c.StringSlice("parties")
 	sessionID := c.String("session")
-	server := c.String("server")
 	publicKey := c.String("pubkey")
 	isLeader := c.Bool("leader")
 	isEdDSA := c.Bool("eddsa")
 	oldParties := c.StringSlice("old-parties")
-	localStateAccessorImp := NewLocalStateAccessorImp(key)
-	tss, err := NewTssService(server, localStateAccessorImp, isEdDSA)
+	localStateAccessorImp, err := newLocalStateAccessor(c, key)
+	if err != nil {
+		return err
+	}
+	tss, err := setupTssService(c, localStateAccessorImp, isEdDSA)
+	if err != nil {
+		return err
+	}
+	return tss.Reshare(c.Context, sessionID, publicKey, c.String("chaincode"), key, parties, oldParties, c.Int("threshold"), isLeader)
+}
+func refreshCmd(c *cli.Context) error {
+	key := c.String("key")
+	parties := c.StringSlice("parties")
+	sessionID := c.String("session")
+	publicKey := c.String("pubkey")
+	isLeader := c.Bool("leader")
+	isEdDSA := c.Bool("eddsa")
+	localStateAccessorImp, err := newLocalStateAccessor(c, key)
+	if err != nil {
+		return err
+	}
+	tss, err := setupTssService(c, localStateAccessorImp, isEdDSA)
 	if err != nil {
 		return err
 	}
-	return tss.Reshare(sessionID, publicKey, key, parties, oldParties, isLeader)
+	return tss.Refresh(c.Context, sessionID, publicKey, key, parties, c.Int("threshold"), isLeader)
+}
+func refreshCommitCmd(c *cli.Context) error {
+	key := c.String("key")
+	publicKey := c.String("pubkey")
+	localStateAccessorImp, err := newLocalStateAccessor(c, key)
+	if err != nil {
+		return err
+	}
+	tss, err := setupTssService(c, localStateAccessorImp, c.Bool("eddsa"))
+	if err != nil {
+		return err
+	}
+	if c.Bool("rollback") {
+		return tss.RollbackPendingRefresh(publicKey)
+	}
+	return tss.CommitPendingRefresh(publicKey, key)
 }
 func keysignCmd(c *cli.Context) error {
 	key := c.String("key")
 	parties := c.StringSlice("parties")
 	sessionID := c.String("session")
-	server := c.String("server")
 	isLeader := c.Bool("leader")
 	publicKey := c.String("pubkey")
 	message := c.String("message")
 	derivePath := c.String("derivepath")
 	isEdDSA := c.Bool("eddsa")
-	localStateAccessorImp := NewLocalStateAccessorImp(key)
-	tss, err := NewTssService(server, localStateAccessorImp, isEdDSA)
+	localStateAccessorImp, err := newLocalStateAccessor(c, key)
+	if err != nil {
+		return err
+	}
+	tss, err := setupTssService(c, localStateAccessorImp, isEdDSA)
+	if err != nil {
+		return err
+	}
+	var result *KeysignResult
+	if presignID := c.String("use-presign"); presignID != "" {
+		result, err = tss.KeysignWithPresign(c.Context, sessionID, publicKey, message, c.String("encoding"), c.String("hash"), derivePath, presignID, key, parties, isLeader)
+	} else {
+		result, err = tss.Keysign(c.Context, sessionID, publicKey, message, c.String("encoding"), c.String("hash"), derivePath, key, parties, isLeader)
+	}
+	if result != nil {
+		// still write the result when verification fails, so it can be inspected
+		if writeErr := result.WriteJSON(c.String("out")); writeErr != nil {
+			return writeErr
+		}
+	}
+	return err
+}
+func presignCmd(c *cli.Context) error {
+	key := c.String("key")
+	localStateAccessorImp, err := newLocalStateAccessor(c, key)
+	if err != nil {
+		return err
+	}
+	tss, err := setupTssService(c, localStateAccessorImp, false)
+	if err != nil {
+		return err
+	}
+	return tss.Presign(c.Context, c.String("session"), c.String("pubkey"), c.String("derivepath"), key, c.StringSlice("parties"), c.Bool("leader"))
+}
+func keysignBatchCmd(c *cli.Context) error {
+	key := c.String("key")
+	parties := c.StringSlice("parties")
+	sessionID := c.String("session")
+	isLeader := c.Bool("leader")
+	publicKey := c.String("pubkey")
+	isEdDSA := c.Bool("eddsa")
+	requests, err := LoadKeysignRequests(c.String("file"))
+	if err != nil {
+		return err
+	}
+	localStateAccessorImp, err := newLocalStateAccessor(c, key)
 	if err != nil {
 		return err
 	}
-	return tss.Keysign(sessionID, publicKey, message, derivePath, key, parties, isLeader)
+	tss, err := setupTssService(c, localStateAccessorImp, isEdDSA)
+	if err != nil {
+		return err
+	}
+	results, err := tss.KeysignBatch(c.Context, sessionID, publicKey, requests, key, parties, isLeader)
+	if results != nil {
+		if writeErr := writeJSON(results, c.String("out")); writeErr != nil {
+			return writeErr
+		}
+	}
+	return err
 }
 func exportCmd(c *cli.Context) error {
 	parts := c.StringSlice("part")
@@ -240,14 +690,107 @@ func exportCmd(c *cli.Context) error {
 func migrationCmd(c *cli.Context) error {
 	key := c.String("key")
 	sessionID := c.String("session")
-	server := c.String("server")
 	isLeader := c.Bool("leader")
-	localStateAccessorImp := NewLocalStateAccessorImp(key)
+	localStateAccessorImp, err := newLocalStateAccessor(c, key)
+	if err != nil {
+		return err
+	}
 	keyshareFile := c.String("file")
 	isEdDSA := c.Bool("eddsa")
-	tss, err := NewTssService(server, localStateAccessorImp, isEdDSA)
+	tss, err := setupTssService(c, localStateAccessorImp, isEdDSA)
+	if err != nil {
+		return err
+	}
+	// the vault to migrate may have been sealed like the keyshares
+	shareCipher, err := LoadShareCipher(c.String("passphrase-file"), c.String("share-key-file"))
+	if err != nil {
+		return err
+	}
+	return tss.MigrateKey(c.Context, sessionID, isLeader, keyshareFile, shareCipher, c.Int("threshold"))
+}
+func deriveCmd(c *cli.Context) error {
+	key := c.String("key")
+	publicKey := c.String("pubkey")
+	derivePath := c.String("path")
+	isEdDSA := c.Bool("eddsa")
+	watchOnly := c.Bool("watch-only")
+	localStateAccessorImp, err := newLocalStateAccessor(c, key)
+	if err != nil {
+		return err
+	}
+	tss, err := setupTssService(c, localStateAccessorImp, isEdDSA)
+	if err != nil {
+		return err
+	}
+	childPublicKey, err := tss.DeriveChildPublicKey(publicKey, derivePath, watchOnly)
+	if errors.Is(err, ErrEdDSADerivePath) {
+		return fmt.Errorf("%w, pass --watch-only to derive a key that can't be signed with", err)
+	}
+	if err != nil {
+		return err
+	}
+	derivedKey, err := NewDerivedKey(derivePath, childPublicKey, isEdDSA)
+	if err != nil {
+		return err
+	}
+	derivedKey.WatchOnly = tss.checkDerivePath(derivePath) != nil
+	buf, err := json.MarshalIndent(derivedKey, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal derived key: %w", err)
+	}
+	fmt.Println(string(buf))
+	return nil
+}
+func listCmd(c *cli.Context) error {
+	store, err := newLocalStateAccessor(c, c.String("key"))
+	if err != nil {
+		return err
+	}
+	list, err := store.List()
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		list = []KeyshareMetadata{}
+	}
+	return writeJSON(list, "")
+}
+func inspectCmd(c *cli.Context) error {
+	key := c.String("key")
+	publicKey := c.String("pubkey")
+	// the curve is told by the public key, so --eddsa is not needed
+	curve, err := curveOfPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	localStateAccessorImp, err := newLocalStateAccessor(c, key)
+	if err != nil {
+		return err
+	}
+	tss, err := setupTssService(c, localStateAccessorImp, curve == CurveEdDSA)
+	if err != nil {
+		return err
+	}
+	info, err := tss.InspectKeyshare(publicKey)
+	if err != nil {
+		return err
+	}
+	if err := writeJSON(info, ""); err != nil {
+		return err
+	}
+	return info.Check()
+}
+func relayCmd(c *cli.Context) error {
+	listen := c.String("listen")
+	fmt.Println("relay server listening on", listen)
+	return http.ListenAndServe(listen, relay.NewServer())
+}
+
+func identityCmd(c *cli.Context) error {
+	publicKey, err := GenerateIdentityKey(c.String("out"))
 	if err != nil {
 		return err
 	}
-	return tss.MigrateKey(sessionID, isLeader, keyshareFile)
+	fmt.Printf("%s=%s\n", c.String("key"), publicKey)
+	return nil
 }
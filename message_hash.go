@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	HashSHA256    = "sha256"
+	HashSHA256d   = "sha256d"
+	HashKeccak256 = "keccak256"
+	// HashNone signs the decoded message as is, it has to be a digest already
+	HashNone = "none"
+
+	EncodingUTF8   = "utf8"
+	EncodingHex    = "hex"
+	EncodingBase64 = "base64"
+)
+
+// DecodeInputMessage decodes the message given on the command line
+func DecodeInputMessage(message string, encoding string) ([]byte, error) {
+	switch encoding {
+	case EncodingUTF8, "":
+		return []byte(message), nil
+	case EncodingHex:
+		return hex.DecodeString(message)
+	case EncodingBase64:
+		return base64.StdEncoding.DecodeString(message)
+	default:
+		return nil, fmt.Errorf("unsupported message encoding: %s", encoding)
+	}
+}
+
+// HashMessage returns the digest of the message that will be signed
+func HashMessage(message []byte, hashFunction string) ([]byte, error) {
+	switch hashFunction {
+	case HashSHA256, "":
+		return SHA256HashBytes(message), nil
+	case HashSHA256d:
+		return SHA256HashBytes(SHA256HashBytes(message)), nil
+	case HashKeccak256:
+		return crypto.Keccak256(message), nil
+	case HashNone:
+		return message, nil
+	default:
+		return nil, fmt.Errorf("unsupported hash function: %s", hashFunction)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestHashMessage(t *testing.T) {
+	cases := []struct {
+		message      string
+		encoding     string
+		hashFunction string
+		expected     string
+	}{
+		{"abc", EncodingUTF8, HashSHA256, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"616263", EncodingHex, HashSHA256, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"YWJj", EncodingBase64, HashSHA256, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"abc", EncodingUTF8, HashSHA256d, "4f8b42c22dd3729b519ba6f68d2da7cc5b2d606d05daed5ad5128cc03e6c6358"},
+		{"", EncodingUTF8, HashKeccak256, "c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470"},
+		{"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", EncodingHex, HashNone, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+	}
+	for _, c := range cases {
+		message, err := DecodeInputMessage(c.message, c.encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgHash, err := HashMessage(message, c.hashFunction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(msgHash) != c.expected {
+			t.Errorf("%s(%s) = %x, expected %s", c.hashFunction, c.message, msgHash, c.expected)
+		}
+	}
+	if _, err := HashMessage([]byte("abc"), "md5"); err == nil {
+		t.Error("unsupported hash function should fail")
+	}
+	if _, err := DecodeInputMessage("zz", EncodingHex); err == nil {
+		t.Error("invalid hex should fail")
+	}
+}
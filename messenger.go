@@ -1,80 +1,79 @@
 package main
 
 import (
-	"bytes"
-	"crypto/md5"
+	"context"
+	"crypto/ed25519"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"net/http"
+	"sync"
 
 	"github.com/sirupsen/logrus"
+	"github.com/vultisig/test-dkls/relay"
 )
 
 type MessengerImp struct {
-	Server    string
-	SessionID string
-	logger    *logrus.Logger
+	transport     Transport
+	SessionID     string
+	logger        *logrus.Logger
+	encryptionKey []byte
+	identityKey   ed25519.PrivateKey
+	mu            sync.Mutex
+	// sequenceNo is the sequence number of the last message sent to each receiver in each session
+	sequenceNo map[string]int64
 }
 
-func NewMessageImp(server, sessionID string) *MessengerImp {
+func NewMessageImp(transport Transport, sessionID string) *MessengerImp {
 	return &MessengerImp{
-		Server:    server,
-		SessionID: sessionID,
-		logger:    logrus.WithField("service", "messenger").Logger,
+		transport:  transport,
+		SessionID:  sessionID,
+		logger:     logrus.WithField("service", "messenger").Logger,
+		sequenceNo: make(map[string]int64),
 	}
 }
 
-func (m *MessengerImp) Send(from, to, body string) error {
-	hash := md5.New()
-	hash.Write([]byte(body))
-	hashStr := hex.EncodeToString(hash.Sum(nil))
-
-	if hashStr == "" {
-		return fmt.Errorf("hash is empty")
-	}
-
-	buf, err := json.MarshalIndent(struct {
-		SessionID string   `json:"session_id,omitempty"`
-		From      string   `json:"from,omitempty"`
-		To        []string `json:"to,omitempty"`
-		Body      string   `json:"body,omitempty"`
-		Hash      string   `json:"hash,omitempty"`
-	}{
-		SessionID: m.SessionID,
-		From:      from,
-		To:        []string{to},
-		Body:      body,
-		Hash:      hashStr,
-	}, "", "  ")
-	if err != nil {
-		return fmt.Errorf("fail to marshal message: %w", err)
-	}
-
-	url := fmt.Sprintf("%s/message/%s", m.Server, m.SessionID)
-	req, err := http.NewRequest("POST", url, bytes.NewReader(buf))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
+func (m *MessengerImp) Send(ctx context.Context, from, to, body string) error {
+	return m.SendWithSessionID(ctx, m.SessionID, from, to, body)
+}
 
+// SendWithSessionID sends the message over the relay session of the messenger, but tags it with the given
+// session id, it's used to multiplex several protocol sessions over one relay session
+func (m *MessengerImp) SendWithSessionID(ctx context.Context, sessionID, from, to, body string) error {
 	if body == "" {
 		return fmt.Errorf("body is empty")
 	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := http.DefaultClient.Do(req)
+	sequenceNo := m.nextSequenceNo(sessionID, to)
+	if len(m.encryptionKey) > 0 {
+		// the key is derived from the relay session, the same key is used by all the multiplexed sessions
+		encryptedBody, err := encryptMessage(m.encryptionKey, m.SessionID, sessionID, from, to, sequenceNo, []byte(body))
+		if err != nil {
+			return fmt.Errorf("fail to encrypt message: %w", err)
+		}
+		body = encryptedBody
+	}
+	message := relay.Message{
+		SessionID:  sessionID,
+		From:       from,
+		To:         []string{to},
+		Body:       body,
+		SequenceNo: sequenceNo,
+	}
+	idKey, err := messageIDKey(m.encryptionKey, m.SessionID)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		return fmt.Errorf("fail to derive message id key: %w", err)
 	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			m.logger.Error("failed to close response body", "error", err)
-		}
-	}()
-
-	if resp.StatusCode != http.StatusAccepted {
-		return fmt.Errorf("fail to send message, response code is not 202 Accepted: %s", resp.Status)
+	message.Hash = messageID(idKey, message)
+	if m.identityKey != nil {
+		signature := ed25519.Sign(m.identityKey, messageSigningPayload(m.SessionID, sessionID, from, to, message.SequenceNo, body))
+		message.Signature = hex.EncodeToString(signature)
 	}
-	return nil
+	return m.transport.Send(ctx, m.SessionID, message)
+}
+
+// nextSequenceNo numbers the messages sent to a receiver in a session. The transport retries a message as it
+// is, so a retried message keeps its sequence number and id, and the receiver drops it as a duplicate.
+func (m *MessengerImp) nextSequenceNo(sessionID, to string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sequenceNo[sessionID+"/"+to]++
+	return m.sequenceNo[sessionID+"/"+to]
 }
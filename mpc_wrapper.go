@@ -29,6 +29,11 @@ type MPCKeysignWrapper interface {
 	SignSessionInputMessage(session Handle, message []byte) (bool, error)
 	SignSessionFinish(session Handle) ([]byte, error)
 	SignSessionFree(session Handle) error
+	// PresignSessionFinish returns the pre-signature of a sign session created from a setup message without message hash
+	PresignSessionFinish(session Handle) (Handle, error)
+	PresignToBytes(presign Handle) ([]byte, error)
+	PresignFromBytes(buf []byte) (Handle, error)
+	PresignFree(presign Handle) error
 }
 type MPCQcWrapper interface {
 	QcSetupMsgNew(keyshareHandle Handle, threshod int, ids []string, oldParties []int, newParties []int) ([]byte, error)
@@ -234,6 +239,21 @@ func (w *MPCWrapperImp) SignSessionFree(h Handle) error {
 	}
 	return session.DklsSignSessionFree(session.Handle(h))
 }
+
+// the go wrapper takes a pre-signature in SignSessionFromSetup, but it doesn't give access to the pre-signature of
+// a sign session nor serialize one yet
+func (w *MPCWrapperImp) PresignSessionFinish(h Handle) (Handle, error) {
+	return Handle(0), ErrPresignNotSupported
+}
+func (w *MPCWrapperImp) PresignToBytes(presign Handle) ([]byte, error) {
+	return nil, ErrPresignNotSupported
+}
+func (w *MPCWrapperImp) PresignFromBytes(buf []byte) (Handle, error) {
+	return Handle(0), ErrPresignNotSupported
+}
+func (w *MPCWrapperImp) PresignFree(presign Handle) error {
+	return ErrPresignNotSupported
+}
 func (w *MPCWrapperImp) KeyshareFromBytes(buf []byte) (Handle, error) {
 	if w.isEdDSA {
 		h, err := eddsaSession.SchnorrKeyshareFromBytes(buf)
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const presignInfix = "-presign-"
+
+var ErrPresignNotSupported = errors.New("presign is not supported by the wrapper")
+
+// presignKey is the local state key a pre-signature is saved under, next to the keyshare
+func presignKey(pubKey string, presignID string) string {
+	return pubKey + presignInfix + presignID
+}
+
+// Presign is a pre-signature of the keyshare, made ahead of the message. It finishes exactly one signature, using
+// it twice leaks the key, so it's deleted before it's used.
+type Presign struct {
+	PresignID  string    `json:"presign_id"`
+	PublicKey  string    `json:"public_key"`
+	DerivePath string    `json:"derive_path"`
+	Committee  []string  `json:"committee"`
+	Presign    string    `json:"presign"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Presign runs the rounds of keysign that don't depend on the message and saves the pre-signature under the
+// session id, KeysignWithPresign finishes a signature with it in one round. Only ECDSA keys can presign.
+func (t *TssService) Presign(ctx context.Context,
+	sessionID string,
+	publicKeyECDSA string,
+	derivePath string,
+	localPartyID string,
+	keysignCommittee []string,
+	isInitiateDevice bool) error {
+	if t.isEdDSA {
+		return fmt.Errorf("%w: EdDSA keys can't presign", ErrPresignNotSupported)
+	}
+	if publicKeyECDSA == "" {
+		return fmt.Errorf("public key is empty")
+	}
+	if derivePath == "" {
+		return fmt.Errorf("derive path is empty")
+	}
+	if localPartyID == "" {
+		return fmt.Errorf("local party id is empty")
+	}
+	if len(keysignCommittee) == 0 {
+		return fmt.Errorf("keysign committee is empty")
+	}
+	mpcWrapper := t.GetMPCKeygenWrapper()
+	t.logger.WithFields(logrus.Fields{
+		"session_id":         sessionID,
+		"public_key_ecdsa":   publicKeyECDSA,
+		"derive_path":        derivePath,
+		"local_party_id":     localPartyID,
+		"keysign_committee":  keysignCommittee,
+		"is_initiate_device": isInitiateDevice,
+	}).Info("Presign")
+
+	joinCtx, cancelJoin := withTimeout(ctx, t.timeouts.Join)
+	defer cancelJoin()
+	session, err := t.beginSession(OperationPresign, sessionID, localPartyID, keysignCommittee)
+	if err != nil {
+		return fmt.Errorf("failed to begin session: %w", err)
+	}
+	defer t.endSession(session)
+	if err := t.transport.RegisterSession(joinCtx, sessionID, localPartyID); err != nil {
+		return fmt.Errorf("failed to start session: %w", err)
+	}
+	keyshare, err := t.localStateAccessor.GetLocalState(publicKeyECDSA)
+	if err != nil {
+		return fmt.Errorf("failed to get keyshare: %w", err)
+	}
+	keyshareBytes, err := base64.StdEncoding.DecodeString(keyshare)
+	if err != nil {
+		return fmt.Errorf("failed to decode keyshare: %w", err)
+	}
+	keyshareHandle, err := mpcWrapper.KeyshareFromBytes(keyshareBytes)
+	if err != nil {
+		return fmt.Errorf("failed to create keyshare from bytes: %w", err)
+	}
+	defer func() {
+		if err := mpcWrapper.KeyshareFree(keyshareHandle); err != nil {
+			t.logger.Error("failed to free keyshare", "error", err)
+		}
+	}()
+	var encodedSetupMsg string
+	if isInitiateDevice {
+		if err := t.transport.WaitAllParties(joinCtx, sessionID, keysignCommittee); err != nil {
+			return fmt.Errorf("failed to wait for all parties to join: %w", err)
+		}
+		keyID, err := mpcWrapper.KeyshareKeyID(keyshareHandle)
+		if err != nil {
+			return fmt.Errorf("failed to get key id: %w", err)
+		}
+		keysignCommitteeBytes, err := t.convertKeygenCommitteeToBytes(keysignCommittee)
+		if err != nil {
+			return fmt.Errorf("failed to get keysign committee: %w", err)
+		}
+		// a sign setup message without message hash runs the pre-signature rounds only
+		setupMsg, err := mpcWrapper.SignSetupMsgNew(keyID, []byte(derivePath), nil, keysignCommitteeBytes)
+		if err != nil {
+			return fmt.Errorf("failed to create setup message: %w", err)
+		}
+		encodedSetupMsg = base64.StdEncoding.EncodeToString(setupMsg)
+		setupCtx, cancelSetup := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelSetup()
+		if err := t.transport.UploadPayload(setupCtx, sessionID, encodedSetupMsg); err != nil {
+			return fmt.Errorf("failed to upload setup message: %w", err)
+		}
+		if err := t.transport.StartSession(setupCtx, sessionID, keysignCommittee); err != nil {
+			return fmt.Errorf("failed to start session: %w", err)
+		}
+	} else {
+		if _, err := t.transport.WaitForSessionStart(joinCtx, sessionID); err != nil {
+			return fmt.Errorf("failed to wait for session to start: %w", err)
+		}
+		setupCtx, cancelSetup := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelSetup()
+		encodedSetupMsg, err = t.transport.GetPayload(setupCtx, sessionID)
+		if err != nil {
+			return fmt.Errorf("failed to get setup message: %w", err)
+		}
+	}
+	setupMessageBytes, err := base64.StdEncoding.DecodeString(encodedSetupMsg)
+	if err != nil {
+		return fmt.Errorf("failed to decode setup message: %w", err)
+	}
+	// a setup message carrying a message hash would sign it instead of making a pre-signature
+	messageHashInSetupMsg, err := mpcWrapper.DecodeMessage(setupMessageBytes)
+	if err != nil {
+		return fmt.Errorf("failed to decode message: %w", err)
+	}
+	if len(messageHashInSetupMsg) != 0 {
+		return fmt.Errorf("presign setup message carries a message hash, stop presign")
+	}
+	sessionHandle, err := mpcWrapper.SignSessionFromSetup(setupMessageBytes, []byte(t.partyName(localPartyID)), keyshareHandle)
+	if err != nil {
+		return fmt.Errorf("failed to create session from setup message: %w", err)
+	}
+	defer func() {
+		if err := mpcWrapper.SignSessionFree(sessionHandle); err != nil {
+			t.logger.Error("failed to free presign session", "error", err)
+		}
+	}()
+	presign, err := t.runSignSession(ctx, sessionHandle, sessionID, localPartyID, keysignCommittee, "", func(session Handle) ([]byte, error) {
+		presignHandle, err := mpcWrapper.PresignSessionFinish(session)
+		if err != nil {
+			return nil, fmt.Errorf("fail to finish presign: %w", err)
+		}
+		defer func() {
+			if err := mpcWrapper.PresignFree(presignHandle); err != nil {
+				t.logger.Error("failed to free presign", "error", err)
+			}
+		}()
+		return mpcWrapper.PresignToBytes(presignHandle)
+	})
+	if err != nil {
+		return err
+	}
+	t.logger.Infof("Presign %s is finished", sessionID)
+	return t.savePresign(&Presign{
+		PresignID:  sessionID,
+		PublicKey:  publicKeyECDSA,
+		DerivePath: derivePath,
+		Committee:  keysignCommittee,
+		Presign:    base64.StdEncoding.EncodeToString(presign),
+		CreatedAt:  time.Now().UTC(),
+	})
+}
+
+func (t *TssService) savePresign(presign *Presign) error {
+	buf, err := json.Marshal(presign)
+	if err != nil {
+		return fmt.Errorf("fail to marshal presign: %w", err)
+	}
+	if err := t.localStateAccessor.SaveLocalState(presignKey(presign.PublicKey, presign.PresignID), string(buf)); err != nil {
+		return fmt.Errorf("fail to save presign: %w", err)
+	}
+	return nil
+}
+
+// takePresign loads the pre-signature and deletes it, so it can't be used for a second signature even when the
+// keysign fails
+func (t *TssService) takePresign(publicKey string, presignID string) (*Presign, error) {
+	if strings.ContainsAny(presignID, `/\`) {
+		return nil, fmt.Errorf("invalid presign id %s", presignID)
+	}
+	buf, err := t.localStateAccessor.GetLocalState(presignKey(publicKey, presignID))
+	if err != nil || buf == "" {
+		return nil, fmt.Errorf("presign %s of %s does not exist or is used", presignID, publicKey)
+	}
+	var presign Presign
+	if err := json.Unmarshal([]byte(buf), &presign); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal presign: %w", err)
+	}
+	if err := t.deleteLocalState(presignKey(publicKey, presignID)); err != nil {
+		return nil, fmt.Errorf("fail to delete presign: %w", err)
+	}
+	return &presign, nil
+}
+
+// KeysignWithPresign finishes the signature of the message with a pre-signature made by Presign, it only takes one
+// round. The committee and derive path have to be the ones of the pre-signature.
+func (t *TssService) KeysignWithPresign(ctx context.Context,
+	sessionID string,
+	publicKeyECDSA string,
+	message string,
+	messageEncoding string,
+	hashFunction string,
+	derivePath string,
+	presignID string,
+	localPartyID string,
+	keysignCommittee []string,
+	isInitiateDevice bool) (*KeysignResult, error) {
+	if t.isEdDSA {
+		return nil, fmt.Errorf("%w: EdDSA keys can't presign", ErrPresignNotSupported)
+	}
+	if publicKeyECDSA == "" {
+		return nil, fmt.Errorf("public key is empty")
+	}
+	if message == "" {
+		return nil, fmt.Errorf("message is empty")
+	}
+	if presignID == "" {
+		return nil, fmt.Errorf("presign id is empty")
+	}
+	if localPartyID == "" {
+		return nil, fmt.Errorf("local party id is empty")
+	}
+	if len(keysignCommittee) == 0 {
+		return nil, fmt.Errorf("keysign committee is empty")
+	}
+	decodedMessage, err := DecodeInputMessage(message, messageEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode message: %w", err)
+	}
+	msgHash, err := HashMessage(decodedMessage, hashFunction)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash message: %w", err)
+	}
+	if len(msgHash) != 32 {
+		return nil, fmt.Errorf("message hash should be 32 bytes, got %d", len(msgHash))
+	}
+	mpcWrapper := t.GetMPCKeygenWrapper()
+	t.logger.WithFields(logrus.Fields{
+		"session_id":         sessionID,
+		"public_key_ecdsa":   publicKeyECDSA,
+		"message":            message,
+		"derive_path":        derivePath,
+		"presign_id":         presignID,
+		"local_party_id":     localPartyID,
+		"keysign_committee":  keysignCommittee,
+		"is_initiate_device": isInitiateDevice,
+	}).Info("Keysign with presign")
+
+	joinCtx, cancelJoin := withTimeout(ctx, t.timeouts.Join)
+	defer cancelJoin()
+	session, err := t.beginSession(OperationKeysign, sessionID, localPartyID, keysignCommittee)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin session: %w", err)
+	}
+	defer t.endSession(session)
+	presign, err := t.takePresign(publicKeyECDSA, presignID)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Equal(presign.Committee, keysignCommittee) {
+		return nil, fmt.Errorf("presign %s was made by %v, not by %v", presignID, presign.Committee, keysignCommittee)
+	}
+	if presign.DerivePath != derivePath {
+		return nil, fmt.Errorf("presign %s was made for derive path %s, not %s", presignID, presign.DerivePath, derivePath)
+	}
+	presignBytes, err := base64.StdEncoding.DecodeString(presign.Presign)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode presign: %w", err)
+	}
+	presignHandle, err := mpcWrapper.PresignFromBytes(presignBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create presign from bytes: %w", err)
+	}
+	defer func() {
+		if err := mpcWrapper.PresignFree(presignHandle); err != nil {
+			t.logger.Error("failed to free presign", "error", err)
+		}
+	}()
+	if err := t.transport.RegisterSession(joinCtx, sessionID, localPartyID); err != nil {
+		return nil, fmt.Errorf("failed to start session: %w", err)
+	}
+	var encodedSetupMsg string
+	if isInitiateDevice {
+		if err := t.transport.WaitAllParties(joinCtx, sessionID, keysignCommittee); err != nil {
+			return nil, fmt.Errorf("failed to wait for all parties to join: %w", err)
+		}
+		keysignCommitteeBytes, err := t.convertKeygenCommitteeToBytes(keysignCommittee)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get keysign committee: %w", err)
+		}
+		setupMsg, err := mpcWrapper.FinishSetupMsgNew([]byte(presignID), msgHash, keysignCommitteeBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create finish setup message: %w", err)
+		}
+		encodedSetupMsg = base64.StdEncoding.EncodeToString(setupMsg)
+		setupCtx, cancelSetup := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelSetup()
+		if err := t.transport.UploadPayload(setupCtx, sessionID, encodedSetupMsg); err != nil {
+			return nil, fmt.Errorf("failed to upload setup message: %w", err)
+		}
+		if err := t.transport.StartSession(setupCtx, sessionID, keysignCommittee); err != nil {
+			return nil, fmt.Errorf("failed to start session: %w", err)
+		}
+	} else {
+		if _, err := t.transport.WaitForSessionStart(joinCtx, sessionID); err != nil {
+			return nil, fmt.Errorf("failed to wait for session to start: %w", err)
+		}
+		setupCtx, cancelSetup := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelSetup()
+		encodedSetupMsg, err = t.transport.GetPayload(setupCtx, sessionID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get setup message: %w", err)
+		}
+	}
+	setupMessageBytes, err := base64.StdEncoding.DecodeString(encodedSetupMsg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode setup message: %w", err)
+	}
+	messageHashInSetupMsg, err := mpcWrapper.DecodeMessage(setupMessageBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode message: %w", err)
+	}
+	if !bytes.Equal(messageHashInSetupMsg, msgHash) {
+		return nil, fmt.Errorf("message hash in setup message is not equal to the message, stop keysign")
+	}
+	// every party has to finish with the same pre-signature
+	presignIDInSetupMsg, err := mpcWrapper.DecodeSessionID(setupMessageBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode session id: %w", err)
+	}
+	if string(presignIDInSetupMsg) != presignID {
+		return nil, fmt.Errorf("setup message finishes presign %s, not %s, stop keysign", presignIDInSetupMsg, presignID)
+	}
+	sessionHandle, err := mpcWrapper.SignSessionFromSetup(setupMessageBytes, []byte(t.partyName(localPartyID)), presignHandle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session from setup message: %w", err)
+	}
+	defer func() {
+		if err := mpcWrapper.SignSessionFree(sessionHandle); err != nil {
+			t.logger.Error("failed to free keysign session", "error", err)
+		}
+	}()
+	sig, err := t.runSignSession(ctx, sessionHandle, sessionID, localPartyID, keysignCommittee, message, mpcWrapper.SignSessionFinish)
+	if err != nil {
+		return nil, err
+	}
+	pubKeyBytes, err := t.DeriveChildPublicKey(publicKeyECDSA, derivePath, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive child public key: %w", err)
+	}
+	t.logger.Infof("Derived public key: %s", hex.EncodeToString(pubKeyBytes))
+	result, err := NewKeysignResult(msgHash, derivePath, pubKeyBytes, sig, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := result.Verify(); err != nil {
+		t.logger.Error("Signature is invalid")
+		return result, err
+	}
+	t.logger.Infoln("Signature is valid")
+	return result, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/vultisig/test-dkls/relay"
+)
+
+func TestTakePresign(t *testing.T) {
+	accessor := newMemoryStateAccessor()
+	tss, err := NewTssService(NewMemoryTransport(relay.NewServer()), accessor, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	presign := &Presign{
+		PresignID:  "session",
+		PublicKey:  "pubkey",
+		DerivePath: "m/0",
+		Committee:  []string{"first", "second"},
+		Presign:    "cHJlc2lnbg==",
+	}
+	if err := tss.savePresign(presign); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := tss.takePresign("pubkey", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Presign != presign.Presign || loaded.DerivePath != "m/0" || len(loaded.Committee) != 2 {
+		t.Fatalf("presign changed after reload: %+v", loaded)
+	}
+	// a pre-signature only signs once
+	if _, err := tss.takePresign("pubkey", "session"); err == nil {
+		t.Fatal("a used presign should not be taken again")
+	}
+	if _, err := tss.takePresign("pubkey", "../session"); err == nil {
+		t.Fatal("presign id with a path separator should be rejected")
+	}
+}
+
+func TestKeysignWithPresignValidation(t *testing.T) {
+	tss, err := NewTssService(NewMemoryTransport(relay.NewServer()), newMemoryStateAccessor(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committee := []string{"first", "second"}
+	for name, args := range map[string]struct {
+		committee  []string
+		derivePath string
+		expected   string
+	}{
+		"other committee":   {[]string{"first", "third"}, "m/0", "was made by"},
+		"other derive path": {committee, "m/1", "was made for derive path"},
+	} {
+		if err := tss.savePresign(&Presign{PresignID: "session", PublicKey: "pubkey", DerivePath: "m/0", Committee: committee}); err != nil {
+			t.Fatal(err)
+		}
+		_, err := tss.KeysignWithPresign(context.Background(), "keysign", "pubkey", "hello", "", "", args.derivePath, "session", "first", args.committee, false)
+		if err == nil || !strings.Contains(err.Error(), args.expected) {
+			t.Fatalf("%s: expected %s, got %v", name, args.expected, err)
+		}
+		// the presign is dropped once it's taken, even when keysign fails
+		if _, err := tss.takePresign("pubkey", "session"); err == nil {
+			t.Fatalf("%s: presign should be deleted", name)
+		}
+	}
+
+	eddsa, err := NewTssService(NewMemoryTransport(relay.NewServer()), newMemoryStateAccessor(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := eddsa.Presign(context.Background(), "session", "pubkey", "m", "first", committee, false); !errors.Is(err, ErrPresignNotSupported) {
+		t.Fatalf("expected presign not supported for EdDSA, got %v", err)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const pendingSuffix = "-pending"
+
+var (
+	ErrRefreshTimeout = errors.New("refresh timeout")
+	ErrRefreshPending = errors.New("refresh is pending")
+)
+
+// pendingKeyshareKey is the local state key a refreshed keyshare is saved under until it's committed
+func pendingKeyshareKey(pubKey string) string {
+	return pubKey + pendingSuffix
+}
+
+// The new keyshare only replaces the old one after every party finished the refresh.
+func (t *TssService) Refresh(ctx context.Context,
+	sessionID string,
+	publicKey string,
+	localPartyID string,
+	keygenCommittee []string,
+	threshold int,
+	isInitiateDevice bool) error {
+	if publicKey == "" {
+		return fmt.Errorf("public key is empty")
+	}
+	if localPartyID == "" {
+		return fmt.Errorf("local party id is empty")
+	}
+	if len(keygenCommittee) == 0 {
+		return fmt.Errorf("keygen committee is empty")
+	}
+	if t.hasPendingRefresh(publicKey) {
+		return fmt.Errorf("%w: the refreshed keyshare of %s is not committed, commit or roll it back first", ErrRefreshPending, publicKey)
+	}
+	t.logger.WithFields(logrus.Fields{
+		"session_id":         sessionID,
+		"public_key":         publicKey,
+		"local_party_id":     localPartyID,
+		"keygen_committee":   keygenCommittee,
+		"threshold":          threshold,
+		"is_initiate_device": isInitiateDevice,
+	}).Info("Refresh")
+	threshold, err := t.refreshThreshold(publicKey, threshold, len(keygenCommittee))
+	if err != nil {
+		return fmt.Errorf("failed to get threshold: %w", err)
+	}
+	t.logger.Infof("Threshold is %v", threshold)
+
+	joinCtx, cancelJoin := withTimeout(ctx, t.timeouts.Join)
+	defer cancelJoin()
+	session, err := t.beginSession(OperationRefresh, sessionID, localPartyID, keygenCommittee)
+	if err != nil {
+		return fmt.Errorf("failed to begin session: %w", err)
+	}
+	defer t.endSession(session)
+	if err := t.transport.RegisterSession(joinCtx, sessionID, localPartyID); err != nil {
+		return fmt.Errorf("failed to register session: %w", err)
+	}
+	mpcWrapper := t.GetMPCKeygenWrapper()
+	keyshare, err := t.localStateAccessor.GetLocalState(publicKey)
+	if err != nil {
+		return fmt.Errorf("failed to get keyshare: %w", err)
+	}
+	keyshareBytes, err := base64.StdEncoding.DecodeString(keyshare)
+	if err != nil {
+		return fmt.Errorf("failed to decode keyshare: %w", err)
+	}
+	keyshareHandle, err := mpcWrapper.KeyshareFromBytes(keyshareBytes)
+	if err != nil {
+		return fmt.Errorf("failed to create keyshare from bytes: %w", err)
+	}
+	defer func() {
+		if err := mpcWrapper.KeyshareFree(keyshareHandle); err != nil {
+			t.logger.Error("failed to free keyshare", "error", err)
+		}
+	}()
+	var encodedSetupMsg string
+	if isInitiateDevice {
+		if err := t.transport.WaitAllParties(joinCtx, sessionID, keygenCommittee); err != nil {
+			return fmt.Errorf("failed to wait for all parties to join: %w", err)
+		}
+		keyID, err := mpcWrapper.KeyshareKeyID(keyshareHandle)
+		if err != nil {
+			return fmt.Errorf("failed to get key id: %w", err)
+		}
+		keygenCommitteeBytes, err := t.convertKeygenCommitteeToBytes(keygenCommittee)
+		if err != nil {
+			return fmt.Errorf("failed to get keygen committee: %w", err)
+		}
+		// refresh setup message is a keygen setup message carrying the key id of the existing key
+		setupMsg, err := mpcWrapper.KeygenSetupMsgNew(threshold, keyID, keygenCommitteeBytes)
+		if err != nil {
+			return fmt.Errorf("failed to create setup message: %w", err)
+		}
+		encodedSetupMsg = base64.StdEncoding.EncodeToString(setupMsg)
+		t.logger.Infoln("setup message is:", encodedSetupMsg)
+		setupCtx, cancelSetup := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelSetup()
+		if err := t.transport.UploadPayload(setupCtx, sessionID, encodedSetupMsg); err != nil {
+			return fmt.Errorf("failed to upload setup message: %w", err)
+		}
+		if err := t.uploadThreshold(setupCtx, sessionID, localPartyID, threshold, setupMsg); err != nil {
+			return fmt.Errorf("failed to upload threshold: %w", err)
+		}
+		if err := t.transport.StartSession(setupCtx, sessionID, keygenCommittee); err != nil {
+			return fmt.Errorf("failed to start session: %w", err)
+		}
+	} else {
+		if _, err := t.transport.WaitForSessionStart(joinCtx, sessionID); err != nil {
+			return fmt.Errorf("failed to wait for session to start: %w", err)
+		}
+		setupCtx, cancelSetup := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelSetup()
+		encodedSetupMsg, err = t.transport.GetPayload(setupCtx, sessionID)
+		if err != nil {
+			return fmt.Errorf("failed to get setup message: %w", err)
+		}
+	}
+	setupMessageBytes, err := base64.StdEncoding.DecodeString(encodedSetupMsg)
+	if err != nil {
+		return fmt.Errorf("failed to decode setup message: %w", err)
+	}
+	if !isInitiateDevice {
+		verifyCtx, cancelVerify := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelVerify()
+		if err := t.verifyThreshold(verifyCtx, sessionID, keygenCommittee, threshold, setupMessageBytes); err != nil {
+			return fmt.Errorf("failed to verify setup message: %w", err)
+		}
+	}
+	handle, err := mpcWrapper.KeyRefreshSessionFromSetup(setupMessageBytes, []byte(t.partyName(localPartyID)), keyshareHandle)
+	if err != nil {
+		return fmt.Errorf("failed to create refresh session from setup message: %w", err)
+	}
+	defer func() {
+		if err := mpcWrapper.KeygenSessionFree(handle); err != nil {
+			t.logger.Error("failed to free refresh session", "error", err)
+		}
+	}()
+	protocolCtx, cancelProtocol := withTimeout(ctx, t.timeouts.Protocol)
+	defer cancelProtocol()
+	// the protocol stalls on a message that can't be delivered, so a failed outbound aborts it
+	protocolCtx, abortProtocol := context.WithCancelCause(protocolCtx)
+	defer abortProtocol(nil)
+	go t.watchParties(protocolCtx, abortProtocol, sessionID, localPartyID, keygenCommittee)
+	t.isKeygenFinished.Store(false)
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		if err := t.processKeygenOutbound(protocolCtx, handle, sessionID, keygenCommittee, localPartyID, wg); err != nil {
+			t.logger.Error("failed to process refresh outbound", "error", err)
+			abortProtocol(err)
+		}
+	}()
+	newPublicKey, newKeyshare, err := t.processRefreshInbound(protocolCtx, handle, sessionID, localPartyID, keygenCommittee, wg)
+	wg.Wait()
+	if err != nil {
+		return fmt.Errorf("failed to process refresh inbound: %w", err)
+	}
+	return t.commitRefresh(ctx, sessionID, publicKey, newPublicKey, newKeyshare, localPartyID, keygenCommittee, threshold)
+}
+
+// refreshThreshold is the threshold of the stored keyshare, a refresh can't change it. threshold is only used for
+// a keyshare saved without it, otherwise it has to be 0 or the stored one.
+func (t *TssService) refreshThreshold(publicKey string, threshold int, committeeSize int) (int, error) {
+	metadata, err := t.keyshareMetadata(publicKey)
+	if err != nil {
+		return 0, err
+	}
+	if metadata == nil || metadata.Threshold == 0 {
+		return ResolveThreshold(threshold, committeeSize)
+	}
+	if threshold != 0 && threshold != metadata.Threshold {
+		return 0, fmt.Errorf("%w: keyshare of %s has threshold %d, got %d", ErrThresholdMismatch, publicKey, metadata.Threshold, threshold)
+	}
+	return metadata.Threshold, nil
+}
+
+// commitRefresh replaces the keyshare of publicKey with the refreshed one, once all the parties finished.
+// The new keyshare is saved as pending first. When the other parties can't be confirmed in time some of them may
+// have saved their new keyshare already, so the pending keyshare is kept for CommitPendingRefresh or
+// RollbackPendingRefresh to settle once the operator knows the outcome on the other parties.
+func (t *TssService) commitRefresh(ctx context.Context,
+	sessionID string,
+	publicKey string,
+	newPublicKey string,
+	newKeyshare string,
+	localPartyID string,
+	keygenCommittee []string,
+	threshold int) error {
+	if newPublicKey != publicKey {
+		return fmt.Errorf("public key changed after refresh, expected %s, got %s", publicKey, newPublicKey)
+	}
+	if err := t.localStateAccessor.SaveLocalState(pendingKeyshareKey(publicKey), newKeyshare); err != nil {
+		return fmt.Errorf("failed to save pending keyshare: %w", err)
+	}
+	// don't replace the old keyshare until everyone has the new one, otherwise a failed party would leave the
+	// committee with a mix of old and new shares
+	completeCtx, cancelComplete := withTimeout(ctx, t.timeouts.Complete)
+	defer cancelComplete()
+	if err := t.transport.CompleteSession(completeCtx, sessionID, localPartyID); err != nil {
+		// the other parties wait for this party, none of them can have saved the new keyshare
+		if err := t.clearPendingRefresh(publicKey); err != nil {
+			t.logger.Error("failed to drop pending keyshare", "error", err)
+		}
+		return fmt.Errorf("failed to complete session: %w", err)
+	}
+	if err := t.transport.WaitForSessionComplete(completeCtx, sessionID, keygenCommittee); err != nil {
+		return fmt.Errorf("%w: not all parties finished refresh, the old keyshare is still used and the new one is kept pending, "+
+			"commit it once all the parties saved theirs or roll it back: %w", ErrRefreshPending, err)
+	}
+	t.logger.Infoln("All parties finished refresh, save the new keyshare")
+	if err := t.saveKeyshare(newPublicKey, newKeyshare, localPartyID, keygenCommittee, threshold); err != nil {
+		return err
+	}
+	return t.clearPendingRefresh(publicKey)
+}
+
+// hasPendingRefresh tells whether a refreshed keyshare of publicKey waits to be committed
+func (t *TssService) hasPendingRefresh(publicKey string) bool {
+	keyshare, err := t.localStateAccessor.GetLocalState(pendingKeyshareKey(publicKey))
+	return err == nil && keyshare != ""
+}
+
+func (t *TssService) clearPendingRefresh(publicKey string) error {
+	return t.deleteLocalState(pendingKeyshareKey(publicKey))
+}
+
+// CommitPendingRefresh replaces the keyshare of publicKey with the pending refreshed one. Only commit when all
+// the other parties saved their refreshed keyshare, the old and new keyshares can't sign together.
+func (t *TssService) CommitPendingRefresh(publicKey string, localPartyID string) error {
+	if !t.hasPendingRefresh(publicKey) {
+		return fmt.Errorf("no pending refresh of %s", publicKey)
+	}
+	newKeyshare, err := t.localStateAccessor.GetLocalState(pendingKeyshareKey(publicKey))
+	if err != nil {
+		return fmt.Errorf("failed to get pending keyshare: %w", err)
+	}
+	metadata, err := t.keyshareMetadata(publicKey)
+	if err != nil {
+		return err
+	}
+	var committee []string
+	var threshold int
+	if metadata != nil {
+		committee, threshold = metadata.Committee, metadata.Threshold
+	}
+	if err := t.saveKeyshare(publicKey, newKeyshare, localPartyID, committee, threshold); err != nil {
+		return err
+	}
+	t.logger.Infof("Pending refresh of %s is committed", publicKey)
+	return t.clearPendingRefresh(publicKey)
+}
+
+// RollbackPendingRefresh drops the pending refreshed keyshare of publicKey and keeps the old one
+func (t *TssService) RollbackPendingRefresh(publicKey string) error {
+	if !t.hasPendingRefresh(publicKey) {
+		return fmt.Errorf("no pending refresh of %s", publicKey)
+	}
+	t.logger.Infof("Pending refresh of %s is rolled back", publicKey)
+	return t.clearPendingRefresh(publicKey)
+}
+
+// processRefreshInbound applies the inbound messages to the refresh session, it returns the public key
+// and the new encoded keyshare when the refresh is finished
+func (t *TssService) processRefreshInbound(ctx context.Context,
+	handle Handle,
+	sessionID string,
+	localPartyID string,
+	parties []string,
+	wg *sync.WaitGroup) (string, string, error) {
+	defer wg.Done()
+	tracker := newInboundTracker(localPartyID, t.logger)
+	rejected := make(map[string]bool)
+	inbound := t.transport.Receive(ctx, sessionID, localPartyID)
+	defer inbound.Close()
+	mpcWrapper := t.GetMPCKeygenWrapper()
+	for {
+		select {
+		case <-ctx.Done():
+			// set isKeygenFinished to true , so the other go routine can be stopped
+			t.isKeygenFinished.Store(true)
+			return "", "", protocolError(ctx, ErrRefreshTimeout, tracker, []string{sessionID}, parties)
+		case messages := <-inbound.Messages():
+			for _, message := range messages {
+				decodedBody, ok := t.acceptMessage(sessionID, localPartyID, message, inbound, tracker, rejected)
+				if !ok {
+					continue
+				}
+				t.logger.Infoln("Received message from", message.From)
+				isFinished, err := mpcWrapper.KeygenSessionInputMessage(handle, decodedBody)
+				if err != nil {
+					t.logger.Error("fail to apply input message", "error", err)
+					continue
+				}
+				if isFinished {
+					t.logger.Infoln("Refresh finished")
+					t.isKeygenFinished.Store(true)
+					result, err := mpcWrapper.KeygenSessionFinish(handle)
+					if err != nil {
+						return "", "", fmt.Errorf("fail to finish refresh: %w", err)
+					}
+					defer func() {
+						if err := mpcWrapper.KeyshareFree(result); err != nil {
+							t.logger.Error("failed to free keyshare", "error", err)
+						}
+					}()
+					buf, err := mpcWrapper.KeyshareToBytes(result)
+					if err != nil {
+						return "", "", fmt.Errorf("fail to convert keyshare to bytes: %w", err)
+					}
+					publicKeyBytes, err := mpcWrapper.KeysharePublicKey(result)
+					if err != nil {
+						return "", "", fmt.Errorf("fail to get public key: %w", err)
+					}
+					return hex.EncodeToString(publicKeyBytes), base64.StdEncoding.EncodeToString(buf), nil
+				}
+			}
+		}
+	}
+}
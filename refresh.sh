@@ -0,0 +1,19 @@
+#!/bin/bash
+
+# Check if the public key argument is provided
+if [ -z "$1" ]; then
+  echo "Usage: $0 <public_key>"
+  exit 1
+fi
+session=$RANDOM
+pubkey=$1
+echo "Refreshing ECDSA key, session: $session"
+# first party
+./test-dkls --key first --parties first,second,third --session $session --leader refresh --pubkey $pubkey &
+# second party
+./test-dkls --key second --parties first,second,third --session $session refresh --pubkey $pubkey &
+
+# third party
+./test-dkls --key third --parties first,second,third --session $session refresh --pubkey $pubkey &
+
+wait
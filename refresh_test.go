@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vultisig/test-dkls/relay"
+)
+
+func TestCommitRefresh(t *testing.T) {
+	ctx := context.Background()
+	relayServer := relay.NewServer()
+	parties := []string{"first", "second"}
+	newTss := func(accessor *memoryStateAccessor) *TssService {
+		tss, err := NewTssService(NewMemoryTransport(relayServer), accessor, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tss.SetTimeouts(Timeouts{Complete: 200 * time.Millisecond})
+		return tss
+	}
+	first := newMemoryStateAccessor()
+	if err := first.SaveLocalState("pubkey", "old keyshare"); err != nil {
+		t.Fatal(err)
+	}
+	keyshareOf := func(accessor *memoryStateAccessor, key string) string {
+		keyshare, err := accessor.GetLocalState(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keyshare
+	}
+
+	err := newTss(first).commitRefresh(ctx, "changed-key", "pubkey", "other pubkey", "new keyshare", "first", parties, 1)
+	if err == nil || !strings.Contains(err.Error(), "public key changed") {
+		t.Fatalf("expected public key changed, got %v", err)
+	}
+	if keyshareOf(first, "pubkey") != "old keyshare" {
+		t.Fatal("old keyshare should be kept when the public key changed")
+	}
+
+	// second never finishes the refresh, it may still have saved its new keyshare so the new one is kept pending
+	relayServer.Register("unfinished", parties)
+	err = newTss(first).commitRefresh(ctx, "unfinished", "pubkey", "pubkey", "new keyshare", "first", parties, 1)
+	if !errors.Is(err, ErrRefreshPending) {
+		t.Fatalf("expected pending refresh, got %v", err)
+	}
+	if keyshareOf(first, "pubkey") != "old keyshare" {
+		t.Fatal("old keyshare should be kept when a party didn't finish")
+	}
+	if keyshareOf(first, pendingKeyshareKey("pubkey")) != "new keyshare" {
+		t.Fatal("new keyshare should be kept pending when a party didn't finish")
+	}
+	relayServer.Register("another refresh", parties)
+	if err := newTss(first).Refresh(ctx, "another refresh", "pubkey", "first", parties, 1, false); !errors.Is(err, ErrRefreshPending) {
+		t.Fatalf("a new refresh should not start before the pending one is settled, got %v", err)
+	}
+	if err := newTss(first).RollbackPendingRefresh("pubkey"); err != nil {
+		t.Fatal(err)
+	}
+	if keyshareOf(first, "pubkey") != "old keyshare" || newTss(first).hasPendingRefresh("pubkey") {
+		t.Fatal("rollback should keep the old keyshare and drop the pending one")
+	}
+	if err := newTss(first).RollbackPendingRefresh("pubkey"); err == nil {
+		t.Fatal("rollback without a pending refresh should fail")
+	}
+	relayServer.Register("unfinished again", parties)
+	err = newTss(first).commitRefresh(ctx, "unfinished again", "pubkey", "pubkey", "new keyshare", "first", parties, 1)
+	if !errors.Is(err, ErrRefreshPending) {
+		t.Fatalf("expected pending refresh, got %v", err)
+	}
+	if err := newTss(first).CommitPendingRefresh("pubkey", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if keyshareOf(first, "pubkey") != "new keyshare" || newTss(first).hasPendingRefresh("pubkey") {
+		t.Fatal("commit should replace the old keyshare with the pending one")
+	}
+	if err := first.SaveLocalState("pubkey", "old keyshare"); err != nil {
+		t.Fatal(err)
+	}
+
+	relayServer.Register("finished", parties)
+	second := newMemoryStateAccessor()
+	errs := make(chan error, 2)
+	go func() {
+		errs <- newTss(second).commitRefresh(ctx, "finished", "pubkey", "pubkey", "new keyshare of second", "second", parties, 1)
+	}()
+	errs <- newTss(first).commitRefresh(ctx, "finished", "pubkey", "pubkey", "new keyshare", "first", parties, 1)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keyshareOf(first, "pubkey") != "new keyshare" || keyshareOf(second, "pubkey") != "new keyshare of second" {
+		t.Fatal("refreshed keyshares should be saved once all parties finished")
+	}
+}
+
+func TestRefreshThreshold(t *testing.T) {
+	ecdsaPublicKey := "02" + strings.Repeat("ab", 32)
+	store := NewDirectoryStateAccessor(t.TempDir(), "first", nil)
+	tss, err := NewTssService(NewMemoryTransport(relay.NewServer()), store, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a keyshare saved without threshold falls back to the flag
+	if threshold, err := tss.refreshThreshold(ecdsaPublicKey, 0, 3); err != nil || threshold != 2 {
+		t.Fatalf("expected the default threshold 2, got %d, %v", threshold, err)
+	}
+	if err := tss.saveKeyshare(ecdsaPublicKey, "keyshare", "first", []string{"first", "second", "third"}, 3); err != nil {
+		t.Fatal(err)
+	}
+	if threshold, err := tss.refreshThreshold(ecdsaPublicKey, 0, 3); err != nil || threshold != 3 {
+		t.Fatalf("expected the stored threshold 3, got %d, %v", threshold, err)
+	}
+	if _, err := tss.refreshThreshold(ecdsaPublicKey, 2, 3); !errors.Is(err, ErrThresholdMismatch) {
+		t.Fatalf("expected threshold mismatch, got %v", err)
+	}
+}
@@ -1,106 +1,150 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"time"
 )
 
-func RegisterSession(server, session, key string) error {
-	sessionUrl := server + "/" + session
+// sleepContext waits for d, it returns early with the error of ctx when ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// getParties reads the list of parties the relay returns for url
+func (h *HTTPTransport) getParties(ctx context.Context, url string) ([]string, error) {
+	resp, err := h.retryPolicy.request(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("response code is not 200 OK: %s", resp.Status)
+	}
+	buff, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read body: %w", err)
+	}
+	var parties []string
+	if err := json.Unmarshal(buff, &parties); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal body: %w", err)
+	}
+	return parties, nil
+}
+
+func (h *HTTPTransport) RegisterSession(ctx context.Context, session, key string) error {
+	sessionUrl := h.server + "/" + session
 	body := []byte("[\"" + key + "\"]")
-	bodyReader := bytes.NewReader(body)
-	resp, err := http.Post(sessionUrl, "application/json", bodyReader)
+	resp, err := h.retryPolicy.request(ctx, http.MethodPost, sessionUrl, body)
 	if err != nil {
 		return fmt.Errorf("fail to register session: %w", err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusCreated {
 		return fmt.Errorf("fail to register session: %s", resp.Status)
 	}
 	return nil
 }
-func StartSession(server string, session string, parties []string) error {
-	sessionUrl := server + "/start/" + session
-	body, err := json.Marshal(parties)
-	if err != nil {
-		return fmt.Errorf("fail to start session: %w", err)
+
+// WaitAllParties waits until exactly the given parties joined the session
+func (h *HTTPTransport) WaitAllParties(ctx context.Context, session string, parties []string) error {
+	sessionUrl := h.server + "/" + session
+	for {
+		joined, err := h.getParties(ctx, sessionUrl)
+		if err != nil {
+			return fmt.Errorf("fail to get session: %w", err)
+		}
+		allJoined := len(joined) == len(parties)
+		for _, party := range parties {
+			if !slices.Contains(joined, party) {
+				allJoined = false
+				break
+			}
+		}
+		if allJoined {
+			return nil
+		}
+		// backoff
+		if err := sleepContext(ctx, 2*time.Second); err != nil {
+			return fmt.Errorf("fail to wait for all parties, joined parties: %v: %w", joined, err)
+		}
 	}
-	bodyReader := bytes.NewReader(body)
-	client := http.Client{}
-	req, err := http.NewRequest(http.MethodPost, sessionUrl, bodyReader)
+}
+
+func (h *HTTPTransport) StartSession(ctx context.Context, session string, parties []string) error {
+	sessionUrl := h.server + "/start/" + session
+	body, err := json.Marshal(parties)
 	if err != nil {
 		return fmt.Errorf("fail to start session: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := client.Do(req)
+	resp, err := h.retryPolicy.request(ctx, http.MethodPost, sessionUrl, body)
 	if err != nil {
 		return fmt.Errorf("fail to start session: %w", err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("fail to start session: %s", resp.Status)
 	}
 	return nil
 }
 
-func WaitForSessionStart(server, session string) ([]string, error) {
-	sessionUrl := server + "/start/" + session
+func (h *HTTPTransport) WaitForSessionStart(ctx context.Context, session string) ([]string, error) {
+	sessionUrl := h.server + "/start/" + session
 
 	for {
-		resp, err := http.Get(sessionUrl)
+		parties, err := h.getParties(ctx, sessionUrl)
 		if err != nil {
 			return nil, fmt.Errorf("fail to get session: %w", err)
 		}
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("fail to get session: %s", resp.Status)
-		}
-		var parties []string
-		buff, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("fail to read session body: %w", err)
-		}
-		if err := json.Unmarshal(buff, &parties); err != nil {
-			return nil, fmt.Errorf("fail to unmarshal session body: %w", err)
-		}
-
 		if len(parties) > 0 {
 			return parties, nil
 		}
 
 		// backoff
-		time.Sleep(2 * time.Second)
+		if err := sleepContext(ctx, 2*time.Second); err != nil {
+			return nil, fmt.Errorf("fail to wait for session start: %w", err)
+		}
 	}
 }
-func UploadPayload(server string, sessionID string, payload string) error {
-	sessionUrl := server + "/setup-message/" + sessionID
-	body := []byte(payload)
-	bodyReader := bytes.NewReader(body)
-	resp, err := http.Post(sessionUrl, "application/json", bodyReader)
+func (h *HTTPTransport) UploadPayload(ctx context.Context, sessionID string, payload string) error {
+	sessionUrl := h.server + "/setup-message/" + sessionID
+	resp, err := h.retryPolicy.request(ctx, http.MethodPost, sessionUrl, []byte(payload))
 	if err != nil {
 		return fmt.Errorf("fail to upload payload: %w", err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusCreated {
 		return fmt.Errorf("fail to upload payload: %s", resp.Status)
 	}
 	return nil
 }
 
-func GetPayload(server string, sessionID string) (string, error) {
-	sessionUrl := server + "/setup-message/" + sessionID
-	resp, err := http.Get(sessionUrl)
+func (h *HTTPTransport) GetPayload(ctx context.Context, sessionID string) (string, error) {
+	sessionUrl := h.server + "/setup-message/" + sessionID
+	resp, err := h.retryPolicy.request(ctx, http.MethodGet, sessionUrl, nil)
 	if err != nil {
 		return "", fmt.Errorf("fail to get payload: %w", err)
 	}
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("fail to get payload: %s", resp.Status)
-	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
 			fmt.Println("fail to close response body", err)
 		}
 	}()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fail to get payload: %s", resp.Status)
+	}
 	result, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return "", fmt.Errorf("fail to read payload: %w", err)
@@ -108,3 +152,89 @@ func GetPayload(server string, sessionID string) (string, error) {
 
 	return string(result), nil
 }
+
+func (h *HTTPTransport) CompleteSession(ctx context.Context, sessionID string, localPartyID string) error {
+	sessionUrl := h.server + "/complete/" + sessionID
+	body, err := json.Marshal([]string{localPartyID})
+	if err != nil {
+		return fmt.Errorf("fail to complete session: %w", err)
+	}
+	resp, err := h.retryPolicy.request(ctx, http.MethodPost, sessionUrl, body)
+	if err != nil {
+		return fmt.Errorf("fail to complete session: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fail to complete session: %s", resp.Status)
+	}
+	return nil
+}
+
+// WaitForSessionComplete waits until all the given parties marked the session as completed, or ctx is done
+func (h *HTTPTransport) WaitForSessionComplete(ctx context.Context, sessionID string, parties []string) error {
+	sessionUrl := h.server + "/complete/" + sessionID
+	for {
+		completed, err := h.getParties(ctx, sessionUrl)
+		if err != nil {
+			return fmt.Errorf("fail to get completed parties: %w", err)
+		}
+		allCompleted := true
+		for _, party := range parties {
+			if !slices.Contains(completed, party) {
+				allCompleted = false
+				break
+			}
+		}
+		if allCompleted {
+			return nil
+		}
+		if err := sleepContext(ctx, time.Second); err != nil {
+			return fmt.Errorf("fail to wait for session complete, completed parties: %v: %w", completed, err)
+		}
+	}
+}
+
+var errHeartbeatNotSupported = errors.New("relay doesn't support heartbeats")
+
+// Heartbeat tells the relay the local party is alive
+func (h *HTTPTransport) Heartbeat(ctx context.Context, sessionID string, localPartyID string) error {
+	sessionUrl := h.server + "/heartbeat/" + sessionID
+	body, err := json.Marshal([]string{localPartyID})
+	if err != nil {
+		return fmt.Errorf("fail to send heartbeat: %w", err)
+	}
+	resp, err := h.retryPolicy.request(ctx, http.MethodPost, sessionUrl, body)
+	if err != nil {
+		return fmt.Errorf("fail to send heartbeat: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return errHeartbeatNotSupported
+	}
+	return fmt.Errorf("fail to send heartbeat: %s", resp.Status)
+}
+
+// Heartbeats returns how long ago each party of the session sent its last heartbeat
+func (h *HTTPTransport) Heartbeats(ctx context.Context, sessionID string) (map[string]time.Duration, error) {
+	sessionUrl := h.server + "/heartbeat/" + sessionID
+	resp, err := h.retryPolicy.request(ctx, http.MethodGet, sessionUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("fail to get heartbeats: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fail to get heartbeats: %s", resp.Status)
+	}
+	var ages map[string]int64
+	if err := json.NewDecoder(resp.Body).Decode(&ages); err != nil {
+		return nil, fmt.Errorf("fail to decode heartbeats: %w", err)
+	}
+	heartbeats := make(map[string]time.Duration, len(ages))
+	for party, age := range ages {
+		heartbeats[party] = time.Duration(age) * time.Millisecond
+	}
+	return heartbeats, nil
+}
@@ -0,0 +1,465 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Message is the relay wire format, it matches what MessengerImp posts
+type Message struct {
+	SessionID string   `json:"session_id,omitempty"`
+	From      string   `json:"from,omitempty"`
+	To        []string `json:"to,omitempty"`
+	Body      string   `json:"body,omitempty"`
+	// Hash is the id of the message, the receiver deletes the message by it
+	Hash      string `json:"hash,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	// SequenceNo numbers the messages from a sender to a receiver in a session, starting from 1
+	SequenceNo int64 `json:"sequence_no,omitempty"`
+}
+
+type session struct {
+	parties      []string
+	started      []string
+	completed    []string
+	setupMessage *string
+	messages     map[string][]Message
+	// heartbeats is when each party sent its last heartbeat
+	heartbeats map[string]time.Time
+	// changed is closed and replaced whenever the session changes, it wakes up the waiting parties
+	changed chan struct{}
+}
+
+// notify must be called with s.mu held
+func (sess *session) notify() {
+	close(sess.changed)
+	sess.changed = make(chan struct{})
+}
+
+// Server is an in-memory implementation of the relay. It serves the relay HTTP API, standalone
+// or mounted on an httptest.Server, and can be used directly by parties running in the same process.
+type Server struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	mux      *http.ServeMux
+	logger   *logrus.Logger
+}
+
+var _ http.Handler = &Server{}
+
+func NewServer() *Server {
+	s := &Server{
+		sessions: make(map[string]*session),
+		mux:      http.NewServeMux(),
+		logger:   logrus.WithField("service", "relay").Logger,
+	}
+	s.mux.HandleFunc("GET /ping", s.ping)
+	s.mux.HandleFunc("POST /{session}", s.registerSession)
+	s.mux.HandleFunc("GET /{session}", s.getSession)
+	s.mux.HandleFunc("DELETE /{session}", s.deleteSession)
+	s.mux.HandleFunc("POST /start/{session}", s.startSession)
+	s.mux.HandleFunc("GET /start/{session}", s.getStartedSession)
+	s.mux.HandleFunc("POST /complete/{session}", s.completeSession)
+	s.mux.HandleFunc("GET /complete/{session}", s.getCompletedSession)
+	s.mux.HandleFunc("POST /setup-message/{session}", s.uploadSetupMessage)
+	s.mux.HandleFunc("GET /setup-message/{session}", s.getSetupMessage)
+	s.mux.HandleFunc("POST /message/{session}", s.postMessage)
+	s.mux.HandleFunc("GET /message/{session}/{party}", s.getMessages)
+	s.mux.HandleFunc("DELETE /message/{session}/{party}/{hash}", s.deleteMessage)
+	s.mux.HandleFunc("POST /heartbeat/{session}", s.postHeartbeat)
+	s.mux.HandleFunc("GET /heartbeat/{session}", s.getHeartbeats)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// getOrCreateSession must be called with s.mu held
+func (s *Server) getOrCreateSession(sessionID string) *session {
+	sess, ok := s.sessions[sessionID]
+	if !ok {
+		sess = &session{
+			messages:   make(map[string][]Message),
+			heartbeats: make(map[string]time.Time),
+			changed:    make(chan struct{}),
+		}
+		s.sessions[sessionID] = sess
+	}
+	return sess
+}
+
+// Changed returns a channel that is closed on the next change of the session or when the session is deleted,
+// false when the session doesn't exist. Take it before reading the session state, so a change in between is not missed.
+func (s *Server) Changed(sessionID string) (<-chan struct{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[sessionID]
+	if !ok {
+		return nil, false
+	}
+	return sess.changed, true
+}
+
+// Register adds the parties to the session, the session is created when it doesn't exist
+func (s *Server) Register(sessionID string, parties []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := s.getOrCreateSession(sessionID)
+	for _, party := range parties {
+		if !slices.Contains(sess.parties, party) {
+			sess.parties = append(sess.parties, party)
+		}
+	}
+	sess.notify()
+}
+
+// Parties returns the parties registered to the session, false when the session doesn't exist
+func (s *Server) Parties(sessionID string) ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[sessionID]
+	if !ok {
+		return nil, false
+	}
+	return slices.Clone(sess.parties), true
+}
+
+func (s *Server) DeleteSession(sessionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[sessionID]; ok {
+		close(sess.changed)
+	}
+	delete(s.sessions, sessionID)
+}
+
+func (s *Server) Start(sessionID string, parties []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := s.getOrCreateSession(sessionID)
+	sess.started = parties
+	sess.notify()
+}
+
+// Started returns the parties the session is started with, it's empty until the session is started
+func (s *Server) Started(sessionID string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	started := []string{}
+	if sess, ok := s.sessions[sessionID]; ok && sess.started != nil {
+		started = slices.Clone(sess.started)
+	}
+	return started
+}
+
+func (s *Server) Complete(sessionID string, parties []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := s.getOrCreateSession(sessionID)
+	for _, party := range parties {
+		if !slices.Contains(sess.completed, party) {
+			sess.completed = append(sess.completed, party)
+		}
+	}
+	sess.notify()
+}
+
+func (s *Server) Completed(sessionID string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	completed := []string{}
+	if sess, ok := s.sessions[sessionID]; ok && sess.completed != nil {
+		completed = slices.Clone(sess.completed)
+	}
+	return completed
+}
+
+func (s *Server) SetSetupMessage(sessionID string, setupMessage string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := s.getOrCreateSession(sessionID)
+	sess.setupMessage = &setupMessage
+	sess.notify()
+}
+
+// SetupMessage returns the setup message of the session, false when it's not uploaded yet
+func (s *Server) SetupMessage(sessionID string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[sessionID]
+	if !ok || sess.setupMessage == nil {
+		return "", false
+	}
+	return *sess.setupMessage, true
+}
+
+// Post queues the message for each of its receivers, a message already queued for a receiver is not queued again
+func (s *Server) Post(sessionID string, message Message) {
+	if message.SessionID == "" {
+		message.SessionID = sessionID
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := s.getOrCreateSession(sessionID)
+	for _, to := range message.To {
+		// a sender retrying a request the relay already handled posts the message again
+		if message.Hash != "" && slices.ContainsFunc(sess.messages[to], func(m Message) bool {
+			return m.Hash == message.Hash
+		}) {
+			continue
+		}
+		sess.messages[to] = append(sess.messages[to], message)
+	}
+	sess.notify()
+}
+
+// Messages returns the messages queued for the party, false when the session doesn't exist
+func (s *Server) Messages(sessionID string, party string) ([]Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[sessionID]
+	if !ok {
+		return []Message{}, false
+	}
+	return append([]Message{}, sess.messages[party]...), true
+}
+
+// DeleteMessage removes the messages with the given hash from the queue of the party
+func (s *Server) DeleteMessage(sessionID string, party string, hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[sessionID]; ok {
+		sess.messages[party] = slices.DeleteFunc(sess.messages[party], func(m Message) bool {
+			return m.Hash == hash
+		})
+	}
+}
+
+// Heartbeat records that the parties are alive, it doesn't wake up the waiting parties
+func (s *Server) Heartbeat(sessionID string, parties []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := s.getOrCreateSession(sessionID)
+	for _, party := range parties {
+		sess.heartbeats[party] = time.Now()
+	}
+}
+
+// Heartbeats returns how long ago each party sent its last heartbeat, false when the session doesn't exist.
+// The ages are measured by the relay, so the clocks of the parties don't matter.
+func (s *Server) Heartbeats(sessionID string) (map[string]time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[sessionID]
+	if !ok {
+		return nil, false
+	}
+	result := make(map[string]time.Duration, len(sess.heartbeats))
+	for party, heartbeat := range sess.heartbeats {
+		result[party] = time.Since(heartbeat)
+	}
+	return result, true
+}
+
+func (s *Server) ping(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("relay is running"))
+}
+
+func (s *Server) registerSession(w http.ResponseWriter, r *http.Request) {
+	var parties []string
+	if err := json.NewDecoder(r.Body).Decode(&parties); err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	s.Register(r.PathValue("session"), parties)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) getSession(w http.ResponseWriter, r *http.Request) {
+	parties, ok := s.Parties(r.PathValue("session"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, parties)
+}
+
+func (s *Server) deleteSession(w http.ResponseWriter, r *http.Request) {
+	s.DeleteSession(r.PathValue("session"))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request) {
+	var parties []string
+	if err := json.NewDecoder(r.Body).Decode(&parties); err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	s.Start(r.PathValue("session"), parties)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) getStartedSession(w http.ResponseWriter, r *http.Request) {
+	// the session not being started yet is not an error, clients keep polling until the list is not empty
+	s.writeJSON(w, http.StatusOK, s.Started(r.PathValue("session")))
+}
+
+func (s *Server) completeSession(w http.ResponseWriter, r *http.Request) {
+	var parties []string
+	if err := json.NewDecoder(r.Body).Decode(&parties); err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	s.Complete(r.PathValue("session"), parties)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) getCompletedSession(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, s.Completed(r.PathValue("session")))
+}
+
+func (s *Server) uploadSetupMessage(w http.ResponseWriter, r *http.Request) {
+	buf, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "fail to read body", http.StatusBadRequest)
+		return
+	}
+	s.SetSetupMessage(r.PathValue("session"), string(buf))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) getSetupMessage(w http.ResponseWriter, r *http.Request) {
+	setupMessage, ok := s.SetupMessage(r.PathValue("session"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(setupMessage))
+}
+
+func (s *Server) postMessage(w http.ResponseWriter, r *http.Request) {
+	var message Message
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	s.Post(r.PathValue("session"), message)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) getMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Accept") == "text/event-stream" {
+		s.streamMessages(w, r)
+		return
+	}
+	messages, _ := s.Messages(r.PathValue("session"), r.PathValue("party"))
+	s.writeJSON(w, http.StatusOK, messages)
+}
+
+// streamMessages pushes the messages of a party as server-sent events. Messages stay queued until they are
+// deleted, so a client reconnecting receives the ones it has not acknowledged yet.
+func (s *Server) streamMessages(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	sessionID := r.PathValue("session")
+	party := r.PathValue("party")
+	if _, ok := s.Parties(sessionID); !ok {
+		// opening a stream doesn't create the session, the receiver connects again once it's registered
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	sent := make(map[string]bool)
+	// keep idle connections from being closed by proxies
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		changed, ok := s.Changed(sessionID)
+		if !ok {
+			// the session is deleted
+			return
+		}
+		pending, _ := s.Messages(sessionID, party)
+		for _, message := range pending {
+			if sent[message.Hash] {
+				continue
+			}
+			buf, err := json.Marshal(message)
+			if err != nil {
+				s.logger.Error("fail to marshal message", "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", buf); err != nil {
+				return
+			}
+			sent[message.Hash] = true
+		}
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) deleteMessage(w http.ResponseWriter, r *http.Request) {
+	s.DeleteMessage(r.PathValue("session"), r.PathValue("party"), r.PathValue("hash"))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) postHeartbeat(w http.ResponseWriter, r *http.Request) {
+	var parties []string
+	if err := json.NewDecoder(r.Body).Decode(&parties); err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	s.Heartbeat(r.PathValue("session"), parties)
+	w.WriteHeader(http.StatusOK)
+}
+
+// getHeartbeats answers with the milliseconds since the last heartbeat of each party
+func (s *Server) getHeartbeats(w http.ResponseWriter, r *http.Request) {
+	heartbeats, ok := s.Heartbeats(r.PathValue("session"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	result := make(map[string]int64, len(heartbeats))
+	for party, age := range heartbeats {
+		result[party] = age.Milliseconds()
+	}
+	s.writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v any) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		s.logger.Error("fail to marshal response", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(buf)
+}
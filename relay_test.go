@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vultisig/test-dkls/relay"
+)
+
+func TestRelayServer(t *testing.T) {
+	server := httptest.NewServer(relay.NewServer())
+	defer server.Close()
+	sessionID := "test-session"
+	parties := []string{"first", "second"}
+	ctx := context.Background()
+	transport := newHTTPTransport(t, server.URL)
+	for _, party := range parties {
+		if err := transport.RegisterSession(ctx, sessionID, party); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := transport.WaitAllParties(ctx, sessionID, parties); err != nil {
+		t.Fatal(err)
+	}
+	if err := transport.UploadPayload(ctx, sessionID, "setup"); err != nil {
+		t.Fatal(err)
+	}
+	if err := transport.StartSession(ctx, sessionID, parties); err != nil {
+		t.Fatal(err)
+	}
+	started, err := transport.WaitForSessionStart(ctx, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(started) != len(parties) {
+		t.Fatalf("expected %d parties, got %d", len(parties), len(started))
+	}
+	payload, err := transport.GetPayload(ctx, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload != "setup" {
+		t.Fatalf("expected setup message, got %s", payload)
+	}
+
+	messenger := NewMessageImp(transport, sessionID)
+	if err := messenger.Send(ctx, "first", "second", "aGVsbG8="); err != nil {
+		t.Fatal(err)
+	}
+	messages := getRelayMessages(t, server.URL+"/message/"+sessionID+"/second")
+	if len(messages) != 1 || messages[0].From != "first" || messages[0].Body != "aGVsbG8=" {
+		t.Fatalf("unexpected messages: %+v", messages)
+	}
+	if len(getRelayMessages(t, server.URL+"/message/"+sessionID+"/first")) != 0 {
+		t.Fatal("message should only be delivered to its receiver")
+	}
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"/message/"+sessionID+"/second/"+messages[0].Hash, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("fail to delete message: %s", resp.Status)
+	}
+	if len(getRelayMessages(t, server.URL+"/message/"+sessionID+"/second")) != 0 {
+		t.Fatal("message should be deleted")
+	}
+}
+
+func newHTTPTransport(t *testing.T, server string) *HTTPTransport {
+	transport, err := NewHTTPTransport(server, InboundPoll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transport
+}
+
+func getRelayMessages(t *testing.T, url string) []relay.Message {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("fail to get messages: %s", resp.Status)
+	}
+	var messages []relay.Message
+	if err := json.NewDecoder(resp.Body).Decode(&messages); err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+func TestSetupMessageIsRaw(t *testing.T) {
+	server := httptest.NewServer(relay.NewServer())
+	defer server.Close()
+	ctx := context.Background()
+	// the other clients of the relay expect the base64 setup message as it is, without any envelope
+	setupMessage := base64.StdEncoding.EncodeToString([]byte("setup"))
+	if err := newHTTPTransport(t, server.URL).UploadPayload(ctx, "test-session", setupMessage); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(server.URL + "/setup-message/test-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != setupMessage {
+		t.Fatalf("expected raw setup message %s, got %s", setupMessage, buf)
+	}
+}
+
+func TestMessageReceiver(t *testing.T) {
+	relayServer := relay.NewServer()
+	ctx := context.Background()
+	// a relay that doesn't know about streaming ignores the Accept header
+	plainRelayServer := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("Accept")
+		relayServer.ServeHTTP(w, r)
+	})
+	for name, tc := range map[string]struct {
+		handler   http.Handler
+		streaming bool
+	}{
+		"stream":          {handler: relayServer, streaming: true},
+		"poll":            {handler: relayServer, streaming: false},
+		"stream fallback": {handler: plainRelayServer, streaming: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(tc.handler)
+			defer server.Close()
+			sessionID := "test-session-" + name
+			if err := newHTTPTransport(t, server.URL).RegisterSession(ctx, sessionID, "second"); err != nil {
+				t.Fatal(err)
+			}
+			receiver := newRelayReceiver(ctx, server.URL, sessionID, "second", tc.streaming, DefaultRetryPolicy())
+			defer receiver.Close()
+			messenger := NewMessageImp(newHTTPTransport(t, server.URL), sessionID)
+			for _, body := range []string{"Zmlyc3Q=", "c2Vjb25k"} {
+				if err := messenger.Send(ctx, "first", "second", body); err != nil {
+					t.Fatal(err)
+				}
+				received := false
+				for !received {
+					select {
+					case messages := <-receiver.Messages():
+						// a poll racing with the previous ack may deliver an acknowledged message again
+						for _, message := range messages {
+							if err := receiver.Ack(message.Hash); err != nil {
+								t.Fatal(err)
+							}
+							received = received || message.Body == body
+						}
+					case <-time.After(5 * time.Second):
+						t.Fatal("message is not received")
+					}
+				}
+			}
+			if len(getRelayMessages(t, server.URL+"/message/"+sessionID+"/second")) != 0 {
+				t.Fatal("acknowledged messages should be deleted")
+			}
+		})
+	}
+}
+
+func TestMessageStreamUnknownSession(t *testing.T) {
+	relayServer := relay.NewServer()
+	server := httptest.NewServer(relayServer)
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/message/unknown-session/first", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for a stream of an unknown session, got %s", resp.Status)
+	}
+	if _, ok := relayServer.Parties("unknown-session"); ok {
+		t.Fatal("opening a stream should not create the session")
+	}
+}
@@ -1,21 +1,21 @@
 package main
 
 import (
-	"crypto/md5"
+	"context"
 	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
-	"github.com/vultisig/mobile-tss-lib/coordinator"
 )
 
+var ErrReshareTimeout = errors.New("reshare timeout")
+
 func (t *TssService) processReshareCommittee(oldParties []string, newParties []string) ([]string, []int, []int) {
 	var allParties []string
 	var oldPartiesIdx []int
@@ -40,11 +40,14 @@ func (t *TssService) processReshareCommittee(oldParties []string, newParties []s
 	return allParties, newPartiesIdx, oldPartiesIdx
 }
 
-func (t *TssService) Reshare(sessionID string,
+func (t *TssService) Reshare(ctx context.Context,
+	sessionID string,
 	publicKeyECDAS string,
+	chainCode string,
 	localPartyID string,
 	keygenCommittee []string,
 	oldKeygenCommittee []string,
+	threshold int,
 	isInitiateDevice bool) error {
 
 	if localPartyID == "" {
@@ -57,18 +60,47 @@ func (t *TssService) Reshare(sessionID string,
 	t.logger.WithFields(logrus.Fields{
 		"session_id":         sessionID,
 		"public_key_ecdsa":   publicKeyECDAS,
+		"chain_code":         chainCode,
 		"local_party_id":     localPartyID,
 		"keygen_committee":   keygenCommittee,
+		"threshold":          threshold,
 		"is_initiate_device": isInitiateDevice,
 	}).Info("Reshare")
+	threshold, err := ResolveThreshold(threshold, len(keygenCommittee))
+	if err != nil {
+		return fmt.Errorf("failed to get threshold: %w", err)
+	}
+	t.logger.Infof("Threshold is %v", threshold)
+	// an old party has the chain code next to its keyshare, a new party has to be given it
+	if chainCode == "" && publicKeyECDAS != "" {
+		chainCode, _ = t.localStateAccessor.GetLocalState(chainCodeKey(publicKeyECDAS))
+	}
+	if chainCode != "" {
+		chainCodeBytes, err := hex.DecodeString(chainCode)
+		if err != nil {
+			return fmt.Errorf("failed to decode chain code: %w", err)
+		}
+		if len(chainCodeBytes) != 32 {
+			return fmt.Errorf("chain code should be 32 bytes, got %d", len(chainCodeBytes))
+		}
+	} else if t.isEdDSA {
+		return fmt.Errorf("chain code is empty, a new party needs it to derive EdDSA keys")
+	}
 
-	if err := RegisterSession(t.relayServer, sessionID, localPartyID); err != nil {
+	joinCtx, cancelJoin := withTimeout(ctx, t.timeouts.Join)
+	defer cancelJoin()
+	if err := t.transport.RegisterSession(joinCtx, sessionID, localPartyID); err != nil {
 		return fmt.Errorf("failed to start session: %w", err)
 	}
 	allCommitteeMembers, oldPartyIdx, newPartyIdx := t.processReshareCommittee(keygenCommittee, oldKeygenCommittee)
 	t.logger.Infoln("All committee members:", allCommitteeMembers)
 	t.logger.Infoln("Old party index:", oldPartyIdx)
 	t.logger.Infoln("New party index:", newPartyIdx)
+	session, err := t.beginSession(OperationReshare, sessionID, localPartyID, allCommitteeMembers)
+	if err != nil {
+		return fmt.Errorf("failed to begin session: %w", err)
+	}
+	defer t.endSession(session)
 	var keyshareHandle Handle
 	if len(publicKeyECDAS) > 0 {
 		// we need to get the shares
@@ -92,44 +124,55 @@ func (t *TssService) Reshare(sessionID string,
 	}
 	var encodedSetupMsg string = ""
 	if isInitiateDevice {
-		if coordinator.WaitAllParties(allCommitteeMembers, t.relayServer, sessionID) != nil {
-			return fmt.Errorf("failed to wait for all parties to join")
+		if err := t.transport.WaitAllParties(joinCtx, sessionID, allCommitteeMembers); err != nil {
+			return fmt.Errorf("failed to wait for all parties to join: %w", err)
 		}
-
-		threshold, err := GetThreshold(len(keygenCommittee))
-		if err != nil {
-			return fmt.Errorf("failed to get threshold: %v", err)
-		}
-		t.logger.Infof("Threshold is %v", threshold+1)
-		setupMsg, err := mpcWrapper.QcSetupMsgNew(keyshareHandle, threshold+1, allCommitteeMembers, oldPartyIdx, newPartyIdx)
+		setupMsg, err := mpcWrapper.QcSetupMsgNew(keyshareHandle, threshold, t.partyNames(allCommitteeMembers), oldPartyIdx, newPartyIdx)
 		if err != nil {
 			return fmt.Errorf("failed to create setup message: %v", err)
 		}
 		encodedSetupMsg = base64.StdEncoding.EncodeToString(setupMsg)
 		t.logger.Infoln("setup message is:", encodedSetupMsg)
-		if err := UploadPayload(t.relayServer, sessionID, encodedSetupMsg); err != nil {
+		setupCtx, cancelSetup := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelSetup()
+		if err := t.transport.UploadPayload(setupCtx, sessionID, encodedSetupMsg); err != nil {
 			return fmt.Errorf("failed to upload setup message: %v", err)
 		}
+		if err := t.uploadThreshold(setupCtx, sessionID, localPartyID, threshold, setupMsg); err != nil {
+			return fmt.Errorf("failed to upload threshold: %w", err)
+		}
 
-		if err := StartSession(t.relayServer, sessionID, keygenCommittee); err != nil {
+		if err := t.transport.StartSession(setupCtx, sessionID, keygenCommittee); err != nil {
 			return fmt.Errorf("failed to start session: %w", err)
 		}
 	} else {
 		// wait for the keygen to start
-		_, err := WaitForSessionStart(t.relayServer, sessionID)
+		_, err := t.transport.WaitForSessionStart(joinCtx, sessionID)
 		if err != nil {
 			return fmt.Errorf("failed to wait for session to start: %w", err)
 		}
+		setupCtx, cancelSetup := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelSetup()
 		// retrieve the setup Message
-		encodedSetupMsg, err = GetPayload(t.relayServer, sessionID)
+		encodedSetupMsg, err = t.transport.GetPayload(setupCtx, sessionID)
+		if err != nil {
+			return fmt.Errorf("failed to get setup message: %w", err)
+		}
 	}
 
 	setupMessageBytes, err := base64.StdEncoding.DecodeString(encodedSetupMsg)
 	if err != nil {
 		return fmt.Errorf("failed to decode setup message: %w", err)
 	}
+	if !isInitiateDevice {
+		verifyCtx, cancelVerify := withTimeout(ctx, t.timeouts.Setup)
+		defer cancelVerify()
+		if err := t.verifyThreshold(verifyCtx, sessionID, allCommitteeMembers, threshold, setupMessageBytes); err != nil {
+			return fmt.Errorf("failed to verify setup message: %w", err)
+		}
+	}
 	handle, err := mpcWrapper.QcSessionFromSetup(setupMessageBytes,
-		localPartyID,
+		t.partyName(localPartyID),
 		keyshareHandle)
 	if err != nil {
 		return fmt.Errorf("failed to create session from setup message: %w", err)
@@ -139,24 +182,33 @@ func (t *TssService) Reshare(sessionID string,
 	//		t.logger.Error("failed to free keygen session", "error", err)
 	//	}
 	// }()
+	protocolCtx, cancelProtocol := withTimeout(ctx, t.timeouts.Protocol)
+	defer cancelProtocol()
+	// the protocol stalls on a message that can't be delivered, so a failed outbound aborts it
+	protocolCtx, abortProtocol := context.WithCancelCause(protocolCtx)
+	defer abortProtocol(nil)
+	go t.watchParties(protocolCtx, abortProtocol, sessionID, localPartyID, allCommitteeMembers)
+	t.isKeygenFinished.Store(false)
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
 	go func() {
-		if err := t.processQcOutbound(handle, sessionID, keygenCommittee, localPartyID, wg); err != nil {
+		if err := t.processQcOutbound(protocolCtx, handle, sessionID, keygenCommittee, localPartyID, wg); err != nil {
 			t.logger.Error("failed to process keygen outbound", "error", err)
+			abortProtocol(err)
 		}
 	}()
-	err = t.processQcInbound(handle, sessionID, localPartyID, wg)
+	err = t.processQcInbound(protocolCtx, handle, sessionID, localPartyID, chainCode, allCommitteeMembers, keygenCommittee, threshold, wg)
 	wg.Wait()
 	return err
 }
 
-func (t *TssService) processQcOutbound(handle Handle,
+func (t *TssService) processQcOutbound(ctx context.Context,
+	handle Handle,
 	sessionID string, parties []string,
 	localPartyID string,
 	wg *sync.WaitGroup) error {
 	defer wg.Done()
-	messenger := NewMessageImp(t.relayServer, sessionID)
+	messenger := t.newMessenger(sessionID)
 	mpcKeygenWrapper := t.GetMPCKeygenWrapper()
 	for {
 		outbound, err := mpcKeygenWrapper.QcSessionOutputMessage(handle)
@@ -183,79 +235,38 @@ func (t *TssService) processQcOutbound(handle Handle,
 
 			t.logger.Infoln("Sending message to", receiver)
 			// send the message to the receiver
-			if err := messenger.Send(localPartyID, receiver, encodedOutbound); err != nil {
-				t.logger.Errorf("failed to send message: %v", err)
+			if err := messenger.Send(ctx, localPartyID, t.relayPartyID(receiver), encodedOutbound); err != nil {
+				return fmt.Errorf("failed to send message to %s: %w", receiver, err)
 			}
 		}
 	}
 }
 
-func (t *TssService) processQcInbound(handle Handle,
+func (t *TssService) processQcInbound(ctx context.Context,
+	handle Handle,
 	sessionID string,
 	localPartyID string,
+	chainCode string,
+	parties []string,
+	keygenCommittee []string,
+	threshold int,
 	wg *sync.WaitGroup) error {
 	defer wg.Done()
-	cache := make(map[string]bool)
+	tracker := newInboundTracker(localPartyID, t.logger)
+	rejected := make(map[string]bool)
+	inbound := t.transport.Receive(ctx, sessionID, localPartyID)
+	defer inbound.Close()
 	mpcKeygenWrapper := t.GetMPCKeygenWrapper()
 	for {
 		select {
-		case <-time.After(time.Minute):
+		case <-ctx.Done():
 			// set isKeygenFinished to true , so the other go routine can be stopped
 			t.isKeygenFinished.Store(true)
-			return TssKeyGenTimeout
-		case <-time.After(time.Millisecond * 100):
-			resp, err := http.Get(t.relayServer + "/message/" + sessionID + "/" + localPartyID)
-			if err != nil {
-				t.logger.Error("fail to get data from server", "error", err)
-				continue
-			}
-			if resp.StatusCode != http.StatusOK {
-				t.logger.Debug("fail to get data from server", "status", resp.Status)
-				continue
-			}
-			decoder := json.NewDecoder(resp.Body)
-			var messages []struct {
-				SessionID string   `json:"session_id,omitempty"`
-				From      string   `json:"from,omitempty"`
-				To        []string `json:"to,omitempty"`
-				Body      string   `json:"body,omitempty"`
-			}
-			if err := decoder.Decode(&messages); err != nil {
-				if err != io.EOF {
-					t.logger.Error("fail to decode messages", "error", err)
-				}
-				continue
-			}
+			return protocolError(ctx, ErrReshareTimeout, tracker, []string{sessionID}, parties)
+		case messages := <-inbound.Messages():
 			for _, message := range messages {
-				if message.From == localPartyID {
-					continue
-				}
-
-				hash := md5.Sum([]byte(message.Body))
-				hashStr := hex.EncodeToString(hash[:])
-
-				client := http.Client{}
-				req, err := http.NewRequest(http.MethodDelete, t.relayServer+"/message/"+sessionID+"/"+localPartyID+"/"+hashStr, nil)
-				if err != nil {
-					t.logger.Error("fail to delete message", "error", err)
-					continue
-				}
-				resp, err := client.Do(req)
-				if err != nil {
-					t.logger.Error("fail to delete message", "error", err)
-					continue
-				}
-				if resp.StatusCode != http.StatusOK {
-					t.logger.Error("fail to delete message", "status", resp.Status)
-					continue
-				}
-				if _, ok := cache[hashStr]; ok {
-					continue
-				}
-				cache[hashStr] = true
-				decodedBody, err := base64.StdEncoding.DecodeString(message.Body)
-				if err != nil {
-					t.logger.Error("fail to decode message", "error", err)
+				decodedBody, ok := t.acceptMessage(sessionID, localPartyID, message, inbound, tracker, rejected)
+				if !ok {
 					continue
 				}
 				t.logger.Infoln("Received message from", message.From)
@@ -266,6 +277,11 @@ func (t *TssService) processQcInbound(handle Handle,
 				}
 				if isFinished {
 					t.logger.Infoln("Reshare finished")
+					if !slices.Contains(keygenCommittee, localPartyID) {
+						// a party leaving the committee doesn't get a keyshare
+						t.isKeygenFinished.Store(true)
+						return nil
+					}
 					result, err := mpcKeygenWrapper.QcSessionFinish(handle)
 					if err != nil {
 						t.logger.Error("fail to finish keygen", "error", err)
@@ -283,10 +299,27 @@ func (t *TssService) processQcInbound(handle Handle,
 						return err
 					}
 					encodedPublicKey := hex.EncodeToString(publicKeyECDSABytes)
-					t.logger.Infof("Public key: %s, keyshare: %s", encodedPublicKey, encodedShare)
+					t.logger.Infof("Public key: %s", encodedPublicKey)
 					// This sleep give the local party a chance to send last message to others
 					t.isKeygenFinished.Store(true)
-					return t.localStateAccessor.SaveLocalState(encodedPublicKey, encodedShare)
+					// the public key stays the same, the chain code is saved for the parties new to the committee.
+					// The ECDSA keyshare keeps its chain code, it has to be the one the old parties had
+					if !t.isEdDSA {
+						keyshareChainCode, err := mpcKeygenWrapper.KeyshareChainCode(result)
+						if err != nil {
+							return fmt.Errorf("fail to get chain code: %w", err)
+						}
+						if chainCode != "" && !strings.EqualFold(chainCode, hex.EncodeToString(keyshareChainCode)) {
+							return fmt.Errorf("chain code of keyshare %s is %x, expect %s", encodedPublicKey, keyshareChainCode, chainCode)
+						}
+						chainCode = hex.EncodeToString(keyshareChainCode)
+					}
+					if chainCode != "" {
+						if err := t.localStateAccessor.SaveLocalState(chainCodeKey(encodedPublicKey), chainCode); err != nil {
+							return fmt.Errorf("fail to save chain code: %w", err)
+						}
+					}
+					return t.saveKeyshare(encodedPublicKey, encodedShare, localPartyID, keygenCommittee, threshold)
 				}
 			}
 		}
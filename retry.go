@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy is how the requests to the relay server are retried. A request is sent again on network errors
+// and retryable status codes, with a jittered exponential backoff, until it runs out of attempts or budget.
+// Any other response goes back to the caller.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request is sent, including the first one
+	MaxAttempts int
+	// BaseDelay is the backoff before the first retry, it doubles on every retry up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Budget bounds the time spent on a request and its retries, there is no bound when it's 0
+	Budget time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    2 * time.Second,
+		Budget:      10 * time.Second,
+	}
+}
+
+// backoff is the delay before the given retry, half of it is random so the parties retrying together
+// don't hit the relay at the same time again
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.MaxDelay
+	if retry < 32 && p.BaseDelay<<retry < p.MaxDelay {
+		delay = p.BaseDelay << retry
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// retryableStatus tells whether a request failed with the status code may succeed when it's sent again,
+// the other error codes are fatal
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout,
+		http.StatusTooEarly,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// request sends a request to the relay server, the request is canceled with ctx. The request is retried
+// as the policy says, so the relay must handle a request it receives twice.
+func (policy RetryPolicy) request(ctx context.Context, method string, url string, body []byte) (*http.Response, error) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		resp, err := sendRelayRequest(ctx, method, url, body)
+		if err == nil && !retryableStatus(resp.StatusCode) {
+			return resp, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("response code is %s", resp.Status)
+		} else if ctx.Err() != nil {
+			return nil, err
+		}
+		if attempt >= policy.MaxAttempts {
+			return nil, fmt.Errorf("fail to %s %s after %d attempts: %w", method, url, attempt, err)
+		}
+		delay := policy.backoff(attempt - 1)
+		if policy.Budget > 0 && time.Since(start)+delay > policy.Budget {
+			return nil, fmt.Errorf("fail to %s %s, retry budget %v is used up after %d attempts: %w", method, url, policy.Budget, attempt, err)
+		}
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, fmt.Errorf("fail to %s %s: %w", method, url, err)
+		}
+	}
+}
+
+func sendRelayRequest(ctx context.Context, method string, url string, body []byte) (*http.Response, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return http.DefaultClient.Do(req)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vultisig/test-dkls/relay"
+)
+
+func TestRelayRequestRetry(t *testing.T) {
+	relayServer := relay.NewServer()
+	var failures, attempts atomic.Int32
+	// the relay handles the message, but the response is lost twice
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		relayServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		if failures.Add(1) <= 2 {
+			relayServer.ServeHTTP(httptest.NewRecorder(), r)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		relayServer.ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+	ctx := context.Background()
+	sessionID := "test-session"
+
+	if err := newHTTPTransport(t, flaky.URL).RegisterSession(ctx, sessionID, "second"); err != nil {
+		t.Fatal(err)
+	}
+	if attempts.Load() != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts.Load())
+	}
+	failures.Store(0)
+	if err := NewMessageImp(newHTTPTransport(t, flaky.URL), sessionID).Send(ctx, "first", "second", "aGVsbG8="); err != nil {
+		t.Fatal(err)
+	}
+	if messages, _ := relayServer.Messages(sessionID, "second"); len(messages) != 1 {
+		t.Fatalf("retried message should be queued once, got %+v", messages)
+	}
+
+	// a fatal status code is not retried
+	attempts.Store(0)
+	if _, err := newHTTPTransport(t, server.URL).GetPayload(ctx, "unknown-session"); err == nil {
+		t.Fatal("missing setup message should fail")
+	}
+	if attempts.Load() != 1 {
+		t.Fatalf("expected 1 attempt, got %d", attempts.Load())
+	}
+}
+
+func TestRelayRequestRetryBudget(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	transport := newHTTPTransport(t, server.URL)
+
+	transport.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond})
+	if err := transport.UploadPayload(context.Background(), "test-session", "setup"); err == nil {
+		t.Fatal("unavailable relay should fail")
+	}
+	if attempts.Load() != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts.Load())
+	}
+
+	attempts.Store(0)
+	transport.SetRetryPolicy(RetryPolicy{MaxAttempts: 100, BaseDelay: 50 * time.Millisecond, MaxDelay: 50 * time.Millisecond, Budget: 200 * time.Millisecond})
+	start := time.Now()
+	if err := transport.UploadPayload(context.Background(), "test-session", "setup"); err == nil {
+		t.Fatal("unavailable relay should fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second || attempts.Load() >= 100 {
+		t.Fatalf("retry budget is not respected, %d attempts in %v", attempts.Load(), elapsed)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for retry, maxDelay := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		delay := policy.backoff(retry)
+		if delay < maxDelay/2 || delay > maxDelay {
+			t.Fatalf("backoff of retry %d is %v, expect between %v and %v", retry, delay, maxDelay/2, maxDelay)
+		}
+	}
+	if delay := policy.backoff(100); delay > time.Second {
+		t.Fatalf("backoff should not exceed max delay, got %v", delay)
+	}
+}
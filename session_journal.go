@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	OperationKeygen       = "keygen"
+	OperationKeysign      = "keysign"
+	OperationKeysignBatch = "keysign-batch"
+	OperationPresign      = "presign"
+	OperationReshare      = "reshare"
+	OperationRefresh      = "refresh"
+	OperationMigrate      = "migrate"
+)
+
+var ErrSessionInterrupted = errors.New("session was interrupted")
+
+// SessionRecord marks a session the local party is taking part in. Sessions are detected and refused, not
+// resumed: the wrapper can't snapshot or restore the state of a protocol session, so a party restarted in the
+// middle of a session can't rejoin it, the other parties already got messages from the lost protocol session.
+// For the same reason the setup message and the ids of the processed messages are not saved, nothing could
+// continue from them. The record is there so the restarted party fails fast, with the operation and the time
+// it was interrupted, instead of waiting for the session to time out. The committee has to start a new session.
+type SessionRecord struct {
+	SessionID    string    `json:"session_id"`
+	Operation    string    `json:"operation"`
+	LocalPartyID string    `json:"local_party_id"`
+	Committee    []string  `json:"committee"`
+	StartedAt    time.Time `json:"started_at"`
+}
+
+// SessionJournal keeps the records of the sessions the local party is taking part in, one file per session
+// in dir. A record is written once when the operation starts and removed when it returns, a record left
+// behind is a session the party was stopped in, it's refused when the party is asked to join it again.
+type SessionJournal struct {
+	dir string
+}
+
+func NewSessionJournal(dir string) *SessionJournal {
+	return &SessionJournal{
+		dir: dir,
+	}
+}
+
+func (j *SessionJournal) fileName(sessionID, localPartyID string) (string, error) {
+	if strings.ContainsAny(sessionID+localPartyID, `/\`) {
+		return "", fmt.Errorf("invalid session id %s or party %s", sessionID, localPartyID)
+	}
+	return filepath.Join(j.dir, sessionID+"-"+localPartyID+".session.json"), nil
+}
+
+// Load returns the record of the session, nil when there is none
+func (j *SessionJournal) Load(sessionID, localPartyID string) (*SessionRecord, error) {
+	fileName, err := j.fileName(sessionID, localPartyID)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fail to read file %s: %w", fileName, err)
+	}
+	var record SessionRecord
+	if err := json.Unmarshal(buf, &record); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal file %s: %w", fileName, err)
+	}
+	return &record, nil
+}
+
+func (j *SessionJournal) Save(record *SessionRecord) error {
+	fileName, err := j.fileName(record.SessionID, record.LocalPartyID)
+	if err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("fail to marshal session record: %w", err)
+	}
+	if err := os.MkdirAll(j.dir, 0700); err != nil {
+		return fmt.Errorf("fail to create directory %s: %w", j.dir, err)
+	}
+	return writeFileAtomic(fileName, buf, 0600)
+}
+
+func (j *SessionJournal) Delete(sessionID, localPartyID string) error {
+	fileName, err := j.fileName(sessionID, localPartyID)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("fail to delete file %s: %w", fileName, err)
+	}
+	return nil
+}
+
+// SetSessionJournal makes the service record the sessions it takes part in, so a restarted party fails fast
+// when it's asked to rejoin one of them. Sessions are not recorded when journal is nil.
+func (t *TssService) SetSessionJournal(journal *SessionJournal) {
+	t.journal = journal
+}
+
+// beginSession records the session before the local party joins it. It fails when the session is already
+// recorded, the party was stopped in the middle of it and the protocol state is lost.
+func (t *TssService) beginSession(operation string,
+	sessionID string,
+	localPartyID string,
+	committee []string) (*SessionRecord, error) {
+	if t.journal == nil {
+		return nil, nil
+	}
+	record, err := t.journal.Load(sessionID, localPartyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load session record: %w", err)
+	}
+	if record != nil {
+		return nil, fmt.Errorf("%w: %s was stopped during the %s of session %s started at %s, start a new session",
+			ErrSessionInterrupted, localPartyID, record.Operation, sessionID, record.StartedAt.Format(time.RFC3339))
+	}
+	record = &SessionRecord{
+		SessionID:    sessionID,
+		Operation:    operation,
+		LocalPartyID: localPartyID,
+		Committee:    committee,
+		StartedAt:    time.Now().UTC(),
+	}
+	if err := t.journal.Save(record); err != nil {
+		return nil, fmt.Errorf("failed to save session record: %w", err)
+	}
+	return record, nil
+}
+
+// endSession removes the record of a session once the operation returned, whether it succeeded or not
+func (t *TssService) endSession(record *SessionRecord) {
+	if record == nil {
+		return
+	}
+	if err := t.journal.Delete(record.SessionID, record.LocalPartyID); err != nil {
+		t.logger.Error("fail to delete session record", "error", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vultisig/test-dkls/relay"
+)
+
+func TestSessionJournal(t *testing.T) {
+	journal := NewSessionJournal(filepath.Join(t.TempDir(), "sessions"))
+	if record, err := journal.Load("session", "first"); err != nil || record != nil {
+		t.Fatalf("expected no record, got %v, %v", record, err)
+	}
+	record := &SessionRecord{
+		SessionID:    "session",
+		Operation:    OperationKeygen,
+		LocalPartyID: "first",
+		Committee:    []string{"first", "second"},
+	}
+	if err := journal.Save(record); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := journal.Load("session", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Operation != OperationKeygen || len(loaded.Committee) != 2 {
+		t.Fatalf("record changed after reload: %+v", loaded)
+	}
+	if err := journal.Delete("session", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if record, err := journal.Load("session", "first"); err != nil || record != nil {
+		t.Fatalf("expected deleted record, got %v, %v", record, err)
+	}
+	if _, err := journal.Load("../session", "first"); err == nil {
+		t.Fatal("session id with a path separator should be rejected")
+	}
+}
+
+func TestInterruptedSession(t *testing.T) {
+	dir := t.TempDir()
+	committee := []string{"first", "second"}
+	// restart returns the service of a party restarted with the same session directory
+	restart := func() *TssService {
+		tss, err := NewTssService(NewMemoryTransport(relay.NewServer()), newMemoryStateAccessor(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tss.SetSessionJournal(NewSessionJournal(dir))
+		return tss
+	}
+
+	tss := restart()
+	record, err := tss.beginSession(OperationKeysign, "session", "second", committee)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the party stopped before the operation returned, it must not rejoin the session
+	_, err = restart().beginSession(OperationKeysign, "session", "second", committee)
+	if !errors.Is(err, ErrSessionInterrupted) {
+		t.Fatalf("expected session interrupted, got %v", err)
+	}
+	if _, err := restart().beginSession(OperationKeysign, "other session", "second", committee); err != nil {
+		t.Fatalf("a new session should start, got %v", err)
+	}
+
+	tss.endSession(record)
+	if _, err := os.Stat(filepath.Join(dir, "session-second.session.json")); !os.IsNotExist(err) {
+		t.Fatalf("expected session record to be deleted, got %v", err)
+	}
+}
+
+func TestSessionRecordRemovedOnError(t *testing.T) {
+	dir := t.TempDir()
+	relayServer := relay.NewServer()
+	tss, err := NewTssService(NewMemoryTransport(relayServer), newMemoryStateAccessor(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tss.SetSessionJournal(NewSessionJournal(dir))
+	// the keyshare doesn't exist, so keysign fails after the session is recorded
+	relayServer.Register("session", []string{"first", "second"})
+	if _, err := tss.Keysign(context.Background(), "session", "unknown", "message", "", "", "m/44'/60'/0'/0/0", "first", []string{"first", "second"}, false); err == nil {
+		t.Fatal("expected keysign to fail")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "session-first.session.json")); !os.IsNotExist(err) {
+		t.Fatalf("expected session record to be deleted after the error, got %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var ErrThresholdMismatch = errors.New("threshold mismatch")
+
+// thresholdSessionID is the relay session the leader uploads the threshold attestation of a setup message to,
+// the setup message itself stays as it is for the other clients of the relay
+func thresholdSessionID(sessionID string) string {
+	return sessionID + "-threshold"
+}
+
+// ThresholdAttestation binds the threshold the leader put in a setup message to that setup message. The wrapper
+// can't decode the threshold of a setup message, so the other parties check the attestation instead. It's signed
+// with the identity key of the leader when identity keys are configured, and authenticated with a key derived
+// from the encryption key when messages are encrypted. Otherwise the relay is trusted with it, as it's trusted
+// with the messages.
+type ThresholdAttestation struct {
+	Threshold int    `json:"threshold"`
+	SetupHash string `json:"setup_hash"`
+	From      string `json:"from"`
+	Signature string `json:"signature,omitempty"`
+	MAC       string `json:"mac,omitempty"`
+}
+
+func thresholdAttestationPayload(sessionID string, from string, threshold int, setupHash string) []byte {
+	return []byte(strings.Join([]string{sessionID, from, strconv.Itoa(threshold), setupHash}, "\x00"))
+}
+
+func (t *TssService) thresholdMAC(sessionID string, payload []byte) ([]byte, error) {
+	key, err := deriveSessionKey(t.encryptionKey, sessionID, keyPurposeThreshold)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(payload)
+	return h.Sum(nil), nil
+}
+
+// uploadThreshold attests the threshold of the setup message the leader uploaded
+func (t *TssService) uploadThreshold(ctx context.Context, sessionID string, localPartyID string, threshold int, setupMsg []byte) error {
+	setupHash := sha256.Sum256(setupMsg)
+	attestation := ThresholdAttestation{
+		Threshold: threshold,
+		SetupHash: hex.EncodeToString(setupHash[:]),
+		From:      localPartyID,
+	}
+	payload := thresholdAttestationPayload(sessionID, localPartyID, threshold, attestation.SetupHash)
+	if t.identityKey != nil {
+		attestation.Signature = hex.EncodeToString(ed25519.Sign(t.identityKey, payload))
+	}
+	if t.encryptionKey != nil {
+		mac, err := t.thresholdMAC(sessionID, payload)
+		if err != nil {
+			return err
+		}
+		attestation.MAC = hex.EncodeToString(mac)
+	}
+	buf, err := json.Marshal(attestation)
+	if err != nil {
+		return fmt.Errorf("fail to marshal threshold attestation: %w", err)
+	}
+	return t.transport.UploadPayload(ctx, thresholdSessionID(sessionID), string(buf))
+}
+
+// verifyThreshold checks that the leader made the setup message with the threshold the local party expects
+func (t *TssService) verifyThreshold(ctx context.Context, sessionID string, committee []string, threshold int, setupMsg []byte) error {
+	buf, err := t.transport.GetPayload(ctx, thresholdSessionID(sessionID))
+	if err != nil {
+		return fmt.Errorf("fail to get threshold attestation: %w", err)
+	}
+	var attestation ThresholdAttestation
+	if err := json.Unmarshal([]byte(buf), &attestation); err != nil {
+		return fmt.Errorf("fail to unmarshal threshold attestation: %w", err)
+	}
+	if !slices.Contains(committee, attestation.From) {
+		return fmt.Errorf("threshold is attested by %s, who is not in the committee", attestation.From)
+	}
+	setupHash := sha256.Sum256(setupMsg)
+	if attestation.SetupHash != hex.EncodeToString(setupHash[:]) {
+		return fmt.Errorf("threshold attestation is not for this setup message")
+	}
+	payload := thresholdAttestationPayload(sessionID, attestation.From, attestation.Threshold, attestation.SetupHash)
+	if len(t.partyKeys) > 0 {
+		publicKey, ok := t.partyKeys[attestation.From]
+		if !ok {
+			return fmt.Errorf("%w: unknown sender %s of threshold attestation", ErrInvalidMessageSignature, attestation.From)
+		}
+		signature, err := hex.DecodeString(attestation.Signature)
+		if err != nil || !ed25519.Verify(publicKey, payload, signature) {
+			return fmt.Errorf("%w: threshold attestation from %s", ErrInvalidMessageSignature, attestation.From)
+		}
+	}
+	if t.encryptionKey != nil {
+		expected, err := t.thresholdMAC(sessionID, payload)
+		if err != nil {
+			return err
+		}
+		mac, err := hex.DecodeString(attestation.MAC)
+		if err != nil || !hmac.Equal(mac, expected) {
+			return fmt.Errorf("threshold attestation from %s is not authenticated by the encryption key", attestation.From)
+		}
+	}
+	if attestation.Threshold != threshold {
+		return fmt.Errorf("%w: setup message of %s has threshold %d, expect %d", ErrThresholdMismatch, attestation.From, attestation.Threshold, threshold)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vultisig/test-dkls/relay"
+)
+
+func TestVerifyThreshold(t *testing.T) {
+	ctx := context.Background()
+	committee := []string{"first", "second"}
+	setupMsg := []byte("setup message")
+	dir := t.TempDir()
+	var partyKeys []string
+	for _, party := range committee {
+		publicKey, err := GenerateIdentityKey(filepath.Join(dir, party+".key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		partyKeys = append(partyKeys, party+"="+publicKey)
+	}
+	encryptionKey := strings.Repeat("ab", 32)
+	for name, configure := range map[string]func(tss *TssService, party string) error{
+		"plain": func(tss *TssService, party string) error {
+			return nil
+		},
+		"identity keys": func(tss *TssService, party string) error {
+			return tss.SetIdentityKeys(party, filepath.Join(dir, party+".key"), partyKeys)
+		},
+		"encryption key": func(tss *TssService, party string) error {
+			return tss.SetEncryptionKey(encryptionKey)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			relayServer := relay.NewServer()
+			newTss := func(party string) *TssService {
+				tss, err := NewTssService(NewMemoryTransport(relayServer), newMemoryStateAccessor(), false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := configure(tss, party); err != nil {
+					t.Fatal(err)
+				}
+				return tss
+			}
+			leader, follower := newTss("first"), newTss("second")
+			if err := leader.uploadThreshold(ctx, "session", "first", 2, setupMsg); err != nil {
+				t.Fatal(err)
+			}
+			if err := follower.verifyThreshold(ctx, "session", committee, 2, setupMsg); err != nil {
+				t.Fatal(err)
+			}
+			if err := follower.verifyThreshold(ctx, "session", committee, 1, setupMsg); !errors.Is(err, ErrThresholdMismatch) {
+				t.Fatalf("expected threshold mismatch, got %v", err)
+			}
+			if err := follower.verifyThreshold(ctx, "session", committee, 2, []byte("other setup message")); err == nil {
+				t.Fatal("attestation of another setup message should be rejected")
+			}
+			if err := follower.verifyThreshold(ctx, "session", []string{"second", "third"}, 2, setupMsg); err == nil {
+				t.Fatal("attestation from outside the committee should be rejected")
+			}
+
+			// the relay rewrites the threshold of the attestation
+			payload, _ := relayServer.SetupMessage(thresholdSessionID("session"))
+			relayServer.SetSetupMessage(thresholdSessionID("session"), strings.Replace(payload, `"threshold":2`, `"threshold":1`, 1))
+			err := follower.verifyThreshold(ctx, "session", committee, 1, setupMsg)
+			if name == "plain" {
+				if err != nil {
+					t.Fatalf("without keys the relay is trusted with the threshold, got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("a threshold changed by the relay should be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	shareEncryptionVersion = 1
+	kdfArgon2id            = "argon2id"
+	kdfNone                = "none"
+	// argon2id parameters recommended by RFC 9106 for memory constrained environments
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+)
+
+var ErrShareNotEncrypted = errors.New("keyshare is not encrypted")
+
+// ShareCipher seals keyshares at rest with AES-256-GCM. The key is either derived from a passphrase
+// with argon2id and a random salt per file, or read from a key file.
+type ShareCipher struct {
+	passphrase []byte
+	key        []byte
+}
+
+// encryptedShare is the content of an encrypted keyshare file
+type encryptedShare struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Salt       string `json:"salt,omitempty"`
+	Time       uint32 `json:"time,omitempty"`
+	Memory     uint32 `json:"memory,omitempty"`
+	Threads    uint8  `json:"threads,omitempty"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// LoadShareCipher creates the share cipher from a passphrase file or a key file holding a hex encoded 32 bytes key.
+// It returns nil when neither is set, keyshares are stored in clear text then.
+func LoadShareCipher(passphraseFile string, keyFile string) (*ShareCipher, error) {
+	switch {
+	case passphraseFile != "" && keyFile != "":
+		return nil, fmt.Errorf("only one of passphrase file and key file can be set")
+	case passphraseFile != "":
+		buf, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("fail to read passphrase file %s: %w", passphraseFile, err)
+		}
+		passphrase := strings.TrimRight(string(buf), "\r\n")
+		if passphrase == "" {
+			return nil, fmt.Errorf("passphrase is empty")
+		}
+		return &ShareCipher{passphrase: []byte(passphrase)}, nil
+	case keyFile != "":
+		buf, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("fail to read key file %s: %w", keyFile, err)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+		if err != nil {
+			return nil, fmt.Errorf("fail to decode key: %w", err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key should be 32 bytes, got %d", len(key))
+		}
+		return &ShareCipher{key: key}, nil
+	default:
+		return nil, nil
+	}
+}
+
+func newShareAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts the keyshare, aad binds the ciphertext to the file it's stored in
+func (c *ShareCipher) Seal(aad []byte, plaintext []byte) ([]byte, error) {
+	share := encryptedShare{
+		Version: shareEncryptionVersion,
+		KDF:     kdfNone,
+	}
+	key := c.key
+	if c.passphrase != nil {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, fmt.Errorf("fail to generate salt: %w", err)
+		}
+		share.KDF = kdfArgon2id
+		share.Salt = hex.EncodeToString(salt)
+		share.Time = argon2Time
+		share.Memory = argon2Memory
+		share.Threads = argon2Threads
+		key = argon2.IDKey(c.passphrase, salt, share.Time, share.Memory, share.Threads, 32)
+	}
+	aead, err := newShareAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("fail to generate nonce: %w", err)
+	}
+	share.Nonce = hex.EncodeToString(nonce)
+	share.Ciphertext = base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, plaintext, aad))
+	return json.MarshalIndent(share, "", "  ")
+}
+
+// Open decrypts a keyshare sealed by Seal
+func (c *ShareCipher) Open(aad []byte, data []byte) ([]byte, error) {
+	share, ok := parseEncryptedShare(data)
+	if !ok {
+		return nil, ErrShareNotEncrypted
+	}
+	if share.Version != shareEncryptionVersion {
+		return nil, fmt.Errorf("unsupported keyshare encryption version %d", share.Version)
+	}
+	var key []byte
+	switch share.KDF {
+	case kdfArgon2id:
+		if c.passphrase == nil {
+			return nil, fmt.Errorf("keyshare is encrypted with a passphrase")
+		}
+		salt, err := hex.DecodeString(share.Salt)
+		if err != nil {
+			return nil, fmt.Errorf("fail to decode salt: %w", err)
+		}
+		// the parameters come from the file, bounded so a crafted file can't exhaust the memory or the cpu
+		// before the authentication fails
+		if share.Time == 0 || share.Time > argon2Time || share.Memory == 0 || share.Memory > argon2Memory ||
+			share.Threads == 0 || share.Threads > argon2Threads {
+			return nil, fmt.Errorf("invalid argon2id parameters, time %d, memory %d, threads %d", share.Time, share.Memory, share.Threads)
+		}
+		key = argon2.IDKey(c.passphrase, salt, share.Time, share.Memory, share.Threads, 32)
+	case kdfNone:
+		if c.key == nil {
+			return nil, fmt.Errorf("keyshare is encrypted with a key file")
+		}
+		key = c.key
+	default:
+		return nil, fmt.Errorf("unsupported kdf %s", share.KDF)
+	}
+	aead, err := newShareAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(share.Nonce)
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(share.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("fail to decode ciphertext: %w", err)
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("fail to decrypt keyshare, wrong passphrase or key: %w", err)
+	}
+	return plaintext, nil
+}
+
+// parseEncryptedShare tells an encrypted keyshare file apart from a clear text one, which is plain base64
+func parseEncryptedShare(data []byte) (encryptedShare, bool) {
+	var share encryptedShare
+	if err := json.Unmarshal(data, &share); err != nil {
+		return share, false
+	}
+	return share, share.Version > 0 && share.Ciphertext != ""
+}
+
+// writeFileAtomic writes data to a temporary file next to fileName and renames it over fileName,
+// so a crash never leaves a partially written file behind
+func writeFileAtomic(fileName string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("fail to create temp file: %w", err)
+	}
+	tmpName := tmp.Name()
+	defer func() {
+		// no-op once the file is renamed
+		_ = os.Remove(tmpName)
+	}()
+	if err := tmp.Chmod(perm); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("fail to set permission of %s: %w", tmpName, err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("fail to write %s: %w", tmpName, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("fail to sync %s: %w", tmpName, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("fail to close %s: %w", tmpName, err)
+	}
+	if err := os.Rename(tmpName, fileName); err != nil {
+		return fmt.Errorf("fail to rename %s to %s: %w", tmpName, fileName, err)
+	}
+	return nil
+}
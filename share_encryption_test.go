@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShareCipher(t *testing.T) {
+	dir := t.TempDir()
+	passphraseFile := filepath.Join(dir, "passphrase")
+	if err := os.WriteFile(passphraseFile, []byte("correct horse battery staple\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadShareCipher(passphraseFile, keyFile); err == nil {
+		t.Fatal("passphrase file and key file should not be set together")
+	}
+	if shareCipher, err := LoadShareCipher("", ""); err != nil || shareCipher != nil {
+		t.Fatal("no share cipher is expected without passphrase file and key file")
+	}
+	passphraseCipher, err := LoadShareCipher(passphraseFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyCipher, err := LoadShareCipher("", keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, shareCipher := range map[string]*ShareCipher{"passphrase": passphraseCipher, "key": keyCipher} {
+		t.Run(name, func(t *testing.T) {
+			aad := []byte("pubkey-first.json")
+			sealed, err := shareCipher.Seal(aad, []byte("keyshare"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			plaintext, err := shareCipher.Open(aad, sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(plaintext) != "keyshare" {
+				t.Fatalf("expected keyshare, got %s", plaintext)
+			}
+			if _, err := shareCipher.Open([]byte("pubkey-second.json"), sealed); err == nil {
+				t.Fatal("keyshare should not decrypt from another file")
+			}
+			if _, err := shareCipher.Open(aad, []byte("a2V5c2hhcmU=")); err != ErrShareNotEncrypted {
+				t.Fatalf("expected ErrShareNotEncrypted, got %v", err)
+			}
+		})
+	}
+	sealed, err := passphraseCipher.Seal(nil, []byte("keyshare"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&ShareCipher{passphrase: []byte("wrong passphrase")}).Open(nil, sealed); err == nil {
+		t.Fatal("keyshare should not decrypt with a wrong passphrase")
+	}
+	if _, err := keyCipher.Open(nil, sealed); err == nil {
+		t.Fatal("keyshare encrypted with a passphrase should not decrypt with a key")
+	}
+	var share map[string]any
+	if err := json.Unmarshal(sealed, &share); err != nil {
+		t.Fatal(err)
+	}
+	share["memory"] = 16 * 1024 * 1024
+	crafted, err := json.Marshal(share)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := passphraseCipher.Open(nil, crafted); err == nil || !strings.Contains(err.Error(), "invalid argon2id parameters") {
+		t.Fatalf("expected argon2id parameters above the defaults to be rejected, got %v", err)
+	}
+}
+
+func TestEncryptedLocalStateAccessor(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	accessor := NewEncryptedLocalStateAccessor("first", &ShareCipher{passphrase: []byte("passphrase")})
+	if err := accessor.SaveLocalState("pubkey", "a2V5c2hhcmU="); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat("pubkey-first.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected mode 0600, got %v", info.Mode().Perm())
+	}
+	entries, err := os.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("temp file should be renamed, got %d files", len(entries))
+	}
+	localState, err := accessor.GetLocalState("pubkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if localState != "a2V5c2hhcmU=" {
+		t.Fatalf("unexpected local state %s", localState)
+	}
+	if _, err := NewLocalStateAccessorImp("first").GetLocalState("pubkey"); err == nil {
+		t.Fatal("encrypted keyshare should not be read without passphrase")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Timeouts bound the phases of a ceremony, a phase has no time limit when its timeout is 0
+type Timeouts struct {
+	// Join is how long to wait for the other parties to join the session and the leader to start it
+	Join time.Duration
+	// Setup is how long uploading or fetching the setup message may take
+	Setup time.Duration
+	// Protocol is how long the protocol may run once the session is started
+	Protocol time.Duration
+	// Liveness is how long a party may not send heartbeats while the protocol runs before it's unresponsive
+	Liveness time.Duration
+	// Complete is how long a party waits for the others to confirm they finished, before it keeps the result
+	Complete time.Duration
+}
+
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Join:     5 * time.Minute,
+		Setup:    time.Minute,
+		Protocol: 2 * time.Minute,
+		Liveness: 30 * time.Second,
+		Complete: time.Minute,
+	}
+}
+
+// SetTimeouts sets the deadlines of the phases of every ceremony run by the service
+func (t *TssService) SetTimeouts(timeouts Timeouts) {
+	t.timeouts = timeouts
+}
+
+// withTimeout derives the context of a phase from ctx, it's only canceled with ctx when timeout is 0
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
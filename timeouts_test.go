@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vultisig/test-dkls/relay"
+)
+
+func TestCeremonyTimeouts(t *testing.T) {
+	parties := []string{"first", "second"}
+	chainCode := "80871c0f885f953e5206e461630a9222148797e66276a83224c7b9b0f75b3ec0"
+	newTss := func() *TssService {
+		tss, err := NewTssService(NewMemoryTransport(relay.NewServer()), newMemoryStateAccessor(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tss
+	}
+
+	// the leader never starts the session
+	tss := newTss()
+	tss.SetTimeouts(Timeouts{Join: 100 * time.Millisecond})
+	start := time.Now()
+	err := tss.Keygen(context.Background(), "join-timeout", chainCode, "second", parties, 0, false)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected join timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("join timeout took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	err = newTss().Keygen(ctx, "interrupted", chainCode, "first", parties, 0, true)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled keygen, got %v", err)
+	}
+}
+
+func TestProtocolTimeout(t *testing.T) {
+	parties := []string{"first", "second"}
+	// every party delivered all its rounds, the protocol just ran out of time
+	tracker := newInboundTracker("second", logrus.StandardLogger())
+	tracker.Track(newEnvelope("session", "first", 1, "round 1"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+	for _, timeoutErr := range []error{TssKeyGenTimeout, ErrKeysignTimeout} {
+		err := protocolError(ctx, timeoutErr, tracker, []string{"session"}, parties)
+		if !errors.Is(err, timeoutErr) {
+			t.Fatalf("expected %v, got %v", timeoutErr, err)
+		}
+		var unresponsive *ErrPartyUnresponsive
+		if errors.As(err, &unresponsive) || errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected only the timeout, got %v", err)
+		}
+		var abortErr *ErrProtocolAbort
+		if !errors.As(err, &abortErr) || len(abortErr.Undelivered) != 0 {
+			t.Fatalf("expected protocol abort without undelivered rounds, got %v", err)
+		}
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := protocolError(ctx, ErrKeysignTimeout, tracker, []string{"session"}, parties); !errors.Is(err, context.Canceled) || errors.Is(err, ErrKeysignTimeout) {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vultisig/test-dkls/relay"
+)
+
+// Transport is how the parties of a session find each other and exchange messages. The waits return
+// the error of ctx once it's done.
+type Transport interface {
+	// RegisterSession joins the local party to the session
+	RegisterSession(ctx context.Context, sessionID, localPartyID string) error
+	// WaitAllParties blocks until exactly the given parties joined the session
+	WaitAllParties(ctx context.Context, sessionID string, parties []string) error
+	StartSession(ctx context.Context, sessionID string, parties []string) error
+	// WaitForSessionStart blocks until the session is started and returns the parties it's started with
+	WaitForSessionStart(ctx context.Context, sessionID string) ([]string, error)
+	CompleteSession(ctx context.Context, sessionID, localPartyID string) error
+	WaitForSessionComplete(ctx context.Context, sessionID string, parties []string) error
+	// UploadPayload sets the setup message of the session
+	UploadPayload(ctx context.Context, sessionID, payload string) error
+	GetPayload(ctx context.Context, sessionID string) (string, error)
+	Send(ctx context.Context, sessionID string, message relay.Message) error
+	// Heartbeat tells the other parties the local party is alive
+	Heartbeat(ctx context.Context, sessionID, localPartyID string) error
+	// Heartbeats returns how long ago each party sent its last heartbeat
+	Heartbeats(ctx context.Context, sessionID string) (map[string]time.Duration, error)
+	// Receive starts receiving the messages addressed to the local party, until ctx is done or the
+	// receiver is closed
+	Receive(ctx context.Context, sessionID, localPartyID string) MessageReceiver
+}
+
+// HTTPTransport talks to a relay server over HTTP
+type HTTPTransport struct {
+	server      string
+	streaming   bool
+	retryPolicy RetryPolicy
+	logger      *logrus.Logger
+}
+
+var _ Transport = &HTTPTransport{}
+
+// NewHTTPTransport creates a transport to the relay server, inboundTransport is either InboundStream or InboundPoll
+func NewHTTPTransport(server string, inboundTransport string) (*HTTPTransport, error) {
+	if inboundTransport != InboundStream && inboundTransport != InboundPoll {
+		return nil, fmt.Errorf("invalid inbound transport %s, expect %s or %s", inboundTransport, InboundStream, InboundPoll)
+	}
+	return &HTTPTransport{
+		server:      server,
+		streaming:   inboundTransport == InboundStream,
+		retryPolicy: DefaultRetryPolicy(),
+		logger:      logrus.WithField("service", "transport").Logger,
+	}, nil
+}
+
+// SetRetryPolicy sets how the requests to the relay server are retried
+func (h *HTTPTransport) SetRetryPolicy(policy RetryPolicy) {
+	h.retryPolicy = policy
+}
+
+func (h *HTTPTransport) Send(ctx context.Context, sessionID string, message relay.Message) error {
+	buf, err := json.MarshalIndent(message, "", "  ")
+	if err != nil {
+		return fmt.Errorf("fail to marshal message: %w", err)
+	}
+
+	// the relay drops a message it already queued, so a retried message is only delivered once
+	resp, err := h.retryPolicy.request(ctx, http.MethodPost, fmt.Sprintf("%s/message/%s", h.server, sessionID), buf)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			h.logger.Error("failed to close response body", "error", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("fail to send message, response code is not 202 Accepted: %s", resp.Status)
+	}
+	return nil
+}
+
+func (h *HTTPTransport) Receive(ctx context.Context, sessionID, localPartyID string) MessageReceiver {
+	return newRelayReceiver(ctx, h.server, sessionID, localPartyID, h.streaming, h.retryPolicy)
+}
+
+// MemoryTransport connects parties running in the same process, all of them need to share the relay server
+type MemoryTransport struct {
+	relay *relay.Server
+}
+
+var _ Transport = &MemoryTransport{}
+
+func NewMemoryTransport(relayServer *relay.Server) *MemoryTransport {
+	return &MemoryTransport{
+		relay: relayServer,
+	}
+}
+
+// wait blocks until done returns true, done is checked again on every change of the session
+func (m *MemoryTransport) wait(ctx context.Context, sessionID string, done func() bool) error {
+	for {
+		changed, ok := m.relay.Changed(sessionID)
+		if !ok {
+			return fmt.Errorf("session %s doesn't exist", sessionID)
+		}
+		if done() {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fmt.Errorf("fail to wait for session %s: %w", sessionID, ctx.Err())
+		}
+	}
+}
+
+func (m *MemoryTransport) RegisterSession(_ context.Context, sessionID, localPartyID string) error {
+	m.relay.Register(sessionID, []string{localPartyID})
+	return nil
+}
+
+func (m *MemoryTransport) WaitAllParties(ctx context.Context, sessionID string, parties []string) error {
+	return m.wait(ctx, sessionID, func() bool {
+		joined, _ := m.relay.Parties(sessionID)
+		if len(joined) != len(parties) {
+			return false
+		}
+		for _, party := range parties {
+			if !slices.Contains(joined, party) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func (m *MemoryTransport) StartSession(_ context.Context, sessionID string, parties []string) error {
+	m.relay.Start(sessionID, parties)
+	return nil
+}
+
+func (m *MemoryTransport) WaitForSessionStart(ctx context.Context, sessionID string) ([]string, error) {
+	var started []string
+	err := m.wait(ctx, sessionID, func() bool {
+		started = m.relay.Started(sessionID)
+		return len(started) > 0
+	})
+	return started, err
+}
+
+func (m *MemoryTransport) CompleteSession(_ context.Context, sessionID, localPartyID string) error {
+	m.relay.Complete(sessionID, []string{localPartyID})
+	return nil
+}
+
+func (m *MemoryTransport) WaitForSessionComplete(ctx context.Context, sessionID string, parties []string) error {
+	return m.wait(ctx, sessionID, func() bool {
+		completed := m.relay.Completed(sessionID)
+		for _, party := range parties {
+			if !slices.Contains(completed, party) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func (m *MemoryTransport) UploadPayload(_ context.Context, sessionID, payload string) error {
+	m.relay.SetSetupMessage(sessionID, payload)
+	return nil
+}
+
+func (m *MemoryTransport) GetPayload(_ context.Context, sessionID string) (string, error) {
+	payload, ok := m.relay.SetupMessage(sessionID)
+	if !ok {
+		return "", fmt.Errorf("fail to get payload: setup message of %s not found", sessionID)
+	}
+	return payload, nil
+}
+
+func (m *MemoryTransport) Send(_ context.Context, sessionID string, message relay.Message) error {
+	m.relay.Post(sessionID, message)
+	return nil
+}
+
+func (m *MemoryTransport) Heartbeat(_ context.Context, sessionID, localPartyID string) error {
+	m.relay.Heartbeat(sessionID, []string{localPartyID})
+	return nil
+}
+
+func (m *MemoryTransport) Heartbeats(_ context.Context, sessionID string) (map[string]time.Duration, error) {
+	heartbeats, ok := m.relay.Heartbeats(sessionID)
+	if !ok {
+		return nil, fmt.Errorf("fail to get heartbeats: session %s doesn't exist", sessionID)
+	}
+	return heartbeats, nil
+}
+
+func (m *MemoryTransport) Receive(ctx context.Context, sessionID, localPartyID string) MessageReceiver {
+	// the receiver may start before the session is registered
+	m.relay.Register(sessionID, nil)
+	ctx, cancel := context.WithCancel(ctx)
+	r := &memoryReceiver{
+		relay:        m.relay,
+		sessionID:    sessionID,
+		localPartyID: localPartyID,
+		messages:     make(chan []relay.Message),
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+	go r.run()
+	return r
+}
+
+type memoryReceiver struct {
+	relay        *relay.Server
+	sessionID    string
+	localPartyID string
+	messages     chan []relay.Message
+	ctx          context.Context
+	cancel       context.CancelFunc
+}
+
+var _ MessageReceiver = &memoryReceiver{}
+
+func (r *memoryReceiver) Messages() <-chan []relay.Message {
+	return r.messages
+}
+
+func (r *memoryReceiver) Ack(hash string) error {
+	r.relay.DeleteMessage(r.sessionID, r.localPartyID, hash)
+	return nil
+}
+
+func (r *memoryReceiver) Close() {
+	r.cancel()
+}
+
+// run pushes the queued messages to the consumer whenever the session changes
+func (r *memoryReceiver) run() {
+	sent := make(map[string]bool)
+	for {
+		changed, ok := r.relay.Changed(r.sessionID)
+		if !ok {
+			return
+		}
+		pending, _ := r.relay.Messages(r.sessionID, r.localPartyID)
+		var messages []relay.Message
+		for _, message := range pending {
+			if !sent[message.Hash] {
+				sent[message.Hash] = true
+				messages = append(messages, message)
+			}
+		}
+		if len(messages) > 0 {
+			select {
+			case r.messages <- messages:
+			case <-r.ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-changed:
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vultisig/test-dkls/relay"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	relayServer := relay.NewServer()
+	first := NewMemoryTransport(relayServer)
+	second := NewMemoryTransport(relayServer)
+	sessionID := "test-session"
+	parties := []string{"first", "second"}
+	ctx := context.Background()
+	if err := first.RegisterSession(ctx, sessionID, "first"); err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan []string, 1)
+	go func() {
+		if err := second.RegisterSession(ctx, sessionID, "second"); err != nil {
+			t.Error(err)
+		}
+		startedParties, err := second.WaitForSessionStart(ctx, sessionID)
+		if err != nil {
+			t.Error(err)
+		}
+		started <- startedParties
+	}()
+	if err := first.WaitAllParties(ctx, sessionID, parties); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.UploadPayload(ctx, sessionID, "setup"); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.StartSession(ctx, sessionID, parties); err != nil {
+		t.Fatal(err)
+	}
+	if startedParties := <-started; len(startedParties) != len(parties) {
+		t.Fatalf("expected %d parties, got %d", len(parties), len(startedParties))
+	}
+	setupMessage, err := second.GetPayload(ctx, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setupMessage != "setup" {
+		t.Fatalf("expected setup message, got %s", setupMessage)
+	}
+
+	receiver := second.Receive(ctx, sessionID, "second")
+	defer receiver.Close()
+	if err := NewMessageImp(first, sessionID).Send(ctx, "first", "second", "aGVsbG8="); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case messages := <-receiver.Messages():
+		if len(messages) != 1 || messages[0].From != "first" || messages[0].Body != "aGVsbG8=" {
+			t.Fatalf("unexpected messages: %+v", messages)
+		}
+		if err := receiver.Ack(messages[0].Hash); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message is not received")
+	}
+	if messages, _ := relayServer.Messages(sessionID, "second"); len(messages) != 0 {
+		t.Fatal("acknowledged message should be deleted")
+	}
+
+	if err := first.CompleteSession(ctx, sessionID, "first"); err != nil {
+		t.Fatal(err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := first.WaitForSessionComplete(waitCtx, sessionID, parties); err == nil {
+		t.Fatal("session should not be complete before all parties complete it")
+	}
+	if err := second.CompleteSession(ctx, sessionID, "second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.WaitForSessionComplete(ctx, sessionID, parties); err != nil {
+		t.Fatal(err)
+	}
+}
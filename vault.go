@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 )
 
 type Keyshare struct {
@@ -19,13 +20,34 @@ type Vault struct {
 	HexChainCode   string     `json:"hex_chain_code"`
 	KeyShares      []Keyshare `json:"key_shares"`
 	LocalPartyID   string     `json:"local_party_id"`
+	// PendingKeyShares are refreshed keyshares waiting to replace the ones in KeyShares
+	PendingKeyShares []Keyshare `json:"pending_key_shares,omitempty"`
+	// Presigns are the pre-signatures of the keyshares, by presign key
+	Presigns map[string]string `json:"presigns,omitempty"`
 }
 
-func GetVaultFromFile(file string) (*Vault, error) {
+// GetVaultFromFile reads a vault file, a vault sealed by VaultStateAccessor is opened with shareCipher
+func GetVaultFromFile(file string, shareCipher *ShareCipher) (*Vault, error) {
 	data, err := os.ReadFile(file)
 	if err != nil {
 		return nil, fmt.Errorf("fail to read from file %s: %w", file, err)
 	}
+	return decodeVault(file, data, shareCipher)
+}
+
+// decodeVault turns the content of a vault file back to the vault, the file name is the associated data of
+// a sealed vault
+func decodeVault(file string, data []byte, shareCipher *ShareCipher) (*Vault, error) {
+	if _, ok := parseEncryptedShare(data); ok {
+		if shareCipher == nil {
+			return nil, fmt.Errorf("vault file %s is encrypted, passphrase file or key file is required", file)
+		}
+		var err error
+		data, err = shareCipher.Open([]byte(filepath.Base(file)), data)
+		if err != nil {
+			return nil, fmt.Errorf("fail to decrypt vault file %s: %w", file, err)
+		}
+	}
 	var vault Vault
 	if err := json.Unmarshal(data, &vault); err != nil {
 		return nil, fmt.Errorf("fail to unmarshal data: %w", err)
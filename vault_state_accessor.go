@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// VaultStateAccessor keeps all the keyshares of the local party in one vault file, in the same format
+// GetVaultFromFile reads, so a keygen of both curves ends up in a single importable vault per party.
+// The raw keyshares are the base64 encoded DKLS / schnorr keyshares.
+type VaultStateAccessor struct {
+	vaultFile    string
+	localPartyID string
+	shareCipher  *ShareCipher
+	mu           sync.Mutex
+}
+
+var _ KeyshareStore = &VaultStateAccessor{}
+
+// NewVaultStateAccessor creates a local state accessor backed by vaultFile, the vault is sealed with
+// shareCipher when it's not nil. A plaintext vault is still read, it's sealed the next time it's saved.
+func NewVaultStateAccessor(vaultFile string, localPartyID string, shareCipher *ShareCipher) *VaultStateAccessor {
+	return &VaultStateAccessor{
+		vaultFile:    vaultFile,
+		localPartyID: localPartyID,
+		shareCipher:  shareCipher,
+	}
+}
+
+// loadVault reads the vault file, a new vault is returned when the file doesn't exist yet
+func (v *VaultStateAccessor) loadVault() (*Vault, error) {
+	buf, err := os.ReadFile(v.vaultFile)
+	if os.IsNotExist(err) {
+		return &Vault{
+			Name:         strings.TrimSuffix(filepath.Base(v.vaultFile), filepath.Ext(v.vaultFile)),
+			LocalPartyID: v.localPartyID,
+		}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fail to read vault file %s: %w", v.vaultFile, err)
+	}
+	vault, err := decodeVault(v.vaultFile, buf, v.shareCipher)
+	if err != nil {
+		return nil, err
+	}
+	if vault.LocalPartyID != "" && vault.LocalPartyID != v.localPartyID {
+		return nil, fmt.Errorf("vault file %s belongs to %s, not %s", v.vaultFile, vault.LocalPartyID, v.localPartyID)
+	}
+	return vault, nil
+}
+
+func (v *VaultStateAccessor) saveVault(vault *Vault) error {
+	buf, err := json.MarshalIndent(vault, "", "  ")
+	if err != nil {
+		return fmt.Errorf("fail to marshal vault: %w", err)
+	}
+	if v.shareCipher != nil {
+		buf, err = v.shareCipher.Seal([]byte(filepath.Base(v.vaultFile)), buf)
+		if err != nil {
+			return fmt.Errorf("fail to encrypt vault file %s: %w", v.vaultFile, err)
+		}
+	}
+	return writeFileAtomic(v.vaultFile, buf, 0600)
+}
+
+func (v *VaultStateAccessor) GetLocalState(pubKey string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	vault, err := v.loadVault()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(pubKey, chainCodeSuffix) {
+		if vault.HexChainCode == "" {
+			return "", fmt.Errorf("vault %s has no chain code", v.vaultFile)
+		}
+		return vault.HexChainCode, nil
+	}
+	if strings.Contains(pubKey, presignInfix) {
+		presign, ok := vault.Presigns[pubKey]
+		if !ok {
+			return "", fmt.Errorf("presign %s does not exist in vault %s", pubKey, v.vaultFile)
+		}
+		return presign, nil
+	}
+	keyshares := vault.KeyShares
+	if strings.HasSuffix(pubKey, pendingSuffix) {
+		keyshares, pubKey = vault.PendingKeyShares, strings.TrimSuffix(pubKey, pendingSuffix)
+	}
+	for _, keyshare := range keyshares {
+		if keyshare.PublicKey == pubKey {
+			return keyshare.RawKeyshare, nil
+		}
+	}
+	return "", fmt.Errorf("keyshare of %s does not exist in vault %s", pubKey, v.vaultFile)
+}
+
+func (v *VaultStateAccessor) SaveLocalState(pubKey, localState string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	vault, err := v.loadVault()
+	if err != nil {
+		return err
+	}
+	vault.LocalPartyID = v.localPartyID
+	if strings.HasSuffix(pubKey, chainCodeSuffix) {
+		// both curves are generated from the same chain code
+		if vault.HexChainCode != "" && vault.HexChainCode != localState {
+			return fmt.Errorf("vault %s already has a different chain code", v.vaultFile)
+		}
+		vault.HexChainCode = localState
+		return v.saveVault(vault)
+	}
+	if strings.Contains(pubKey, presignInfix) {
+		if vault.Presigns == nil {
+			vault.Presigns = make(map[string]string)
+		}
+		vault.Presigns[pubKey] = localState
+		return v.saveVault(vault)
+	}
+	if strings.HasSuffix(pubKey, pendingSuffix) {
+		vault.PendingKeyShares = upsertKeyshare(vault.PendingKeyShares, strings.TrimSuffix(pubKey, pendingSuffix), localState)
+		return v.saveVault(vault)
+	}
+	curve, err := curveOfPublicKey(pubKey)
+	if err != nil {
+		return err
+	}
+	if curve == CurveECDSA {
+		vault.PublicKeyECDSA = pubKey
+	} else {
+		vault.PublicKeyEDDSA = pubKey
+	}
+	vault.KeyShares = upsertKeyshare(vault.KeyShares, pubKey, localState)
+	return v.saveVault(vault)
+}
+
+// upsertKeyshare replaces the keyshare of pubKey, or appends it when there is none
+func upsertKeyshare(keyshares []Keyshare, pubKey string, localState string) []Keyshare {
+	for i := range keyshares {
+		if keyshares[i].PublicKey == pubKey {
+			keyshares[i].RawKeyshare = localState
+			return keyshares
+		}
+	}
+	return append(keyshares, Keyshare{
+		PublicKey:   pubKey,
+		RawKeyshare: localState,
+	})
+}
+
+// SaveMetadata makes the committee of the keyshare being saved the signers of the vault, the vault format has
+// no place for the rest. The signers are replaced rather than merged, so the parties a reshare removed are
+// not listed anymore. The vault has one list for both curves, it's the committee of the last saved keyshare.
+func (v *VaultStateAccessor) SaveMetadata(metadata KeyshareMetadata) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	vault, err := v.loadVault()
+	if err != nil {
+		return err
+	}
+	vault.Signers = slices.Clone(metadata.Committee)
+	return v.saveVault(vault)
+}
+
+func (v *VaultStateAccessor) List() ([]KeyshareMetadata, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	vault, err := v.loadVault()
+	if err != nil {
+		return nil, err
+	}
+	var result []KeyshareMetadata
+	for _, keyshare := range vault.KeyShares {
+		curve, err := curveOfPublicKey(keyshare.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, KeyshareMetadata{
+			PublicKey:    keyshare.PublicKey,
+			Curve:        curve,
+			LocalPartyID: vault.LocalPartyID,
+			Committee:    vault.Signers,
+		})
+	}
+	return result, nil
+}
+
+func (v *VaultStateAccessor) Delete(pubKey string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	vault, err := v.loadVault()
+	if err != nil {
+		return err
+	}
+	if strings.Contains(pubKey, presignInfix) {
+		if _, ok := vault.Presigns[pubKey]; !ok {
+			return fmt.Errorf("presign %s does not exist in vault %s", pubKey, v.vaultFile)
+		}
+		delete(vault.Presigns, pubKey)
+		return v.saveVault(vault)
+	}
+	isPubKey := func(keyshare Keyshare) bool {
+		return keyshare.PublicKey == strings.TrimSuffix(pubKey, pendingSuffix)
+	}
+	if strings.HasSuffix(pubKey, pendingSuffix) {
+		if !slices.ContainsFunc(vault.PendingKeyShares, isPubKey) {
+			return fmt.Errorf("pending keyshare of %s does not exist in vault %s", pubKey, v.vaultFile)
+		}
+		vault.PendingKeyShares = slices.DeleteFunc(vault.PendingKeyShares, isPubKey)
+		maps.DeleteFunc(vault.Presigns, func(key string, _ string) bool {
+			return strings.HasPrefix(key, presignKey(pubKey, ""))
+		})
+		return v.saveVault(vault)
+	}
+	idx := slices.IndexFunc(vault.KeyShares, isPubKey)
+	if idx < 0 {
+		return fmt.Errorf("keyshare of %s does not exist in vault %s", pubKey, v.vaultFile)
+	}
+	vault.KeyShares = slices.Delete(vault.KeyShares, idx, idx+1)
+	vault.PendingKeyShares = slices.DeleteFunc(vault.PendingKeyShares, isPubKey)
+	switch pubKey {
+	case vault.PublicKeyECDSA:
+		vault.PublicKeyECDSA = ""
+	case vault.PublicKeyEDDSA:
+		vault.PublicKeyEDDSA = ""
+	}
+	return v.saveVault(vault)
+}
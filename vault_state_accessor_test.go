@@ -0,0 +1,153 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVaultStateAccessor(t *testing.T) {
+	ecdsaPublicKey := "02" + strings.Repeat("ab", 32)
+	eddsaPublicKey := strings.Repeat("cd", 32)
+	chainCode := strings.Repeat("ef", 32)
+	signers := []string{"first", "second", "third"}
+	keyCipher := &ShareCipher{key: make([]byte, 32)}
+	for name, shareCipher := range map[string]*ShareCipher{"clear": nil, "encrypted": keyCipher} {
+		t.Run(name, func(t *testing.T) {
+			vaultFile := filepath.Join(t.TempDir(), "wallet.json")
+			accessor := NewVaultStateAccessor(vaultFile, "first", shareCipher)
+			if _, err := accessor.GetLocalState(ecdsaPublicKey); err == nil {
+				t.Fatal("keyshare should not exist before it's saved")
+			}
+			for key, value := range map[string]string{
+				ecdsaPublicKey:               "ecdsa keyshare",
+				chainCodeKey(ecdsaPublicKey): chainCode,
+				eddsaPublicKey:               "eddsa keyshare",
+				chainCodeKey(eddsaPublicKey): chainCode,
+			} {
+				if err := accessor.SaveLocalState(key, value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := accessor.SaveMetadata(KeyshareMetadata{PublicKey: ecdsaPublicKey, Committee: signers}); err != nil {
+				t.Fatal(err)
+			}
+			// a reshare removed a party, it's not a signer anymore
+			if err := accessor.SaveMetadata(KeyshareMetadata{PublicKey: eddsaPublicKey, Committee: signers[:2]}); err != nil {
+				t.Fatal(err)
+			}
+			// reshare replaces the keyshare of the same public key
+			if err := accessor.SaveLocalState(ecdsaPublicKey, "new ecdsa keyshare"); err != nil {
+				t.Fatal(err)
+			}
+			if err := accessor.SaveLocalState(chainCodeKey(ecdsaPublicKey), strings.Repeat("00", 32)); err == nil {
+				t.Fatal("a different chain code should be rejected")
+			}
+			// a pending refreshed keyshare doesn't replace the keyshare until it's committed
+			if err := accessor.SaveLocalState(pendingKeyshareKey(eddsaPublicKey), "pending eddsa keyshare"); err != nil {
+				t.Fatal(err)
+			}
+			if value, err := accessor.GetLocalState(pendingKeyshareKey(eddsaPublicKey)); err != nil || value != "pending eddsa keyshare" {
+				t.Fatalf("expected pending eddsa keyshare, got %s, %v", value, err)
+			}
+			if list, err := accessor.List(); err != nil || len(list) != 2 {
+				t.Fatalf("pending keyshare should not be listed, got %+v, %v", list, err)
+			}
+			if err := accessor.Delete(pendingKeyshareKey(eddsaPublicKey)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := accessor.GetLocalState(pendingKeyshareKey(eddsaPublicKey)); err == nil {
+				t.Fatal("deleted pending keyshare should not exist")
+			}
+			if err := accessor.SaveLocalState(presignKey(ecdsaPublicKey, "1"), "presign"); err != nil {
+				t.Fatal(err)
+			}
+			if value, err := accessor.GetLocalState(presignKey(ecdsaPublicKey, "1")); err != nil || value != "presign" {
+				t.Fatalf("expected presign, got %s, %v", value, err)
+			}
+			if err := accessor.Delete(presignKey(ecdsaPublicKey, "1")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := accessor.GetLocalState(presignKey(ecdsaPublicKey, "1")); err == nil {
+				t.Fatal("deleted presign should not exist")
+			}
+
+			accessor = NewVaultStateAccessor(vaultFile, "first", shareCipher)
+			for key, expected := range map[string]string{
+				ecdsaPublicKey:               "new ecdsa keyshare",
+				eddsaPublicKey:               "eddsa keyshare",
+				chainCodeKey(eddsaPublicKey): chainCode,
+			} {
+				value, err := accessor.GetLocalState(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if value != expected {
+					t.Fatalf("expected %s for %s, got %s", expected, key, value)
+				}
+			}
+			if _, err := NewVaultStateAccessor(vaultFile, "second", shareCipher).GetLocalState(ecdsaPublicKey); err == nil {
+				t.Fatal("vault of another party should not be used")
+			}
+			info, err := os.Stat(vaultFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0600 {
+				t.Fatalf("expected mode 0600, got %v", info.Mode().Perm())
+			}
+			if shareCipher != nil {
+				if _, err := NewVaultStateAccessor(vaultFile, "first", nil).GetLocalState(ecdsaPublicKey); err == nil {
+					t.Fatal("encrypted vault should not be read without the share cipher")
+				}
+				if _, err := GetVaultFromFile(vaultFile, nil); err == nil {
+					t.Fatal("encrypted vault should not be read without the share cipher")
+				}
+			}
+			vault, err := GetVaultFromFile(vaultFile, shareCipher)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if vault.Name != "wallet" || vault.LocalPartyID != "first" || vault.HexChainCode != chainCode {
+				t.Fatalf("unexpected vault: %+v", vault)
+			}
+			if vault.PublicKeyECDSA != ecdsaPublicKey || vault.PublicKeyEDDSA != eddsaPublicKey {
+				t.Fatalf("unexpected public keys: %s, %s", vault.PublicKeyECDSA, vault.PublicKeyEDDSA)
+			}
+			if strings.Join(vault.Signers, ",") != strings.Join(signers[:2], ",") || len(vault.KeyShares) != 2 {
+				t.Fatalf("unexpected vault: %+v", vault)
+			}
+		})
+	}
+}
+
+func TestVaultStateAccessorSealsPlaintextVault(t *testing.T) {
+	ecdsaPublicKey := "02" + strings.Repeat("ab", 32)
+	vaultFile := filepath.Join(t.TempDir(), "wallet.json")
+	if err := NewVaultStateAccessor(vaultFile, "first", nil).SaveLocalState(ecdsaPublicKey, "ecdsa keyshare"); err != nil {
+		t.Fatal(err)
+	}
+	shareCipher := &ShareCipher{key: make([]byte, 32)}
+	accessor := NewVaultStateAccessor(vaultFile, "first", shareCipher)
+	if keyshare, err := accessor.GetLocalState(ecdsaPublicKey); err != nil || keyshare != "ecdsa keyshare" {
+		t.Fatalf("plaintext vault should still be read, got %s, %v", keyshare, err)
+	}
+	if err := accessor.SaveMetadata(KeyshareMetadata{PublicKey: ecdsaPublicKey, Committee: []string{"first", "second"}}); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(vaultFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := parseEncryptedShare(buf); !ok {
+		t.Fatal("vault should be sealed once it's saved with the share cipher")
+	}
+	vault, err := GetVaultFromFile(vaultFile, shareCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vault.KeyShares) != 1 || vault.KeyShares[0].RawKeyshare != "ecdsa keyshare" {
+		t.Fatalf("unexpected vault: %+v", vault)
+	}
+}